@@ -2,15 +2,20 @@ package cmd
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/tommyknows/packa/pkg/controller"
 	"github.com/tommyknows/packa/pkg/defaults"
 	"github.com/tommyknows/packa/pkg/handlers/brew"
 	"github.com/tommyknows/packa/pkg/handlers/goget"
+	"github.com/tommyknows/packa/pkg/handlers/plugin"
+	"github.com/tommyknows/packa/pkg/handlers/script"
 	"github.com/tommyknows/packa/pkg/output"
 	"k8s.io/klog"
 )
@@ -31,44 +36,82 @@ type PackageHandler interface {
 
 // NewPackaCommand returns the root command for packa
 func NewPackaCommand() *cobra.Command {
-	var cfgFile string
-	var ctl *controller.Controller
-	cmd := &cobra.Command{
-		Version:      version,
-		Use:          Name,
-		Short:        "packa is a package manager",
-		SilenceUsage: true,
-	}
-
-	cmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file location")
-
-	// if cfgFile is not defined, get the default config file name
-	if cfgFile == "" {
-		var err error
-		cfgFile, err = createConfigFile()
-		if err != nil {
-			klog.Fatalf("could not create default config file location: %v", err)
-		}
-	}
+	var cfgFile, profile string
+	var wait time.Duration
 
 	h := make(map[string]controller.PackageHandler)
 	for _, handler := range []PackageHandler{goget.New(), brew.New()} {
 		h[handler.Name()] = handler
 	}
+	for name, path := range plugin.Discover(plugin.Dirs()...) {
+		if _, ok := h[name]; ok {
+			klog.V(1).Infof("Ignoring plugin %v, handler %v exists already", path, name)
+			continue
+		}
+		h[name] = plugin.New(name, path)
+	}
+	// handlers that are defined in the config need to be known before
+	// the flags are parsed, so that their commands can be added
+	for name, handler := range scriptHandlers(configFlag(os.Args[1:])) {
+		if _, ok := h[name]; !ok {
+			h[name] = handler
+		}
+	}
 
 	ctl, err := controller.New(
-		controller.ConfigFile(cfgFile),
 		controller.RegisterHandlers(h),
 	)
 	if err != nil {
 		klog.Fatalf("could not create controller: %v", err)
 	}
 
+	cmd := &cobra.Command{
+		Version:      version,
+		Use:          Name,
+		Short:        "packa is a package manager",
+		SilenceUsage: true,
+		// the config is loaded once the flags have been parsed
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := setOutputFormat(cmd); err != nil {
+				return err
+			}
+
+			// if cfgFile is not defined, get the default config file name
+			if cfgFile == "" {
+				var err error
+				cfgFile, err = createConfigFile()
+				if err != nil {
+					return errors.Wrapf(err, "could not create default config file location")
+				}
+			}
+
+			for _, opt := range []controller.Option{
+				controller.WaitForLock(wait),
+				controller.SelectProfile(profile),
+				controller.History(defaults.HistoryFileFullPath(), os.Args),
+				controller.ConfigFile(cfgFile),
+			} {
+				if err := opt(ctl); err != nil {
+					return errors.Wrapf(err, "could not load config")
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file location")
+	cmd.PersistentFlags().StringVar(&profile, "profile", "", "profile to use instead of the default profile")
+	cmd.PersistentFlags().DurationVar(&wait, "wait", 0, "how long to wait for other packa processes to release the config")
+	cmd.PersistentFlags().String("output", string(output.Text), "output format, text or json (newline-delimited events)")
+
 	subcmds := []func(*controller.Controller) *cobra.Command{
 		installCommand,
 		upgradeCommand,
 		removeCommand,
 		listCommand,
+		planCommand,
+		applyCommand,
+		statusCommand,
 	}
 
 	for _, handler := range h {
@@ -85,10 +128,59 @@ func NewPackaCommand() *cobra.Command {
 	// to do an operation on all of them.
 	cmd.AddCommand(upgradeCommand(ctl))
 	cmd.AddCommand(listCommand(ctl))
+	cmd.AddCommand(planCommand(ctl))
+	cmd.AddCommand(applyCommand(ctl))
+	cmd.AddCommand(statusCommand(ctl))
+	cmd.AddCommand(configCommand(ctl))
+	cmd.AddCommand(historyCommand(ctl))
 
 	return cmd
 }
 
+// setOutputFormat applies the format of the --output flag to all output
+func setOutputFormat(cmd *cobra.Command) error {
+	if err := output.SetFormat(cmd.Flag("output").Value.String()); err != nil {
+		return err
+	}
+	// errors are emitted as events by main
+	cmd.Root().SilenceErrors = output.GetFormat() == output.JSON
+	return nil
+}
+
+// configFlag returns the value of the --config flag in args, or the
+// default config file if it is not set
+func configFlag(args []string) string {
+	flags := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.SetOutput(ioutil.Discard)
+	cfgFile := flags.String("config", "", "")
+	_ = flags.Parse(args)
+	if *cfgFile == "" {
+		return defaults.ConfigFileFullPath()
+	}
+	return *cfgFile
+}
+
+// scriptHandlers returns the handlers that are defined in the config
+// file. Errors are reported once the config is loaded.
+func scriptHandlers(cfgFile string) map[string]PackageHandler {
+	defs, err := controller.HandlerDefinitions(cfgFile)
+	if err != nil {
+		klog.V(1).Infof("Could not read handler definitions: %v", err)
+		return nil
+	}
+	h := make(map[string]PackageHandler, len(defs))
+	for name, def := range defs {
+		handler, err := script.New(name, *def)
+		if err != nil {
+			klog.V(1).Infof("Could not create handler %v: %v", name, err)
+			continue
+		}
+		h[name] = handler
+	}
+	return h
+}
+
 // createConfigFileLocation creates the config file
 // directory and the file itself, if they should not
 // exist already, and then returns the path to the file
@@ -134,3 +226,17 @@ func close(ctl io.Closer, inerr error) (outerr error) {
 	}
 	return outerr
 }
+
+// summarise prints the summary of the packages that have been operated
+// on, before the controller is closed. If packages have failed but no
+// error would be returned, an error is returned so that packa fails.
+// use it after the deferred close with:
+//  defer func() {
+//    err = summarise(ctl, err)
+//  }()
+func summarise(ctl *controller.Controller, inerr error) error {
+	if err := ctl.PrintSummary(); err != nil && inerr == nil {
+		return err
+	}
+	return inerr
+}
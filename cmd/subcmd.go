@@ -1,8 +1,14 @@
 package cmd
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/tommyknows/packa/pkg/controller"
+	"github.com/tommyknows/packa/pkg/defaults"
 	"github.com/tommyknows/packa/pkg/output"
 )
 
@@ -13,7 +19,8 @@ func listCommand(ctl *controller.Controller) *cobra.Command {
 		Long: `if called with zero arguments, list will output
 all packages of all handlers.
 If called with one or more arguments, it will print the packages
-of all specified handlers.`,
+of all specified handlers.
+With --output json, every package is printed as JSON object.`,
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			// always try to close the controller, this will save the config
 			// file. if an error occurred on closing but we are already returning
@@ -32,22 +39,41 @@ of all specified handlers.`,
 }
 
 func installCommand(ctl *controller.Controller) *cobra.Command {
-	return &cobra.Command{
+	var frozen, atomic bool
+	c := &cobra.Command{
 		Use:   "install <handler> [package]",
 		Short: "install packages with the specified handler",
 		Long: `install a package with the specified handler. The package
 name is handler-specific, check the documentation of the handler to get
 the correct format. If no package name is given, install all packages
 that are defined in the index.
-Will also add the package to the index if it does not exist yet.`,
+Will also add the package to the index if it does not exist yet.
+With --frozen, install exactly the versions that have been recorded in
+the lockfile (packa.lock) without modifying the index. If no package name
+is given, install all locked packages of the handler.
+With --atomic, all packages are rolled back if one of them fails.`,
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			defer func() {
 				err = close(ctl, err)
 			}()
+			defer func() {
+				err = summarise(ctl, err)
+			}()
 
+			if err := controller.Atomic(atomic)(ctl); err != nil {
+				return err
+			}
+
+			if frozen {
+				return ctl.InstallFrozen(cmd.Parent().Name(), args...)
+			}
 			return ctl.Install(cmd.Parent().Name(), args...)
 		},
 	}
+
+	c.Flags().BoolVar(&frozen, "frozen", false, "install the versions recorded in the lockfile")
+	c.Flags().BoolVar(&atomic, "atomic", false, "roll back all packages if one fails")
+	return c
 }
 
 func removeCommand(ctl *controller.Controller) *cobra.Command {
@@ -61,6 +87,9 @@ the correct format.`,
 			defer func() {
 				err = close(ctl, err)
 			}()
+			defer func() {
+				err = summarise(ctl, err)
+			}()
 
 			if len(args) == 0 {
 				output.Warn("no package specified!")
@@ -73,7 +102,8 @@ the correct format.`,
 }
 
 func upgradeCommand(ctl *controller.Controller) *cobra.Command {
-	return &cobra.Command{
+	var atomic bool
+	c := &cobra.Command{
 		Use:   "upgrade [package]",
 		Short: "upgrade packages with the specified handler",
 		Long: `upgrade a package with the specified handler. The package
@@ -81,11 +111,20 @@ name is handler-specific, check the documentation of the handler to get
 the correct format. If no package name is given, upgrade all packages
 that are in the index.
 If no handler is set, upgrade all packages of all handlers.
+With --atomic, all packages are rolled back if one of them fails. Note
+that brew cannot downgrade formulae, only their pins are rolled back.
 `,
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			defer func() {
 				err = close(ctl, err)
 			}()
+			defer func() {
+				err = summarise(ctl, err)
+			}()
+
+			if err := controller.Atomic(atomic)(ctl); err != nil {
+				return err
+			}
 
 			// if the parent is not a handler, we want to upgrade all handlers
 			if cmd.Parent().Name() == Name && len(args) == 0 {
@@ -94,4 +133,253 @@ If no handler is set, upgrade all packages of all handlers.
 			return ctl.Upgrade(cmd.Parent().Name(), args...)
 		},
 	}
+
+	c.Flags().BoolVar(&atomic, "atomic", false, "roll back all packages if one fails")
+	return c
+}
+
+func planCommand(ctl *controller.Controller) *cobra.Command {
+	var out string
+	c := &cobra.Command{
+		Use:   "plan",
+		Short: "show what would change on the system",
+		Long: `plan compares the packages in the index with the packages that
+are installed on the system and prints the changes that installing and
+upgrading would make, without executing anything.
+If called with zero arguments, plan will output the changes of all handlers.
+If called with one or more arguments, it will print the changes of all
+specified handlers.
+With --out, the plan is saved to a file that can be executed with
+"packa apply <file>" later on.
+With --output json, every change is printed as JSON object.`,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			defer func() {
+				err = close(ctl, err)
+			}()
+
+			if cmd.Parent().Name() != Name {
+				args = []string{cmd.Parent().Name()}
+			}
+			if out != "" {
+				return ctl.SavePlan(out, args...)
+			}
+			return ctl.PrintPlan(args...)
+		},
+	}
+
+	c.Flags().StringVarP(&out, "out", "o", "", "save the plan to this file (JSON)")
+	return c
+}
+
+func applyCommand(ctl *controller.Controller) *cobra.Command {
+	return &cobra.Command{
+		Use:   "apply [plan.json]",
+		Short: "reconcile the system with the config",
+		Long: `apply installs, upgrades and pins packages so that the system
+matches the packages that are defined in the index. Packages that are
+installed but not in the index are only removed if the "prune" setting
+of the handler is enabled.
+If called with zero arguments, apply will reconcile all handlers.
+If called with one or more arguments, it will reconcile all specified
+handlers.
+If called with a plan file (ending in .json) that has been created with
+"packa plan --out", it executes exactly that plan. Applying the plan is
+refused if the config or the installed packages have changed since.`,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			defer func() {
+				err = close(ctl, err)
+			}()
+			defer func() {
+				err = summarise(ctl, err)
+			}()
+
+			if cmd.Parent().Name() == Name {
+				if len(args) == 1 && strings.HasSuffix(args[0], ".json") {
+					return ctl.ApplyPlanFile(args[0])
+				}
+				return ctl.Apply(args...)
+			}
+			return ctl.Apply(cmd.Parent().Name())
+		},
+	}
+}
+
+func statusCommand(ctl *controller.Controller) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "show differences between the config and the system",
+		Long: `status reports packages that are declared but missing, installed
+at a different version than declared or outdated, pinned or unpinned
+against their definition, and taps that differ from the config.
+If called with zero arguments, status will check all handlers.
+If called with one or more arguments, it will check all specified handlers.
+Exits with a non-zero exit code if the system differs from the config.
+With --output json, every difference is printed as JSON object.`,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			defer func() {
+				err = close(ctl, err)
+			}()
+
+			if cmd.Parent().Name() != Name {
+				args = []string{cmd.Parent().Name()}
+			}
+			return ctl.PrintStatus(args...)
+		},
+	}
+}
+
+func historyCommand(ctl *controller.Controller) *cobra.Command {
+	var handler, since string
+	c := &cobra.Command{
+		Use:   "history",
+		Short: "show the operations that packa has executed",
+		Long: `every operation of a handler is recorded in the history in the
+working directory (~/.packa/history.jsonl), with the command line, the
+outcome of every package and its versions before and after the operation.
+history prints the recorded operations, the oldest first. With --handler,
+only the operations of that handler are printed. With --since, only the
+operations after a point in time, given as duration (e.g. 48h), date
+(2006-01-02) or time (2006-01-02T15:04:05Z07:00).
+With --output json, the operations are printed as they are recorded.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			defer func() {
+				err = close(ctl, err)
+			}()
+
+			t, err := parseSince(since, time.Now())
+			if err != nil {
+				return err
+			}
+			return ctl.PrintHistory(handler, t)
+		},
+	}
+
+	c.Flags().StringVar(&handler, "handler", "", "only show the operations of the handler")
+	c.Flags().StringVar(&since, "since", "", "only show the operations since a duration ago, a date or a time")
+	return c
+}
+
+// parseSince parses the point in time that is given as duration before
+// now, date or time. Returns the zero time if since is empty.
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	return t, errors.Wrapf(err, "invalid --since %v, use a duration, date or time", since)
+}
+
+func configCommand(ctl *controller.Controller) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "config",
+		Short: "manage the config file",
+	}
+
+	c.AddCommand(&cobra.Command{
+		Use:   "restore [n]",
+		Short: "restore a previous version of the config",
+		Long: `every time the config changes, the previous version is kept as
+backup in the working directory (e.g. ~/.packa/packa.yml.~1~). restore
+replaces the config with the n-th most recent backup, or the most recent
+one if n is not given. The current config is kept as backup, so that
+restoring can be undone with "packa config restore".`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			defer func() {
+				err = close(ctl, err)
+			}()
+
+			n := 1
+			if len(args) == 1 {
+				n, err = strconv.Atoi(args[0])
+				if err != nil {
+					return errors.Wrapf(err, "invalid backup number %v", args[0])
+				}
+			}
+			return ctl.RestoreConfig(n)
+		},
+	})
+
+	var unset bool
+	profile := &cobra.Command{
+		Use:   "profile [name]",
+		Short: "set the default profile",
+		Long: `profiles enable a subset of the handlers and packages in the
+config. The default profile is active if no profile is selected with
+--profile. If no name is given, profile prints the active profile.
+With --unset, no profile is active by default.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			defer func() {
+				err = close(ctl, err)
+			}()
+
+			switch {
+			case unset:
+				return ctl.SetDefaultProfile("")
+			case len(args) == 1:
+				return ctl.SetDefaultProfile(args[0])
+			}
+			return ctl.PrintProfile()
+		},
+	}
+	profile.Flags().BoolVar(&unset, "unset", false, "unset the default profile")
+	c.AddCommand(profile)
+
+	var to string
+	convert := &cobra.Command{
+		Use:   "convert",
+		Short: "convert the config to another format",
+		Long: `convert writes the config file in the format given with --to, one
+of yaml, json and toml, and removes the original file, which is kept as
+backup. Files that the config includes are not converted.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			defer func() {
+				err = close(ctl, err)
+			}()
+
+			format, err := controller.ParseFormat(to)
+			if err != nil {
+				return err
+			}
+			return ctl.ConvertConfig(format)
+		},
+	}
+	convert.Flags().StringVar(&to, "to", "", "format to convert the config to: yaml, json or toml")
+	_ = convert.MarkFlagRequired("to")
+	c.AddCommand(convert)
+
+	c.AddCommand(&cobra.Command{
+		Use:   "validate",
+		Short: "validate the config",
+		Long: `validate checks the config file and the files it includes against
+the schema of packa and its handlers and prints the position of every
+problem, e.g. unknown settings. The config is validated every time it is
+loaded, too.`,
+		Args: cobra.NoArgs,
+		// the config is not loaded, as that would fail already
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return setOutputFormat(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := cmd.Flag("config").Value.String()
+			if cfgFile == "" {
+				cfgFile = defaults.ConfigFileFullPath()
+			}
+			if err := ctl.ValidateConfig(cfgFile); err != nil {
+				return err
+			}
+			output.Success("Config %v is valid", cfgFile)
+			return nil
+		},
+	})
+	return c
 }
@@ -3,6 +3,7 @@ module github.com/tommyknows/packa
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/ghodss/yaml v1.0.0
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/logrusorgru/aurora v0.0.0-20190428105938-cea283e61946
@@ -11,5 +12,6 @@ require (
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/pflag v1.0.3
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/klog v0.3.3
 )
@@ -6,6 +6,7 @@ import (
 
 	"github.com/spf13/pflag"
 	"github.com/tommyknows/packa/cmd"
+	"github.com/tommyknows/packa/pkg/output"
 	"k8s.io/klog"
 )
 
@@ -27,6 +28,10 @@ func main() {
 
 	cmd := cmd.NewPackaCommand()
 	if err := cmd.Execute(); err != nil {
+		// cobra prints the error, except if the output is JSON
+		if output.GetFormat() == output.JSON {
+			output.Error("%v", err)
+		}
 		os.Exit(1)
 	}
 }
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 
 	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/output"
 )
 
 type Cmd *exec.Cmd
@@ -56,6 +57,8 @@ func Execute(args []string, opts ...Option) (output string, err error) {
 	}
 
 	err = (*c).Run()
+	closeOutputs(c.Stdout)
+	closeOutputs(c.Stderr)
 	return b.String(), err
 }
 
@@ -68,18 +71,69 @@ func WorkingDir(wd string) Option {
 	}
 }
 
+// Env adds the environment variables, given as key=value, to the
+// environment of the command
+func Env(vars ...string) Option {
+	return func(c Cmd) error {
+		if c.Env == nil {
+			c.Env = os.Environ()
+		}
+		c.Env = append(c.Env, vars...)
+		return nil
+	}
+}
+
 // DirectPrint prints the output of the command to stdout / stderr
 // if b is true.
 func DirectPrint(b bool) Option {
+	return DirectPrintWithPrefix(b, "")
+}
+
+// DirectPrintWithPrefix acts like DirectPrint, but adds the prefix to
+// every line of the output, so that the output of commands that run
+// concurrently can be told apart.
+func DirectPrintWithPrefix(b bool, prefix string) Option {
+	return DirectPrintOperation(b, nil, prefix)
+}
+
+// DirectPrintOperation acts like DirectPrintWithPrefix, but prints the
+// output as output of the operation, see output.Operation.Output
+func DirectPrintOperation(b bool, op *output.Operation, prefix string) Option {
 	return func(c Cmd) error {
 		if b {
-			c.Stdout = io.MultiWriter(c.Stdout, os.Stdout)
-			c.Stderr = io.MultiWriter(c.Stderr, os.Stderr)
+			c.Stdout = withOutput(c.Stdout, op.Output(prefix, false))
+			c.Stderr = withOutput(c.Stderr, op.Output(prefix, true))
 		}
 		return nil
 	}
 }
 
+// outputWriter writes to the writer of the command and to the outputs
+// of operations, which are closed once the command has exited
+type outputWriter struct {
+	io.Writer
+	outputs []io.Closer
+}
+
+// withOutput adds the output to the writer of the command
+func withOutput(w io.Writer, out io.WriteCloser) io.Writer {
+	ow := &outputWriter{Writer: io.MultiWriter(w, out), outputs: []io.Closer{out}}
+	if prev, ok := w.(*outputWriter); ok {
+		ow.outputs = append(prev.outputs, out)
+	}
+	return ow
+}
+
+// closeOutputs closes the outputs of the writer of a command, so
+// that an unterminated last line of the command is printed
+func closeOutputs(w io.Writer) {
+	if ow, ok := w.(*outputWriter); ok {
+		for _, out := range ow.outputs {
+			_ = out.Close()
+		}
+	}
+}
+
 func expand(path string) (string, error) {
 	if len(path) == 0 || path[0] != '~' {
 		return path, nil
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"os/user"
@@ -8,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/output"
 )
 
 func TestGlobalOpts(t *testing.T) {
@@ -67,6 +69,10 @@ func TestExec(t *testing.T) {
 	is.True(strings.HasSuffix(out, tmpDir+"\n")) // command's output should have the dir name and a newline
 	is.NoErr(err)                                // executing pwd should not fail
 
+	out, err = Execute([]string{"sh", "-c", "echo $A $B"}, Env("A=a"), Env("B=b"))
+	is.Equal("a b\n", out) // the variables should be added to the environment
+	is.NoErr(err)          // echo should not fail
+
 	out, err = Execute([]string{"false"})
 	is.Equal("", out)   // executing `false` should not print anything
 	is.True(err != nil) // error should not be nil
@@ -75,3 +81,16 @@ func TestExec(t *testing.T) {
 	is.Equal("", out)   // not executing any command should output nothing
 	is.True(err != nil) // not giving commands should result in an error
 }
+
+func TestDirectPrint(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	defer output.Set(os.Stdout, os.Stderr)
+
+	out, err := Execute([]string{"printf", `one\ntwo`}, DirectPrintWithPrefix(true, "> "))
+	is.NoErr(err)
+	is.Equal("one\ntwo", out)                // the output is returned unchanged
+	is.Equal("> one\n> two\n", buf.String()) // the last line is printed once the command has exited
+}
@@ -31,7 +31,7 @@ func (e *Error) Merge(err Error) {
 // IfNotEmpty returns an error if there is at least one
 // error collected, and nil if not
 func (e *Error) IfNotEmpty() error {
-	if *e == nil {
+	if len(*e) == 0 {
 		return nil
 	}
 	return e
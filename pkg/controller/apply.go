@@ -0,0 +1,259 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// ExecutionPlan is a list of steps that bring the system in line with
+// the configuration. It can be saved and applied later on, as long as
+// neither the configuration nor the installed packages have changed.
+type ExecutionPlan struct {
+	// Fingerprint of the configuration at the time of planning
+	Fingerprint string `json:"fingerprint"`
+	// Changes that have been planned, per handler
+	Changes map[string][]handlers.Change `json:"changes"`
+	Steps   []Step                       `json:"steps"`
+}
+
+// Apply reconciles the system with the configuration of the given
+// handlers. If no handler is specified, apply the configuration of all
+// handlers.
+// The changes of every handler are planned and then executed by
+// removing, installing and upgrading the affected packages. Packages
+// are only removed if the handler's prune setting is enabled.
+func (ctl *Controller) Apply(names ...string) error {
+	if len(names) == 0 {
+		klog.V(1).Infof("Applying configuration of all handlers")
+	}
+
+	var cerr collection.Error
+	p, err := ctl.NewExecutionPlan(names...)
+	if err != nil {
+		pe, ok := err.(*collection.Error)
+		if !ok {
+			return err
+		}
+		// handlers that could not be planned are not part of
+		// the plan, apply the others nonetheless
+		cerr.Merge(*pe)
+	}
+
+	return ctl.transaction(func() error {
+		cerr.Merge(ctl.execute(p))
+		return cerr.IfNotEmpty()
+	})
+}
+
+// SavePlan creates an execution plan for the given handlers, prints
+// it and saves it to file. If no handler is specified, plan for all
+// handlers. The plan is not saved if a handler could not be planned.
+func (ctl *Controller) SavePlan(file string, names ...string) error {
+	p, err := ctl.NewExecutionPlan(names...)
+	if err != nil {
+		return err
+	}
+	if err := printChanges(p.Changes); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal plan")
+	}
+	err = ioutil.WriteFile(file, data, 0644)
+	return errors.Wrapf(err, "could not write plan to %v", file)
+}
+
+// ApplyPlanFile executes the execution plan that has been saved to
+// file. It refuses to do so if the configuration or the installed
+// packages have changed since the plan has been created. The steps
+// are built from the verified changes, the steps in the file are
+// ignored.
+func (ctl *Controller) ApplyPlanFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "could not read plan")
+	}
+	var p ExecutionPlan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return errors.Wrapf(err, "could not parse plan %v", file)
+	}
+
+	if err := ctl.checkDrift(&p); err != nil {
+		return errors.Wrapf(err, "refusing to apply plan %v", file)
+	}
+	names, _, err := ctl.order(sortedKeys(p.Changes))
+	if err != nil {
+		return err
+	}
+	p.Steps = nil
+	for _, name := range names {
+		p.Steps = append(p.Steps, steps(name, p.Changes[name])...)
+	}
+	return ctl.transaction(func() error {
+		cerr := ctl.execute(&p)
+		return cerr.IfNotEmpty()
+	})
+}
+
+// NewExecutionPlan plans the changes of the given handlers and returns
+// the steps to execute them. If no handler is specified, plan for all
+// handlers that support planning, see plannerNames. Handlers that
+// could not be planned are left out of the plan and reported in the
+// returned collection.Error. The steps are ordered by the dependencies
+// of the handlers.
+func (ctl *Controller) NewExecutionPlan(names ...string) (*ExecutionPlan, error) {
+	if len(names) == 0 {
+		names = ctl.plannerNames()
+	}
+	names, _, err := ctl.order(names)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := ctl.configuration.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ExecutionPlan{
+		Fingerprint: fp,
+		Changes:     make(map[string][]handlers.Change),
+	}
+	var cerr collection.Error
+	for _, name := range names {
+		changes, err := ctl.plan(name)
+		if err != nil {
+			cerr.Add(name, err)
+			continue
+		}
+		p.Changes[name] = changes
+		p.Steps = append(p.Steps, steps(name, changes)...)
+	}
+	return p, cerr.IfNotEmpty()
+}
+
+// execute the steps of the plan handler by handler, in the order of
+// their dependencies. The steps of handlers that depend on a handler
+// with a failed step are skipped. Returns the errors of all failed
+// steps and skipped handlers.
+func (ctl *Controller) execute(p *ExecutionPlan) collection.Error {
+	for _, name := range sortedKeys(p.Changes) {
+		if len(p.Changes[name]) == 0 && output.GetFormat() != output.JSON {
+			output.Info("%v: no changes", name)
+		}
+	}
+
+	var names []string
+	byHandler := make(map[string][]Step)
+	for _, s := range p.Steps {
+		if _, ok := byHandler[s.Handler]; !ok {
+			names = append(names, s.Handler)
+		}
+		byHandler[s.Handler] = append(byHandler[s.Handler], s)
+	}
+	return ctl.walk(names, 1, func(name string) error {
+		var cerr collection.Error
+		for _, s := range byHandler[name] {
+			klog.V(2).Infof("Executing step %v", s)
+			if err := ctl.handlerDo(s); err != nil {
+				cerr.Add(fmt.Sprintf("%v %v", s.Handler, s.Operation), err)
+			}
+		}
+		return cerr.IfNotEmpty()
+	}, func(name string, err error) {
+		for _, s := range byHandler[name] {
+			ctl.report(s, nil, nil, err)
+		}
+	})
+}
+
+// checkDrift returns an error if the configuration or the changes
+// of a handler in the plan differ from the current state
+func (ctl *Controller) checkDrift(p *ExecutionPlan) error {
+	fp, err := ctl.configuration.fingerprint()
+	if err != nil {
+		return err
+	}
+	if fp != p.Fingerprint {
+		return errors.New("the configuration has changed since the plan has been created")
+	}
+
+	for _, name := range sortedKeys(p.Changes) {
+		changes, err := ctl.plan(name)
+		if err != nil {
+			return err
+		}
+		if !equalChanges(changes, p.Changes[name]) {
+			return errors.Errorf("the installed packages of handler %v have changed since the plan has been created", name)
+		}
+	}
+	return nil
+}
+
+// steps returns the steps to execute the changes of a handler
+func steps(name string, changes []handlers.Change) []Step {
+	var sync bool
+	sets := make(map[Operation][]string)
+	for _, c := range changes {
+		switch c.Action {
+		case handlers.ActionInstall:
+			sets[OperationInstall] = append(sets[OperationInstall], c.Package)
+		case handlers.ActionUpgrade:
+			sets[OperationUpgrade] = append(sets[OperationUpgrade], c.Package)
+		case handlers.ActionRemove:
+			sets[OperationRemove] = append(sets[OperationRemove], c.Package)
+		case handlers.ActionPin:
+			sets[OperationPin] = append(sets[OperationPin], c.Package)
+		case handlers.ActionUnpin:
+			sets[OperationUnpin] = append(sets[OperationUnpin], c.Package)
+		default:
+			// changes that do not affect a package, like
+			// taps, are applied when syncing the handler
+			sync = true
+		}
+	}
+
+	var s []Step
+	if sync {
+		s = append(s, Step{Handler: name, Operation: OperationSync})
+	}
+	// packages are unpinned before they are upgraded, and
+	// pinned once they are installed at their version
+	for _, op := range []Operation{OperationRemove, OperationUnpin, OperationInstall, OperationUpgrade, OperationPin} {
+		if len(sets[op]) > 0 {
+			s = append(s, Step{Handler: name, Operation: op, Packages: sets[op]})
+		}
+	}
+	return s
+}
+
+// fingerprint returns a hash of the configuration
+func (cfg *Configuration) fingerprint() (string, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not marshal configuration")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// equalChanges compares two lists of changes, treating nil
+// and empty lists as equal
+func equalChanges(a, b []handlers.Change) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
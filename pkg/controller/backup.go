@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// number of previous versions of the config file that are kept
+const configBackups = 5
+
+// backupFile returns the path of the n-th most recent backup
+// of the config file, e.g. packa.yml.~1~
+func (cfg *Configuration) backupFile(n int) string {
+	return filepath.Join(cfg.backupDir, fmt.Sprintf("%v.~%v~", filepath.Base(cfg.file), n))
+}
+
+// backup keeps data, the current content of the config file, as the
+// most recent backup. The older backups are rotated, dropping the
+// oldest one.
+func (cfg *Configuration) backup(data []byte) error {
+	if cfg.backupDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.backupDir, 0755); err != nil {
+		return err
+	}
+
+	for n := configBackups - 1; n > 0; n-- {
+		err := os.Rename(cfg.backupFile(n), cfg.backupFile(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	klog.V(3).Infof("Backing up config to %v", cfg.backupFile(1))
+	return writeFileAtomic(cfg.backupFile(1), data)
+}
+
+// RestoreConfig replaces the configuration with the n-th most recent
+// backup of the config file. The restored configuration is saved on
+// Close, which keeps the current configuration as backup.
+func (ctl *Controller) RestoreConfig(n int) error {
+	cfg := ctl.configuration
+	if cfg.file == "" || cfg.backupDir == "" {
+		return errors.New("no backups are kept of this configuration")
+	}
+	if n < 1 || n > configBackups {
+		return errors.Errorf("only the last %v versions of the config are kept", configBackups)
+	}
+
+	file := cfg.backupFile(n)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return errors.Errorf("backup %v of the config does not exist", file)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not read backup")
+	}
+
+	restored := defaultConfig()
+	if err := unmarshal(cfg.file, data, restored); err != nil {
+		return errors.Wrapf(err, "invalid backup")
+	}
+	restored.file, restored.backupDir = cfg.file, cfg.backupDir
+	if FormatOf(cfg.file) == YAML {
+		restored.doc, _ = parseDocument(data)
+	}
+
+	ctl.mu.Lock()
+	ctl.configuration = restored
+	ctl.mu.Unlock()
+	output.Success("Restored config from %v", file)
+	return nil
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestConfigBackups(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	// the config is symlinked, like in a dotfiles repository
+	cfgFile := filepath.Join(dir, "dotfiles", "packa.yml")
+	link := filepath.Join(dir, "packa.yml")
+	backups := filepath.Join(dir, "backups")
+	is.NoErr(os.Mkdir(filepath.Dir(cfgFile), 0755))
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte("packages:\n  fake: []\n"), 0600))
+	is.NoErr(os.Symlink(cfgFile, link))
+
+	save := func(version int) {
+		ctl, err := New(PidFile(filepath.Join(dir, "packa.pid")), BackupDir(backups), ConfigFile(link))
+		is.NoErr(err)
+		pkgs := json.RawMessage(fmt.Sprintf(`[{"version":%v}]`, version))
+		ctl.configuration.Packages["fake"] = &pkgs
+		is.NoErr(ctl.Close())
+	}
+	content := func(file string) string {
+		data, err := ioutil.ReadFile(file)
+		is.NoErr(err)
+		return string(data)
+	}
+	version := func(v int) string {
+		return fmt.Sprintf("apiVersion: v2\npackages:\n  fake:\n  - version: %v\n", v)
+	}
+
+	for v := 1; v <= configBackups+2; v++ {
+		save(v)
+	}
+	// saving an unchanged config does not rotate the backups
+	save(configBackups + 2)
+
+	is.Equal(version(configBackups+2), content(cfgFile))
+	info, err := os.Lstat(link)
+	is.NoErr(err)
+	is.True(info.Mode()&os.ModeSymlink != 0) // the symlink has not been replaced
+	info, err = os.Stat(cfgFile)
+	is.NoErr(err)
+	is.Equal(os.FileMode(0600), info.Mode())
+
+	files, err := ioutil.ReadDir(backups)
+	is.NoErr(err)
+	is.Equal(configBackups, len(files))
+	is.Equal(version(configBackups+1), content(filepath.Join(backups, "packa.yml.~1~")))
+	is.Equal(version(2), content(filepath.Join(backups, fmt.Sprintf("packa.yml.~%v~", configBackups))))
+
+	ctl, err := New(PidFile(filepath.Join(dir, "packa.pid")), BackupDir(backups), ConfigFile(link))
+	is.NoErr(err)
+	is.True(ctl.RestoreConfig(configBackups+1) != nil)
+	is.NoErr(ctl.RestoreConfig(2))
+	is.NoErr(ctl.Close())
+
+	is.Equal(version(configBackups), content(cfgFile))
+	// the restored version can be restored again
+	is.Equal(version(configBackups+2), content(filepath.Join(backups, "packa.yml.~1~")))
+}
@@ -1,28 +1,91 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/defaults"
+	"github.com/tommyknows/packa/pkg/handlers/script"
+	"k8s.io/klog"
 )
 
 type Configuration struct {
+	// APIVersion of the configuration, see migrate
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Include other config files, e.g. a shared base configuration.
+	// Relative paths are relative to this file, globs are allowed.
+	Include []string `json:"include,omitempty"`
+	// Local is the included file that new packages are added to,
+	// this file if empty
+	Local string `json:"local,omitempty"`
 	// Settings for packa and its handlers
 	Settings *Settings `json:"settings"`
 	// all the handlers and their packages
 	Packages map[string]*json.RawMessage `json:"packages,omitempty"`
+	// Profiles that enable a subset of the handlers and packages
+	Profiles map[string]*Profile `json:"profiles,omitempty"`
+	// Handlers that are defined by their commands, see script.Definition
+	Handlers map[string]*script.Definition `json:"handlers,omitempty"`
 	// for operations on the config file (save / close)
 	file string
+	// directory that previous versions of the file are kept
+	// in, no backups are kept if empty
+	backupDir string
+	// the source of the file, which save edits, see document
+	doc *document
+	// if the configuration has been migrated when it was
+	// loaded and has not been saved yet, see loadConfig
+	migrated bool
+
+	// if other files are included, the configuration is merged
+	// from these layers, see merge. They are saved separately.
+	layers []*Configuration
+	// the layer that new packages are added to
+	local *Configuration
+	// the layer that defines a package, per handler
+	// and package identity
+	owners    map[string]map[string]*Configuration
+	packageID packageIDFunc
 }
 
 type Settings struct {
+	// Parallelism defines how many handlers are upgraded concurrently
+	// when upgrading all handlers. Values below 2 upgrade sequentially.
+	Parallelism int `json:"parallelism,omitempty"`
+	// Profile that is active if no other profile is selected
+	Profile string `json:"profile,omitempty"`
 	// Settings for Handlers
 	Handler map[string]*json.RawMessage `json:"handler,omitempty"`
 }
 
+// handlerSettings are the settings in a handler's settings block
+// that are evaluated by the controller instead of the handler
+type handlerSettings struct {
+	// Prune removes packages that are installed on the system but
+	// not defined in the handler's index when applying the config
+	Prune bool `json:"prune,omitempty"`
+	// DependsOn are the handlers that have to run before this
+	// handler when all handlers are upgraded or applied
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// handlerSettings returns the controller's settings for the handler
+func (cfg *Configuration) handlerSettings(name string) (handlerSettings, error) {
+	var s handlerSettings
+	raw := cfg.Settings.Handler[name]
+	if raw == nil {
+		return s, nil
+	}
+	err := json.Unmarshal([]byte(*raw), &s)
+	return s, errors.Wrapf(err, "could not parse settings of handler %v", name)
+}
+
 // defaultConfig returns the default config that
 // is save to use with the controller
 func defaultConfig() *Configuration {
@@ -44,64 +107,311 @@ func Config(cfg *Configuration) Option {
 	}
 }
 
+// layered merges the layers into a single configuration, see merge.
+// The last layer is the main config file.
+func layered(layers []*Configuration, id packageIDFunc) (*Configuration, error) {
+	main := layers[len(layers)-1]
+	cfg, err := merge(layers, id)
+	if err != nil {
+		return nil, err
+	}
+	cfg.APIVersion, cfg.Include, cfg.Local = main.APIVersion, main.Include, main.Local
+	cfg.file, cfg.backupDir = main.file, main.backupDir
+	cfg.layers = layers
+
+	cfg.local = main
+	if main.Local != "" {
+		local := absPath(expandPath(main.Local, filepath.Dir(main.file)))
+		cfg.local = nil
+		for _, l := range layers {
+			if absPath(l.file) == local {
+				cfg.local = l
+			}
+		}
+		if cfg.local == nil {
+			return nil, errors.Errorf("local config file %v is not included", main.Local)
+		}
+	}
+
+	for _, l := range layers {
+		l.backupDir, l.packageID = main.backupDir, id
+	}
+	return cfg, nil
+}
+
 // Option for the controller initialisation.
-// ConfigFile reads in the configuration from the given file location
+// ConfigFile locks the configuration against concurrent packa runs and
+// reads it in from the given file location, merged with the files it
+// includes. The files are migrated to the current apiVersion, validated
+// and saved if they have been migrated, see loadConfig and ValidateConfig.
+// The lock is released on Close.
+// Handlers have to be registered before, so that their packages can be
+// merged by identity, see Identifier.
 func ConfigFile(cfgFile string) Option {
-	return func(ctl *Controller) error {
-		f, err := os.OpenFile(cfgFile, os.O_RDONLY, os.ModeTemporary)
+	return func(ctl *Controller) (err error) {
+		if ctl.flockFile != "" && ctl.flock == nil {
+			ctl.flock, err = acquireFlock(ctl.flockFile, ctl.flockTimeout)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err != nil {
+					_ = ctl.flock.release()
+					ctl.flock = nil
+				}
+			}()
+		}
+
+		main, err := ctl.loadConfig(cfgFile)
 		if err != nil {
-			return errors.Wrapf(err, "could not open config file")
+			return err
 		}
-		defer f.Close()
+		main.backupDir, main.packageID = ctl.backupDir, ctl.packageID
+		ctl.configuration = main
 
-		data, err := ioutil.ReadAll(f)
+		layers, err := includes(main, make(map[string]bool), ctl.loadConfig)
 		if err != nil {
-			return errors.Wrapf(err, "could not read config file")
+			return err
+		}
+		if err := ctl.registerScripts(definitions(append(layers, main))); err != nil {
+			return err
+		}
+		for _, l := range append(layers, main) {
+			if err := ctl.validate(l); err != nil {
+				if l.migrated {
+					return errors.Wrapf(err, "could not migrate %v to apiVersion %v", l.file, currentAPIVersion)
+				}
+				return err
+			}
+		}
+		for _, l := range append(layers, main) {
+			if err := ctl.saveMigrated(l); err != nil {
+				return err
+			}
+		}
+		if len(layers) > 0 {
+			ctl.configuration, err = layered(append(layers, main), ctl.packageID)
+			if err != nil {
+				return err
+			}
+		}
+
+		ctl.lock, err = readLockfile(defaults.LockFileFullPath(cfgFile))
+		return err
+	}
+}
+
+// definitions returns the handlers that are defined in the layers,
+// where later layers override earlier ones
+func definitions(layers []*Configuration) map[string]*script.Definition {
+	defs := make(map[string]*script.Definition)
+	for _, l := range layers {
+		for name, def := range l.Handlers {
+			defs[name] = def
 		}
-		ctl.configuration = defaultConfig()
+	}
+	return defs
+}
+
+// HandlerDefinitions reads the handlers that are defined in the config
+// file and the files it includes, without loading the configuration.
+// Returns no handlers if the file does not exist.
+func HandlerDefinitions(cfgFile string) (map[string]*script.Definition, error) {
+	cfg, err := readConfig(cfgFile)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	layers, err := includes(cfg, make(map[string]bool), readConfig)
+	if err != nil {
+		return nil, err
+	}
+	return definitions(append(layers, cfg)), nil
+}
 
-		err = yaml.Unmarshal(data, ctl.configuration)
+// registerScripts registers the handlers that are defined in the
+// config and have not been registered yet
+func (ctl *Controller) registerScripts(defs map[string]*script.Definition) error {
+	for name, def := range defs {
+		if h, ok := ctl.handlers[name]; ok {
+			if _, ok := h.PackageHandler.(*script.Handler); !ok {
+				return errors.Errorf("handler %v is defined in the config, but exists already", name)
+			}
+			continue
+		}
+		s, err := script.New(name, *def)
 		if err != nil {
-			return errors.Wrapf(err, "could not unmarshal")
+			return err
 		}
+		klog.V(2).Infof("Registering handler %v from the config", name)
+		ctl.handlers[name] = &handler{PackageHandler: s}
+	}
+	return nil
+}
 
-		ctl.configuration.file = cfgFile
+// Option for the controller initialisation.
+// WaitForLock sets how long ConfigFile waits for another packa process
+// to release the configuration. Has to be set before ConfigFile.
+func WaitForLock(timeout time.Duration) Option {
+	return func(ctl *Controller) error {
+		ctl.flockTimeout = timeout
+		return nil
+	}
+}
 
-		return err
+// Option for the controller initialisation.
+// PidFile sets the file that ConfigFile locks against concurrent packa
+// runs, defaults.PidFileFullPath by default. Has to be set before
+// ConfigFile.
+func PidFile(file string) Option {
+	return func(ctl *Controller) error {
+		ctl.flockFile = file
+		return nil
+	}
+}
+
+// Option for the controller initialisation.
+// BackupDir sets the directory that ConfigFile keeps the previous
+// versions of the config file in, defaults.WorkingDir by default.
+// Has to be set before ConfigFile.
+func BackupDir(dir string) Option {
+	return func(ctl *Controller) error {
+		ctl.backupDir = dir
+		return nil
 	}
 }
 
 var errorFileNotSet = errors.New("no file has been set")
 
 // save the config file to the file, if set. If no File
-// should be set, save returns errorFileNotSet
+// should be set, save returns errorFileNotSet. A layered
+// config is saved to the files of its layers.
+// The file is replaced atomically and the previous version is kept
+// as backup, see backup. Comments and formatting of the file are kept,
+// see encode.
 func (cfg *Configuration) save() error {
 	if cfg.file == "" {
 		return errorFileNotSet
 	}
 
-	f, err := os.OpenFile(cfg.file, os.O_WRONLY, os.ModeTemporary)
+	if len(cfg.layers) > 0 {
+		if err := cfg.split(); err != nil {
+			return err
+		}
+		var cerr collection.Error
+		for _, l := range cfg.layers {
+			if err := l.save(); err != nil {
+				cerr.Add(l.file, err)
+			}
+		}
+		return cerr.IfNotEmpty()
+	}
+
+	// write to the target of a symlinked config,
+	// instead of replacing the symlink
+	path, err := filepath.EvalSymlinks(cfg.file)
 	if err != nil {
-		return errors.Wrapf(err, "could not open config file")
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "could not resolve config file")
+		}
+		path = cfg.file
 	}
-	defer f.Close()
 
-	enc, err := yaml.Marshal(cfg)
+	enc, err := cfg.encode()
 	if err != nil {
 		return errors.Wrapf(err, "could not marshal config file")
 	}
 
-	if err = f.Truncate(0); err != nil {
-		return errors.Wrapf(err, "could not clear config file to overwrite")
+	current, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil && bytes.Equal(current, enc):
+		klog.V(3).Infof("Config has not changed, not saving")
+		return nil
+	case err == nil:
+		if err := cfg.backup(current); err != nil {
+			return errors.Wrapf(err, "could not back up config file")
+		}
+	case !os.IsNotExist(err):
+		return errors.Wrapf(err, "could not read config file")
 	}
 
-	_, _ = f.Seek(0, 0)
-	bw, err := f.Write(enc)
-	if err != nil {
+	// the current apiVersion is only set in files
+	// that are written anyway, see loadConfig
+	if cfg.APIVersion != currentAPIVersion {
+		cfg.APIVersion = currentAPIVersion
+		if enc, err = cfg.encode(); err != nil {
+			return errors.Wrapf(err, "could not marshal config file")
+		}
+	}
+
+	if err := writeFileAtomic(path, enc); err != nil {
 		return errors.Wrapf(err, "could not write config file")
 	}
-	if bw != len(enc) {
-		return errors.Errorf("did not write correct config to config file, expected to write %v bytes, wrote %v bytes", len(enc), bw)
+	if cfg.doc == nil {
+		return nil
 	}
-	return nil
+	cfg.doc, err = parseDocument(enc)
+	return errors.Wrapf(err, "could not parse saved config file")
+}
+
+// identity of the items in the document at path, the packages of a
+// handler are identified by the handler, see Identifier
+func (cfg *Configuration) identity(path []string, item interface{}) (string, bool) {
+	if cfg.packageID == nil || len(path) != 2 || path[0] != "packages" {
+		return "", false
+	}
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return "", false
+	}
+	return cfg.packageID(path[1], raw), true
+}
+
+// encode the configuration in the format of the file, see FormatOf. If
+// the YAML source of the file is known, only the changed entries are
+// edited, see document. Otherwise, or if the source cannot be edited,
+// it is encoded from scratch.
+func (cfg *Configuration) encode() ([]byte, error) {
+	if cfg.doc != nil {
+		enc, err := cfg.doc.update(cfg, cfg.identity)
+		if err == nil {
+			return enc, nil
+		}
+		klog.V(2).Infof("Could not edit config file %v, rewriting it: %v", cfg.file, err)
+	}
+	return FormatOf(cfg.file).marshal(cfg)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to
+// file, so that file is never left half-written. Keeps the mode of
+// file, if it exists.
+func writeFileAtomic(file string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
 }
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/matryer/is"
+	"github.com/tommyknows/packa/test/fake"
 )
 
 // TestConfigIO creates a source and a destination file,
@@ -15,7 +17,8 @@ import (
 func TestConfigIO(t *testing.T) {
 	is := is.New(t)
 
-	testCfg := []byte(`packages:
+	testCfg := []byte(`apiVersion: v2
+packages:
   fakeHandler:
   - url: github.com/test/bla
   thirdHandler:
@@ -62,7 +65,8 @@ settings:
 	err = ctl.configuration.save()
 	is.NoErr(err)
 
-	smallerCfg := []byte(`packages:
+	smallerCfg := []byte(`apiVersion: v2
+packages:
   fakeHandler: []
   thirdHandler:
   - totest: something
@@ -75,3 +79,118 @@ settings:
 	is.NoErr(err)
 	is.Equal(string(smallerCfg), string(d))
 }
+
+// TestConfigIOComments ensures that comments, the order of keys and
+// blank lines survive edits of the config
+func TestConfigIOComments(t *testing.T) {
+	is := is.New(t)
+
+	testCfg := `# packa configuration
+apiVersion: v2
+
+settings:
+  # handler settings
+  handler:
+    fakeHandler:
+      workingDir: /tmp # must exist
+
+packages:
+  # tools for work
+  fakeHandler:
+  - url: github.com/test/bla # the first one
+    version: 1.0.0
+  # not needed anymore
+  - url: github.com/test/old
+
+  - url: github.com/test/pinned
+    version: 0.1.0 # pinned on purpose
+  thirdHandler:
+  - totest: something
+`
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	file, err := ioutil.TempFile(dir, "")
+	is.NoErr(err)
+	file.Close()
+	is.NoErr(ioutil.WriteFile(file.Name(), []byte(testCfg), 0600))
+
+	ctl, err := New(
+		PidFile(filepath.Join(dir, "packa.pid")),
+		BackupDir(dir),
+		RegisterHandlers(map[string]PackageHandler{"fakeHandler": &fake.Handler{}}),
+		ConfigFile(file.Name()),
+	)
+	is.NoErr(err)
+	read := func() string {
+		d, err := ioutil.ReadFile(file.Name())
+		is.NoErr(err)
+		return string(d)
+	}
+
+	// an unchanged config is written as is
+	is.NoErr(ctl.configuration.save())
+	is.Equal(testCfg, read())
+
+	// remove a package, upgrade one and add a new one
+	pkgs := json.RawMessage(`[
+		{"url": "github.com/test/bla", "version": "1.0.0"},
+		{"url": "github.com/test/pinned", "version": "0.2.0"},
+		{"url": "github.com/test/new"}
+	]`)
+	ctl.configuration.Packages["fakeHandler"] = &pkgs
+	is.NoErr(ctl.configuration.save())
+	is.Equal(`# packa configuration
+apiVersion: v2
+
+settings:
+  # handler settings
+  handler:
+    fakeHandler:
+      workingDir: /tmp # must exist
+
+packages:
+  # tools for work
+  fakeHandler:
+  - url: github.com/test/bla # the first one
+    version: 1.0.0
+
+  - url: github.com/test/pinned
+    version: 0.2.0 # pinned on purpose
+  - url: github.com/test/new
+  thirdHandler:
+  - totest: something
+`, read())
+
+	// add a handler and a setting
+	settings := json.RawMessage(`{"workingDir": "/tmp", "prune": true}`)
+	ctl.configuration.Settings.Handler["fakeHandler"] = &settings
+	other := json.RawMessage(`[{"name": "other"}]`)
+	ctl.configuration.Packages["otherHandler"] = &other
+	is.NoErr(ctl.configuration.save())
+	is.Equal(`# packa configuration
+apiVersion: v2
+
+settings:
+  # handler settings
+  handler:
+    fakeHandler:
+      workingDir: /tmp # must exist
+      prune: true
+
+packages:
+  # tools for work
+  fakeHandler:
+  - url: github.com/test/bla # the first one
+    version: 1.0.0
+
+  - url: github.com/test/pinned
+    version: 0.2.0 # pinned on purpose
+  - url: github.com/test/new
+  otherHandler:
+  - name: other
+  thirdHandler:
+  - totest: something
+`, read())
+}
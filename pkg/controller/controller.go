@@ -2,10 +2,16 @@ package controller
 
 import (
 	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
 	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/defaults"
+	"github.com/tommyknows/packa/pkg/handlers"
 	"github.com/tommyknows/packa/pkg/output"
 	"k8s.io/klog"
 )
@@ -15,12 +21,45 @@ import (
 type Controller struct {
 	configuration *Configuration
 	handlers      map[string]*handler
+	// the resolved versions of the installed packages
+	lock *lockfile
+	// the steps executed by the handlers since the
+	// last commit, see transaction
+	journal handlers.Journal
+	// roll back all changes if an operation fails
+	atomic bool
+	// the profile selected for this run, see SelectProfile
+	profile string
+	// held while the configuration is in use, so
+	// that concurrent runs cannot overwrite it
+	flock     *flock
+	flockFile string
+	// how long to wait for the flock
+	flockTimeout time.Duration
+	// where backups of the config file are kept
+	backupDir string
+	// the outcomes of the packages that have been
+	// operated on, see PrintSummary
+	summary summary
+	// where the operations are recorded, see History
+	history *history
+	// guards the configuration and the lockfile,
+	// as handlers may be executed concurrently
+	mu sync.Mutex
 }
 
 type handler struct {
 	PackageHandler
 	// if the init function of the handler has been run
 	initialised bool
+	// if the handler has been synced, see Syncer
+	synced bool
+	// the profile that restricts the packages the handler
+	// has been initialised with, if any
+	profile *Profile
+	// the identities of the packages that the handler has been
+	// initialised with, nil if it knows all packages
+	visible map[string]bool
 }
 
 func (h *handler) setInitialised() {
@@ -31,8 +70,10 @@ func (h *handler) setInitialised() {
 // for every operation, the following statements are true:
 //   - If pkg is an empty string, install all packages as defined
 //     in the handler's package list.
-//   - As long as the returned packageList is not nil, it will be added
-//     back to the config.
+//   - As long as the returned result's package list is not nil, it will
+//     be added back to the config.
+//   - The versions that the result reports as resolved are recorded
+//     in the lockfile.
 //   - The given packages will most likely need to be parsed (e.g. separating
 //     the package name and version)
 type PackageHandler interface {
@@ -40,17 +81,39 @@ type PackageHandler interface {
 	Init(config *json.RawMessage, packages *json.RawMessage) error
 	// Install the given packages on the system.
 	// See docs on PackageHandler
-	Install(pkgs ...string) (packageList *json.RawMessage, err error)
+	Install(pkgs ...string) (result *handlers.Result, err error)
 	// Remove the given packages on the system.
 	// See docs on PackageHandler
-	Remove(pkgs ...string) (packageList *json.RawMessage, err error)
+	Remove(pkgs ...string) (result *handlers.Result, err error)
 	// Upgrade the given packages on the system.
 	// See docs on PackageHandler
-	Upgrade(pkgs ...string) (packageList *json.RawMessage, err error)
+	Upgrade(pkgs ...string) (result *handlers.Result, err error)
 }
 
-// handlerOperation is a function taken from the PackageHandler interface.
-type handlerOperation func(handler PackageHandler, pkgs ...string) (packageList *json.RawMessage, err error)
+// Syncer is an optional interface for PackageHandlers. Handlers that
+// manage state on the system that is not part of a package (e.g. brew
+// taps) implement it to bring that state in line with their settings.
+// Sync is called once before the first operation of the handler.
+type Syncer interface {
+	Sync() error
+}
+
+// FrozenInstaller is an optional interface for PackageHandlers that
+// cannot install a package at a version given as name@version, e.g. as
+// the format has another meaning for them. Frozen installs pass the
+// locked versions to InstallFrozen by package name instead, see
+// Controller.InstallFrozen.
+type FrozenInstaller interface {
+	InstallFrozen(locked map[string]string) (*handlers.Result, error)
+}
+
+// Pinner is an optional interface for PackageHandlers that can pin
+// installed packages to their version, so that they are not upgraded.
+// It executes the pin and unpin changes of a plan, see handlers.ActionPin.
+type Pinner interface {
+	Pin(pkgs ...string) (result *handlers.Result, err error)
+	Unpin(pkgs ...string) (result *handlers.Result, err error)
+}
 
 // functional-style options
 type Option func(*Controller) error
@@ -61,6 +124,9 @@ func New(opts ...Option) (*Controller, error) {
 	ctl := &Controller{
 		configuration: defaultConfig(),
 		handlers:      make(map[string]*handler),
+		lock:          newLockfile(""),
+		flockFile:     defaults.PidFileFullPath(),
+		backupDir:     defaults.WorkingDir(),
 	}
 	for _, opt := range opts {
 		err := opt(ctl)
@@ -76,43 +142,90 @@ func RegisterHandlers(handlers map[string]PackageHandler) Option {
 	return func(ctl *Controller) error {
 		for name, h := range handlers {
 			klog.V(2).Infof("Registering handler %v", name)
-			ctl.handlers[name] = &handler{h, false}
+			ctl.handlers[name] = &handler{PackageHandler: h}
 		}
 		return nil
 	}
 }
 
 // Close contains cleanup tasks that should be done when the command ends.
-// right now, this is mainly saving the config state to file
+// right now, this is mainly saving the config state and the lockfile to file
 func (ctl *Controller) Close() error {
 	klog.V(3).Infof("Closing controller")
-	err := ctl.configuration.save()
-	return errors.Wrapf(err, "could not save config")
+	defer func() {
+		if err := ctl.flock.release(); err != nil {
+			output.Warn(err.Error())
+		}
+		ctl.flock = nil
+	}()
+	defer ctl.closeHandlers()
+
+	if err := ctl.configuration.save(); err != nil {
+		return errors.Wrapf(err, "could not save config")
+	}
+	err := ctl.lock.save()
+	return errors.Wrapf(err, "could not save lockfile")
 }
 
-// PrintPackages of the specified handlers. If no handler is specified,
-// print all packages from all handlers
+// closeHandlers closes the handlers that implement io.Closer, e.g.
+// to stop external processes
+func (ctl *Controller) closeHandlers() {
+	for _, name := range ctl.registeredHandlers() {
+		if c, ok := ctl.handlers[name].PackageHandler.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				output.Warn(err.Error())
+			}
+		}
+	}
+}
+
+// PrintPackages of the specified handlers, grouped by the config file
+// that defines them if the config includes other files. If no handler is specified,
+// print all packages from all handlers. Only the handlers and packages
+// that are enabled in the active profile and on this host are printed.
+// As JSON, every package is printed as record, see recordPackages.
 func (ctl *Controller) PrintPackages(handlers ...string) error {
+	if _, _, err := ctl.activeProfile(); err != nil {
+		return err
+	}
 	if len(handlers) == 0 {
 		klog.V(1).Infof("Printing packages of all handlers")
-		for h := range ctl.handlers {
-			handlers = append(handlers, h)
-		}
+		handlers = ctl.handlerNames()
 	}
 
 	var cerr collection.Error
 	for _, h := range handlers {
 		klog.V(2).Infof("Printing packages of handler %v", h)
-		pkgs, ok := ctl.configuration.Packages[h]
-		if !ok {
+		if _, ok := ctl.configuration.Packages[h]; !ok {
 			cerr.Add(h, errors.New("handler does not exist"))
 			continue
 		}
+		if err := ctl.checkHandler(h); err != nil {
+			cerr.Add(h, err)
+			continue
+		}
+		pkgs, _, err := ctl.enabledPackages(h, false)
+		if err != nil {
+			return err
+		}
 		if pkgs == nil {
 			output.Info("Handler %v does not specify any packages", h)
 			continue
 		}
 
+		if output.GetFormat() == output.JSON {
+			if err := ctl.configuration.recordPackages(h, pkgs); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(ctl.configuration.layers) > 0 {
+			if err := ctl.configuration.printLayers(h, pkgs); err != nil {
+				return err
+			}
+			continue
+		}
+
 		out, err := yaml.JSONToYAML([]byte(*pkgs))
 		if err != nil {
 			return err
@@ -127,7 +240,28 @@ func (ctl *Controller) PrintPackages(handlers ...string) error {
 // the handler's package list
 func (ctl *Controller) Install(handler string, pkgs ...string) error {
 	klog.V(2).Infof("Installing package(s) %v on handler %v", pkgs, handler)
-	return ctl.handlerDo(PackageHandler.Install, handler, pkgs...)
+	return ctl.transaction(func() error {
+		return ctl.handlerDo(Step{Handler: handler, Operation: OperationInstall, Packages: pkgs})
+	})
+}
+
+// InstallFrozen installs exactly the versions of the packages that have
+// been recorded in the lockfile, without modifying the handler's index.
+// If pkg is empty string, install all locked packages of the handler.
+func (ctl *Controller) InstallFrozen(handler string, pkgs ...string) error {
+	klog.V(2).Infof("Installing locked package(s) %v on handler %v", pkgs, handler)
+	ctl.mu.Lock()
+	locked, err := ctl.lock.locked(handler, pkgs...)
+	ctl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(locked) == 0 {
+		return errors.Errorf("no packages of handler %v have been locked", handler)
+	}
+	return ctl.transaction(func() error {
+		return ctl.handlerDo(Step{Handler: handler, Operation: OperationInstall, Packages: locked, frozen: true})
+	})
 }
 
 // Remove the package with the handler
@@ -135,7 +269,9 @@ func (ctl *Controller) Install(handler string, pkgs ...string) error {
 // the handler's package list
 func (ctl *Controller) Remove(handler string, pkgs ...string) error {
 	klog.V(2).Infof("Removing packages %v on handler %v", pkgs, handler)
-	return ctl.handlerDo(PackageHandler.Remove, handler, pkgs...)
+	return ctl.transaction(func() error {
+		return ctl.handlerDo(Step{Handler: handler, Operation: OperationRemove, Packages: pkgs})
+	})
 }
 
 // Upgrade the given package with the handler.
@@ -143,57 +279,139 @@ func (ctl *Controller) Remove(handler string, pkgs ...string) error {
 // the handler's package list.
 func (ctl *Controller) Upgrade(handler string, pkgs ...string) error {
 	klog.V(2).Infof("Upgrading packages %v on handler %v", pkgs, handler)
-	return ctl.handlerDo(PackageHandler.Upgrade, handler, pkgs...)
+	return ctl.transaction(func() error {
+		return ctl.handlerDo(Step{Handler: handler, Operation: OperationUpgrade, Packages: pkgs})
+	})
 }
 
-// UpgradeAll upgrades all packages from all handlers.
+// UpgradeAll upgrades all packages from all handlers. Up to
+// Settings.Parallelism handlers are upgraded concurrently, a handler is
+// only upgraded after the handlers it depends on, see walk.
 func (ctl *Controller) UpgradeAll() error {
 	klog.V(2).Infof("Upgrading all packages")
-	var ce collection.Error
+	names := ctl.handlerNames()
+
+	return ctl.transaction(func() error {
+		ce := ctl.walk(names, ctl.configuration.Settings.Parallelism, func(name string) error {
+			return ctl.handlerDo(Step{Handler: name, Operation: OperationUpgrade})
+		}, func(name string, err error) {
+			ctl.report(Step{Handler: name, Operation: OperationUpgrade}, nil, nil, err)
+		})
+		return ce.IfNotEmpty()
+	})
+}
+
+// handlerNames returns the names of all registered handlers that are
+// enabled in the active profile and on this host, sorted
+func (ctl *Controller) handlerNames() []string {
+	names := make([]string, 0, len(ctl.handlers))
 	for name := range ctl.handlers {
-		err := ctl.handlerDo(PackageHandler.Upgrade, name)
-		if err != nil {
-			ce.Add(name, err)
+		if _, disabled := ctl.checkHandler(name).(errorDisabled); !disabled {
+			names = append(names, name)
 		}
 	}
-
-	return ce.IfNotEmpty()
+	sort.Strings(names)
+	return names
 }
 
-// handlerDo takes operations defined on the handlerInterface and executes
-// them accordingly. Does all necessary safetychecks and config-modifications.
-func (ctl *Controller) handlerDo(f handlerOperation, handler string, pkgs ...string) error {
+// handlerDo takes a step with an operation defined on the handlerInterface
+// and executes it accordingly. Does all necessary safetychecks and
+// config-modifications.
+func (ctl *Controller) handlerDo(step Step) error {
+	handler := step.Handler
+	f, ok := operations[step.Operation]
+	if !ok {
+		return errors.Errorf("operation \"%v\" does not exist", step.Operation)
+	}
+
 	// check if the handler even exists / got registered
 	if ctl.handlers[handler] == nil {
 		return errors.Errorf("handler \"%v\" does not exist or has not been registered", handler)
 	}
 
+	ctl.mu.Lock()
+	before := ctl.versions(handler)
+	ctl.mu.Unlock()
+
 	// initialise the handler if it has not been initialised
 	if !ctl.handlers[handler].initialised {
 		klog.V(2).Infof("Initialising handler %v", handler)
 		err := ctl.initialiseHandler(handler)
 		if err != nil {
+			ctl.report(step, before, nil, err)
 			return err
 		}
 	}
 
-	// execute the actual function and update the index
-	pkgList, err := f(ctl.handlers[handler], pkgs...)
-	if pkgList != nil {
-		klog.V(3).Infof("Appending new packagelist to handler %v", handler)
-		ctl.configuration.Packages[handler] = pkgList
+	if err := ctl.syncHandler(handler); err != nil {
+		ctl.report(step, before, nil, err)
+		return err
+	}
+
+	// execute the actual function between the hooks and
+	// update the index and lockfile
+	res, err := ctl.withHooks(step, func(pkgs ...string) (*handlers.Result, error) {
+		if fi, ok := ctl.handlers[handler].PackageHandler.(FrozenInstaller); ok && step.frozen {
+			locked := make(map[string]string, len(pkgs))
+			for _, pkg := range pkgs {
+				name, version := splitVersion(pkg)
+				locked[name] = version
+			}
+			return fi.InstallFrozen(locked)
+		}
+		return f(ctl.handlers[handler], pkgs...)
+	})
+	if res != nil {
+		ctl.mu.Lock()
+		if res.Packages != nil && !step.frozen {
+			klog.V(3).Infof("Appending new packagelist to handler %v", handler)
+			pkgs := res.Packages
+			var merr error
+			if visible := ctl.handlers[handler].visible; visible != nil {
+				pkgs, merr = ctl.mergePackages(handler, visible, res)
+			}
+			if merr != nil {
+				// the changes have been made, keep the index as it
+				// is but record them so that they can be rolled back
+				err = merr
+			} else {
+				ctl.configuration.Packages[handler] = pkgs
+			}
+		}
+		ctl.lock.update(handler, res)
+		ctl.mu.Unlock()
+		ctl.journal.Append(res.Journal)
 	}
+	ctl.report(step, before, res, err)
 	return errors.Wrapf(err, "error executing action on handler %v", handler)
 }
 
 // initialiseHandler initialises the handler with the given name,
 // calling its Init method with the settings and packages as defined
-// in the configuration.
+// in the configuration. The handler only gets the packages that are
+// enabled in the active profile and select this host. The values of the
+// settings and packages are expanded, see expandString.
 func (ctl *Controller) initialiseHandler(name string) error {
-	settings := ctl.configuration.Settings.Handler[name]
-	packages := ctl.configuration.Packages[name]
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if err := ctl.checkHandler(name); err != nil {
+		return err
+	}
+	settings, err := expandSettings(ctl.configuration.Settings.Handler[name])
+	if err != nil {
+		return errors.Wrapf(err, "could not expand settings of handler %v", name)
+	}
+	packages, visible, err := ctl.enabledPackages(name, true)
+	if err != nil {
+		return err
+	}
+	_, p, _ := ctl.activeProfile()
+	if _, restricted := p.packages(name); restricted {
+		ctl.handlers[name].profile = p
+	}
+	ctl.handlers[name].visible = visible
 
-	err := ctl.handlers[name].Init(settings, packages)
+	err = ctl.handlers[name].Init(settings, packages)
 	if err != nil {
 		return errors.Wrapf(err, "could not initialise handler %v", name)
 	}
@@ -201,3 +419,19 @@ func (ctl *Controller) initialiseHandler(name string) error {
 	klog.V(2).Infof("Handler %v successfully initialised", name)
 	return nil
 }
+
+// syncHandler syncs the handler with the given name, if it implements
+// the Syncer interface and has not been synced yet.
+func (ctl *Controller) syncHandler(name string) error {
+	syncer, ok := ctl.handlers[name].PackageHandler.(Syncer)
+	if !ok || ctl.handlers[name].synced {
+		return nil
+	}
+
+	klog.V(2).Infof("Syncing handler %v", name)
+	if err := syncer.Sync(); err != nil {
+		return errors.Wrapf(err, "could not sync handler %v", name)
+	}
+	ctl.handlers[name].synced = true
+	return nil
+}
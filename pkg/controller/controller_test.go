@@ -1,10 +1,16 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
 	"github.com/tommyknows/packa/test/fake"
 )
 
@@ -50,7 +56,7 @@ func TestInstall(t *testing.T) {
 		configuration: testConfig(),
 		handlers: map[string]*handler{
 			"fake": {
-				fH, false,
+				PackageHandler: fH,
 			},
 		},
 	}
@@ -75,7 +81,7 @@ func TestRemove(t *testing.T) {
 		configuration: cfg,
 		handlers: map[string]*handler{
 			"fake": {
-				fH, false,
+				PackageHandler: fH,
 			},
 		},
 	}
@@ -96,7 +102,7 @@ func TestUpgrade(t *testing.T) {
 		configuration: cfg,
 		handlers: map[string]*handler{
 			"fake": {
-				fH, false,
+				PackageHandler: fH,
 			},
 		},
 	}
@@ -121,10 +127,10 @@ func TestUpgradeAll(t *testing.T) {
 		configuration: cfg,
 		handlers: map[string]*handler{
 			"fake": {
-				fH1, false,
+				PackageHandler: fH1,
 			},
 			"fake2": {
-				fH2, false,
+				PackageHandler: fH2,
 			},
 		},
 	}
@@ -138,3 +144,233 @@ func TestUpgradeAll(t *testing.T) {
 	is.Equal("fakePackage1+", fH2.Packages[0].Name)
 	is.Equal("fakePackage2+", fH2.Packages[1].Name)
 }
+
+func TestPlan(t *testing.T) {
+	is := is.New(t)
+
+	cfg := testConfig()
+	cfg.Packages["fake"] = fake.DefaultPackagesRaw
+
+	ctl := &Controller{
+		configuration: cfg,
+		handlers: map[string]*handler{
+			"fake": {
+				PackageHandler: &fake.Handler{},
+			},
+		},
+	}
+
+	plans, err := ctl.Plan()
+	is.NoErr(err)
+	is.Equal(map[string][]handlers.Change{
+		"fake": {
+			{Action: handlers.ActionInstall, Package: "fakePackage1"},
+			{Action: handlers.ActionInstall, Package: "fakePackage2"},
+		},
+	}, plans)
+
+	// as JSON, every change is printed as record
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	is.NoErr(output.SetFormat("json"))
+	defer func() { _ = output.SetFormat("text") }()
+	is.NoErr(ctl.PrintPlan())
+	is.Equal(`{"handler":"fake","action":"install","package":"fakePackage1"}`+"\n"+
+		`{"handler":"fake","action":"install","package":"fakePackage2"}`+"\n", buf.String())
+
+	_, err = ctl.Plan("nonexistenthandler")
+	is.Equal("handler \"nonexistenthandler\" does not exist or has not been registered", err.Error())
+
+	// handlers that cannot be planned are skipped, unless requested
+	ctl.handlers["noplan"] = &handler{
+		PackageHandler: unplannable{&fake.Handler{}},
+	}
+	plans, err = ctl.Plan()
+	is.NoErr(err)
+	is.Equal(1, len(plans))
+	_, err = ctl.Plan("noplan")
+	is.Equal("handler \"noplan\" does not support planning", err.Error())
+}
+
+// unplannable hides the Plan method of the wrapped handler
+type unplannable struct {
+	PackageHandler
+}
+
+func TestApply(t *testing.T) {
+	is := is.New(t)
+
+	cfg := testConfig()
+	cfg.Packages["fake"] = fake.DefaultPackagesRaw
+
+	fH := &fake.Handler{
+		Installed: []fake.Package{{Name: "fakePackage2"}, {Name: "unlisted"}},
+	}
+	ctl := &Controller{
+		configuration: cfg,
+		handlers: map[string]*handler{
+			"fake": {
+				PackageHandler: fH,
+			},
+		},
+	}
+
+	// without pruning, unlisted packages should not be removed
+	is.NoErr(ctl.Apply())
+	is.Equal([]fake.Package{{Name: "fakePackage2"}, {Name: "unlisted"}, {Name: "fakePackage1"}}, fH.Installed)
+
+	prune := json.RawMessage(`{"prune": true}`)
+	cfg.Settings.Handler["fake"] = &prune
+	is.NoErr(ctl.Apply("fake"))
+	is.Equal([]fake.Package{{Name: "fakePackage2"}, {Name: "fakePackage1"}}, fH.Installed)
+
+	plans, err := ctl.Plan()
+	is.NoErr(err)
+	is.Equal(0, len(plans["fake"])) // the system should be in the desired state
+}
+
+func TestSavedPlan(t *testing.T) {
+	is := is.New(t)
+
+	// redirect the output logs
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	defer buf.Reset()
+
+	planFile, err := ioutil.TempFile("", "")
+	is.NoErr(err)
+	planFile.Close()
+	defer os.Remove(planFile.Name())
+
+	newController := func() (*Controller, *fake.Handler) {
+		cfg := testConfig()
+		cfg.Packages["fake"] = fake.DefaultPackagesRaw
+		fH := &fake.Handler{}
+		return &Controller{
+			configuration: cfg,
+			handlers: map[string]*handler{
+				"fake": {
+					PackageHandler: fH,
+				},
+			},
+		}, fH
+	}
+
+	ctl, _ := newController()
+	is.NoErr(ctl.SavePlan(planFile.Name()))
+
+	ctl, fH := newController()
+	is.NoErr(ctl.ApplyPlanFile(planFile.Name()))
+	is.Equal([]fake.Package{{Name: "fakePackage1"}, {Name: "fakePackage2"}}, fH.Installed)
+
+	// only the verified changes are executed, not the steps in the file
+	data, err := ioutil.ReadFile(planFile.Name())
+	is.NoErr(err)
+	var p ExecutionPlan
+	is.NoErr(json.Unmarshal(data, &p))
+	p.Steps = append(p.Steps, Step{Handler: "fake", Operation: OperationInstall, Packages: []string{"unplanned"}})
+	data, err = json.Marshal(p)
+	is.NoErr(err)
+	is.NoErr(ioutil.WriteFile(planFile.Name(), data, 0644))
+	ctl, fH = newController()
+	is.NoErr(ctl.ApplyPlanFile(planFile.Name()))
+	is.Equal([]fake.Package{{Name: "fakePackage1"}, {Name: "fakePackage2"}}, fH.Installed)
+
+	// the installed state has changed since the plan has been created
+	ctl, fH = newController()
+	fH.Installed = []fake.Package{{Name: "fakePackage1"}}
+	is.True(ctl.ApplyPlanFile(planFile.Name()) != nil)
+
+	// the configuration has changed since the plan has been created
+	ctl, _ = newController()
+	ctl.configuration.Packages["fake"] = fake.EmptyPackages
+	is.True(ctl.ApplyPlanFile(planFile.Name()) != nil)
+}
+
+func TestSteps(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal([]Step{
+		{Handler: "brew", Operation: OperationSync},
+		{Handler: "brew", Operation: OperationUnpin, Packages: []string{"tounpin"}},
+		{Handler: "brew", Operation: OperationInstall, Packages: []string{"vim@8.1"}},
+		{Handler: "brew", Operation: OperationUpgrade, Packages: []string{"tounpin"}},
+		{Handler: "brew", Operation: OperationPin, Packages: []string{"vim@8.1"}},
+	}, steps("brew", []handlers.Change{
+		{Action: handlers.ActionTap, Package: "my/tap"},
+		{Action: handlers.ActionInstall, Package: "vim@8.1"},
+		{Action: handlers.ActionPin, Package: "vim@8.1"},
+		{Action: handlers.ActionUnpin, Package: "tounpin"},
+		{Action: handlers.ActionUpgrade, Package: "tounpin"},
+	}))
+}
+
+func TestStatus(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	defer buf.Reset()
+
+	cfg := testConfig()
+	cfg.Packages["fake"] = fake.DefaultPackagesRaw
+
+	fH := &fake.Handler{
+		Installed: []fake.Package{{Name: "fakePackage1"}, {Name: "fakePackage2"}},
+	}
+	ctl := &Controller{
+		configuration: cfg,
+		handlers: map[string]*handler{
+			"fake": {
+				PackageHandler: fH,
+			},
+		},
+	}
+
+	is.NoErr(ctl.PrintStatus())
+
+	fH.Installed = fH.Installed[1:]
+	drift, err := ctl.Status()
+	is.NoErr(err)
+	is.Equal([]Drift{{Handler: "fake", Package: "fakePackage1", Kind: DriftMissing}}, drift)
+
+	// as JSON, every difference is printed as record
+	is.NoErr(output.SetFormat("json"))
+	defer func() { _ = output.SetFormat("text") }()
+	buf.Reset()
+	is.Equal(ErrDrift, ctl.PrintStatus())
+	is.Equal(`{"handler":"fake","package":"fakePackage1","drift":"missing"}`+"\n", buf.String())
+
+	// the drift is printed even if other handlers fail
+	buf.Reset()
+	err = ctl.PrintStatus("fake", "nonexistenthandler")
+	is.Equal(`{"handler":"fake","package":"fakePackage1","drift":"missing"}`+"\n", buf.String())
+	cerr, ok := err.(*collection.Error)
+	is.True(ok)
+	is.Equal(ErrDrift, (*cerr)["drift"])
+	is.True((*cerr)["nonexistenthandler"] != nil)
+}
+
+func TestUpgradeAllParallel(t *testing.T) {
+	is := is.New(t)
+
+	cfg := testConfig()
+	cfg.Settings.Parallelism = 3
+
+	handlers := make(map[string]*handler)
+	for _, name := range []string{"fake1", "fake2", "fake3", "fake4"} {
+		cfg.Packages[name] = fake.DefaultPackagesRaw
+		handlers[name] = &handler{PackageHandler: &fake.Handler{}}
+	}
+	ctl := &Controller{
+		configuration: cfg,
+		handlers:      handlers,
+	}
+
+	is.NoErr(ctl.UpgradeAll())
+	for name, h := range handlers {
+		fH := h.PackageHandler.(*fake.Handler)
+		is.Equal("fakePackage1+", fH.Packages[0].Name)
+		is.Equal(`[{"url":"fakePackage1+"},{"url":"fakePackage2+"}]`, string(*cfg.Packages[name]))
+	}
+}
@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"k8s.io/klog"
+)
+
+// Dependent is an optional interface for PackageHandlers. DependsOn
+// returns the names of the handlers that have to run before the
+// handler when all handlers are upgraded or applied, e.g. because they
+// install the tools the handler needs. They are added to the handlers
+// in the dependsOn key of the handler's settings.
+type Dependent interface {
+	DependsOn() []string
+}
+
+// dependencies returns the handlers that the handler depends on,
+// sorted and without duplicates
+func (ctl *Controller) dependencies(name string) ([]string, error) {
+	settings, err := ctl.configuration.handlerSettings(name)
+	if err != nil {
+		return nil, err
+	}
+	deps := settings.DependsOn
+	if h, ok := ctl.handlers[name]; ok {
+		if d, ok := h.PackageHandler.(Dependent); ok {
+			deps = append(deps, d.DependsOn()...)
+		}
+	}
+
+	seen := make(map[string]bool, len(deps))
+	var unique []string
+	for _, dep := range deps {
+		if seen[dep] {
+			continue
+		}
+		if _, ok := ctl.handlers[dep]; !ok {
+			return nil, errors.Errorf("handler %v depends on handler %v, which does not exist", name, dep)
+		}
+		seen[dep] = true
+		unique = append(unique, dep)
+	}
+	sort.Strings(unique)
+	return unique, nil
+}
+
+// order sorts the handlers topologically, so that every handler comes
+// after the handlers it depends on. Handlers that are otherwise
+// independent keep their order. Dependencies on handlers that are not
+// in names, e.g. because they are disabled, are ignored. Returns the
+// sorted handlers and the dependencies of every handler within names.
+func (ctl *Controller) order(names []string) ([]string, map[string][]string, error) {
+	included := make(map[string]bool, len(names))
+	for _, name := range names {
+		included[name] = true
+	}
+	deps := make(map[string][]string, len(names))
+	for _, name := range names {
+		all, err := ctl.dependencies(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dep := range all {
+			if included[dep] {
+				deps[name] = append(deps[name], dep)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(names))
+	sorted := make([]string, 0, len(names))
+	// path is the chain of handlers that is currently visited
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i := range path {
+				if path[i] == name {
+					return errors.Errorf("dependency cycle between handlers: %v", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		sorted = append(sorted, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	klog.V(4).Infof("Handlers in order of their dependencies: %v", sorted)
+	return sorted, deps, nil
+}
+
+// errorSkipped is the error of the steps of a handler that have
+// not been executed, as a handler it depends on has failed
+type errorSkipped string
+
+func (e errorSkipped) Error() string {
+	return string(e)
+}
+
+// walk calls f for the handlers in the order of their dependencies,
+// with at most limit calls running concurrently. A handler is started
+// once all the handlers it depends on have succeeded, handlers that
+// depend on a failed handler are skipped and passed to skip with an
+// errorSkipped. A limit below 1 is treated as 1, then the handlers are
+// walked sequentially and in order. Returns the errors of the failed and
+// skipped handlers.
+func (ctl *Controller) walk(names []string, limit int, f func(name string) error, skip func(name string, err error)) collection.Error {
+	var cerr collection.Error
+	sorted, deps, err := ctl.order(names)
+	if err != nil {
+		cerr.Add("dependencies", err)
+		return cerr
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result)
+	finished := make(map[string]bool, len(sorted))
+	failed := make(map[string]bool)
+	var running int
+
+	pending := sorted
+	for len(pending) > 0 || running > 0 {
+		var waiting []string
+		for _, name := range pending {
+			ready, failedDep := true, ""
+			for _, dep := range deps[name] {
+				if failed[dep] {
+					failedDep = dep
+					break
+				}
+				ready = ready && finished[dep]
+			}
+			switch {
+			case failedDep != "":
+				klog.V(2).Infof("Skipping handler %v, handler %v failed", name, failedDep)
+				err := errorSkipped(fmt.Sprintf("skipped, as handler %v failed", failedDep))
+				cerr.Add(name, err)
+				skip(name, err)
+				finished[name], failed[name] = true, true
+			case ready && running < limit:
+				running++
+				go func(name string) {
+					results <- result{name, f(name)}
+				}(name)
+			default:
+				waiting = append(waiting, name)
+			}
+		}
+		pending = waiting
+
+		// as the handlers are sorted, at least one
+		// is running while others are pending
+		if running == 0 {
+			continue
+		}
+		r := <-results
+		running--
+		finished[r.name] = true
+		if r.err != nil {
+			failed[r.name] = true
+			cerr.Add(r.name, r.err)
+		}
+	}
+	return cerr
+}
@@ -0,0 +1,215 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+// recorder records the order in which the handlers are upgraded
+type recorder struct {
+	mu       sync.Mutex
+	upgraded []string
+}
+
+// dependentHandler depends on other handlers and records its upgrades
+type dependentHandler struct {
+	*fake.Handler
+	name string
+	deps []string
+	fail bool
+	rec  *recorder
+}
+
+func (h *dependentHandler) DependsOn() []string {
+	return h.deps
+}
+
+func (h *dependentHandler) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	h.rec.mu.Lock()
+	h.rec.upgraded = append(h.rec.upgraded, h.name)
+	h.rec.mu.Unlock()
+	if h.fail {
+		return nil, errors.New("upgrade failed")
+	}
+	return h.Handler.Upgrade(pkgs...)
+}
+
+func TestOrder(t *testing.T) {
+	tests := map[string]struct {
+		// dependencies from the handlers' settings
+		settings map[string]string
+		// dependencies from the Dependent interface
+		deps  map[string][]string
+		names []string
+		order []string
+		err   string
+	}{
+		"independent": {
+			names: []string{"a", "b", "c"},
+			order: []string{"a", "b", "c"},
+		},
+		"settings": {
+			settings: map[string]string{"a": `{"dependsOn": ["c"]}`},
+			names:    []string{"a", "b", "c"},
+			order:    []string{"c", "a", "b"},
+		},
+		"interface and settings": {
+			settings: map[string]string{"a": `{"dependsOn": ["b"]}`},
+			deps:     map[string][]string{"a": {"c", "b"}, "c": {"b"}},
+			names:    []string{"a", "b", "c"},
+			order:    []string{"b", "c", "a"},
+		},
+		"ignores handlers that are not given": {
+			settings: map[string]string{"a": `{"dependsOn": ["c"]}`},
+			names:    []string{"a", "b"},
+			order:    []string{"a", "b"},
+		},
+		"cycle": {
+			settings: map[string]string{"a": `{"dependsOn": ["b"]}`, "b": `{"dependsOn": ["c"]}`},
+			deps:     map[string][]string{"c": {"a"}},
+			names:    []string{"a", "b", "c"},
+			err:      "dependency cycle between handlers: a -> b -> c -> a",
+		},
+		"unknown handler": {
+			settings: map[string]string{"a": `{"dependsOn": ["x"]}`},
+			names:    []string{"a"},
+			err:      "handler a depends on handler x, which does not exist",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			cfg := testConfig()
+			ctl := &Controller{configuration: cfg, handlers: make(map[string]*handler)}
+			for _, name := range []string{"a", "b", "c"} {
+				ctl.handlers[name] = &handler{PackageHandler: &dependentHandler{Handler: &fake.Handler{}, deps: tt.deps[name]}}
+				if s, ok := tt.settings[name]; ok {
+					raw := json.RawMessage(s)
+					cfg.Settings.Handler[name] = &raw
+				}
+			}
+
+			order, _, err := ctl.order(tt.names)
+			if tt.err != "" {
+				is.True(err != nil)
+				is.Equal(tt.err, err.Error())
+				return
+			}
+			is.NoErr(err)
+			is.Equal(tt.order, order)
+		})
+	}
+}
+
+func TestUpgradeAllDependencies(t *testing.T) {
+	is := is.New(t)
+
+	cfg := testConfig()
+	cfg.Settings.Parallelism = 4
+
+	rec := &recorder{}
+	deps := map[string][]string{
+		"go":    {"brew"},
+		"cargo": {"brew"},
+		"tools": {"go", "cargo"},
+		"other": nil,
+	}
+	handlers := map[string]*handler{"fake": {PackageHandler: &fake.Handler{}}}
+	newHandlers := func(failing string) {
+		rec.upgraded = nil
+		for _, name := range []string{"brew", "go", "cargo", "tools", "other"} {
+			cfg.Packages[name] = fake.DefaultPackagesRaw
+			handlers[name] = &handler{PackageHandler: &dependentHandler{
+				Handler: &fake.Handler{},
+				name:    name,
+				deps:    deps[name],
+				fail:    name == failing,
+				rec:     rec,
+			}}
+		}
+	}
+	ctl := &Controller{
+		configuration: cfg,
+		handlers:      handlers,
+	}
+	index := func(name string) int {
+		for i, n := range rec.upgraded {
+			if n == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	newHandlers("")
+	is.NoErr(ctl.UpgradeAll())
+	is.Equal(5, len(rec.upgraded))
+	is.True(index("brew") < index("go"))
+	is.True(index("brew") < index("cargo"))
+	is.True(index("go") < index("tools"))
+	is.True(index("cargo") < index("tools"))
+
+	// the handlers that depend on a failed handler are skipped
+	newHandlers("go")
+	err := ctl.UpgradeAll()
+	is.True(err != nil)
+	is.Equal(-1, index("tools"))
+	is.True(index("cargo") >= 0)
+	is.True(index("other") >= 0)
+	is.True(strings.Contains(err.Error(), "skipped, as handler go failed"))
+	is.Equal(outcome{kind: "skipped", reason: "skipped, as handler go failed"}, ctl.summary["tools"][""])
+}
+
+func TestApplyDependencies(t *testing.T) {
+	is := is.New(t)
+
+	cfg := testConfig()
+	dependsOn := json.RawMessage(`{"dependsOn": ["b"]}`)
+	cfg.Settings.Handler["a"] = &dependsOn
+	cfg.Packages["a"] = fake.DefaultPackagesRaw
+	cfg.Packages["b"] = fake.DefaultPackagesRaw
+	b := &fake.Handler{}
+	ctl := &Controller{
+		configuration: cfg,
+		handlers: map[string]*handler{
+			"a": {PackageHandler: &fake.Handler{}},
+			"b": {PackageHandler: b},
+		},
+	}
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	is.NoErr(History(filepath.Join(dir, "history.jsonl"), nil)(ctl))
+
+	p, err := ctl.NewExecutionPlan("a", "b")
+	is.NoErr(err)
+	is.Equal(2, len(p.Steps))
+	is.Equal("b", p.Steps[0].Handler)
+	is.Equal("a", p.Steps[1].Handler)
+
+	// a is skipped if b fails
+	b.Fail = []string{"fakePackage1"}
+	cerr := ctl.execute(p)
+	is.Equal(2, len(cerr))
+	is.Equal("skipped, as handler b failed", cerr["a"].Error())
+	is.Equal(handlers.OutcomeSkipped, ctl.summary["a"]["fakePackage1"].kind)
+	is.Equal(handlers.OutcomeSkipped, ctl.summary["a"]["fakePackage2"].kind)
+
+	// the skipped steps are recorded in the history
+	entries, err := ctl.history.entries()
+	is.NoErr(err)
+	is.Equal(2, len(entries))
+	is.Equal("a", entries[1].Handler)
+	is.Equal("skipped", entries[1].Result)
+	is.Equal(handlers.OutcomeSkipped, entries[1].Packages[0].Outcome)
+}
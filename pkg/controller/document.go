@@ -0,0 +1,437 @@
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// document is the YAML source of a config file. It is kept so that
+// saving the configuration only edits the entries that have changed,
+// leaving comments, the order of keys and blank lines intact.
+type document struct {
+	// lines of the source, all ending with a newline
+	lines []string
+	root  *yamlv3.Node
+}
+
+// parseDocument parses the source of a config file
+func parseDocument(data []byte) (*document, error) {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	src := string(data)
+	if src != "" && !strings.HasSuffix(src, "\n") {
+		src += "\n"
+	}
+	lines := strings.SplitAfter(src, "\n")
+	return &document{lines: lines[:len(lines)-1], root: &root}, nil
+}
+
+// update returns the source of the document, edited to contain the
+// value. Entries of mappings and sequences that are equal in the
+// document and the value are not touched, changed entries are edited
+// in place or re-encoded, new entries are inserted after the entry that
+// precedes them in the value.
+func (d *document) update(value interface{}, id identityFunc) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var target yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &target); err != nil {
+		return nil, err
+	}
+	if len(d.root.Content) != 1 || !isBlock(d.root.Content[0], yamlv3.MappingNode) {
+		return nil, errors.New("the document is not a block mapping")
+	}
+	if len(target.Content) != 1 || target.Content[0].Kind != yamlv3.MappingNode {
+		return nil, errors.New("the value is not a mapping")
+	}
+
+	p := &patcher{doc: d, id: id}
+	if !p.mapping(d.root.Content[0], target.Content[0], 0, len(d.lines), false, nil) {
+		return nil, errors.New("could not edit the document")
+	}
+	return p.apply(), nil
+}
+
+// entry of a block mapping or sequence in the document, spanning
+// from line head to line end. Lines before start are head comments.
+type entry struct {
+	key, value       *yamlv3.Node
+	head, start, end int
+}
+
+// entries returns the entries of the block mapping or sequence n,
+// which lies within the lines after from up to last
+func (d *document) entries(n *yamlv3.Node, from, last int) []entry {
+	var es []entry
+	if n.Kind == yamlv3.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			es = append(es, entry{key: n.Content[i], value: n.Content[i+1], start: n.Content[i].Line})
+		}
+	} else {
+		for _, v := range n.Content {
+			es = append(es, entry{value: v, start: v.Line})
+		}
+	}
+
+	for i := range es {
+		bound := from
+		if i > 0 {
+			bound = es[i-1].start
+		}
+		es[i].head = es[i].start
+		for es[i].head-1 > bound && d.isComment(es[i].head-1) {
+			es[i].head--
+		}
+	}
+	for i := range es {
+		limit := last
+		if i+1 < len(es) {
+			limit = es[i+1].head - 1
+		}
+		es[i].end = limit
+		for es[i].end > es[i].start && (d.isBlank(es[i].end) || d.isComment(es[i].end)) {
+			es[i].end--
+		}
+	}
+	return es
+}
+
+func (d *document) isComment(line int) bool {
+	return strings.HasPrefix(strings.TrimSpace(d.lines[line-1]), "#")
+}
+
+func (d *document) isBlank(line int) bool {
+	return strings.TrimSpace(d.lines[line-1]) == ""
+}
+
+// edit replaces the lines from start up to, but excluding, end. If start
+// equals end, the lines are inserted before start.
+type edit struct {
+	start, end int
+	lines      []string
+}
+
+// identityFunc returns the identity of an item of the sequence at path,
+// false if the items of the sequence have no identity
+type identityFunc func(path []string, item interface{}) (string, bool)
+
+type patcher struct {
+	doc   *document
+	id    identityFunc
+	edits []edit
+}
+
+func (p *patcher) replace(start, end int, lines []string) {
+	p.edits = append(p.edits, edit{start, end + 1, lines})
+}
+
+func (p *patcher) insert(before int, lines []string) {
+	p.edits = append(p.edits, edit{before, before, lines})
+}
+
+// apply the edits to the lines of the document
+func (p *patcher) apply() []byte {
+	edits := make([]int, len(p.edits))
+	for i := range edits {
+		edits[i] = i
+	}
+	// apply edits from the bottom up so that line numbers stay valid.
+	// Of edits at the same line, replacements go first, insertions are
+	// applied in reverse so that they end up in the order they were made.
+	sort.SliceStable(edits, func(i, j int) bool {
+		a, b := p.edits[edits[i]], p.edits[edits[j]]
+		if a.start != b.start {
+			return a.start > b.start
+		}
+		if (a.start == a.end) != (b.start == b.end) {
+			return b.start == b.end
+		}
+		return edits[i] > edits[j]
+	})
+
+	lines := p.doc.lines
+	for _, i := range edits {
+		e := p.edits[i]
+		updated := make([]string, 0, len(lines)+len(e.lines))
+		updated = append(updated, lines[:e.start-1]...)
+		updated = append(updated, e.lines...)
+		updated = append(updated, lines[e.end-1:]...)
+		lines = updated
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// mapping edits the block mapping old to equal new. If inline is set,
+// the first key of old is on the line of a sequence item's dash and
+// cannot be edited, mapping returns false then without making edits.
+func (p *patcher) mapping(old, new *yamlv3.Node, from, last int, inline bool, path []string) bool {
+	entries := p.doc.entries(old, from, last)
+	index := make(map[string]int, len(entries))
+	for i, e := range entries {
+		index[e.key.Value] = i
+	}
+	updated := make(map[string]*yamlv3.Node, len(new.Content)/2)
+	for i := 0; i+1 < len(new.Content); i += 2 {
+		updated[new.Content[i].Value] = new.Content[i+1]
+	}
+
+	if inline {
+		v, ok := updated[entries[0].key.Value]
+		if !ok || !equal(entries[0].value, v) {
+			return false
+		}
+	}
+
+	indent := old.Content[0].Column - 1
+	pos := entries[0].head
+	if inline {
+		pos = entries[0].end + 1
+	}
+	for i := 0; i+1 < len(new.Content); i += 2 {
+		key, value := new.Content[i].Value, new.Content[i+1]
+		if j, ok := index[key]; ok {
+			p.update(entries[j], value, indent, append(path[:len(path):len(path)], key))
+			if j > 0 || !inline {
+				pos = entries[j].end + 1
+			}
+			continue
+		}
+		if v, _ := nodeValue(value); isEmpty(v) {
+			continue
+		}
+		p.insert(pos, render(indent, value, key))
+	}
+
+	for _, e := range entries {
+		if _, ok := updated[e.key.Value]; ok {
+			continue
+		}
+		if v, _ := nodeValue(e.value); !isEmpty(v) {
+			p.replace(e.head, e.end, nil)
+		}
+	}
+	return true
+}
+
+// sequence edits the block sequence old to equal new. Items that are
+// equal in both are kept, the remaining items in between are updated in
+// place if they have the same identity, removed or inserted. Without an
+// identity, the remaining items are updated in order.
+func (p *patcher) sequence(old, new *yamlv3.Node, from, last int, path []string) {
+	entries := p.doc.entries(old, from, last)
+	indent := old.Column - 1
+
+	// pairs of equal items, in order, with a sentinel at the end
+	type pair struct{ o, n int }
+	var pairs []pair
+	for _, m := range lcs(old.Content, new.Content) {
+		pairs = append(pairs, pair{m[0], m[1]})
+	}
+	pairs = append(pairs, pair{len(old.Content), len(new.Content)})
+
+	prev := pair{-1, -1}
+	for _, next := range pairs {
+		pos := entries[0].head
+		if prev.o >= 0 {
+			pos = entries[prev.o].end + 1
+		}
+		paired := make(map[int]bool)
+		o := prev.o + 1
+		for n := prev.n + 1; n < next.n; n++ {
+			match := -1
+			if id, ok := p.identity(path, new.Content[n]); ok {
+				for i := prev.o + 1; i < next.o; i++ {
+					if oid, _ := p.identity(path, old.Content[i]); !paired[i] && oid == id {
+						match = i
+						break
+					}
+				}
+			} else if o < next.o {
+				match = o
+				o++
+			}
+			if match < 0 {
+				p.insert(pos, render(indent, new.Content[n], ""))
+				continue
+			}
+			paired[match] = true
+			p.update(entries[match], new.Content[n], indent, nil)
+			pos = entries[match].end + 1
+		}
+		for i := prev.o + 1; i < next.o; i++ {
+			if !paired[i] {
+				p.replace(entries[i].head, entries[i].end, nil)
+			}
+		}
+		prev = next
+	}
+}
+
+// update the entry at path to have the new value, path is nil for
+// sequence items. Block collections are edited recursively, all other
+// values are re-encoded, keeping the comment at the end of the line.
+func (p *patcher) update(e entry, value *yamlv3.Node, indent int, path []string) {
+	if equal(e.value, value) {
+		return
+	}
+	ov, _ := nodeValue(e.value)
+	nv, _ := nodeValue(value)
+	if isEmpty(ov) && isEmpty(nv) {
+		return
+	}
+
+	if !isEmpty(nv) && e.value.Kind == value.Kind {
+		switch {
+		case isBlock(e.value, yamlv3.MappingNode):
+			inline := e.value.Content[0].Line == e.start
+			if p.mapping(e.value, value, e.start, e.end, inline, path) {
+				return
+			}
+		case isBlock(e.value, yamlv3.SequenceNode):
+			p.sequence(e.value, value, e.start, e.end, path)
+			return
+		}
+	}
+
+	key := ""
+	if e.key != nil {
+		key = e.key.Value
+	}
+	lines := render(indent, value, key)
+	comment := e.value.LineComment
+	if e.key != nil && comment == "" {
+		comment = e.key.LineComment
+	}
+	if comment != "" && len(lines) == 1 && e.start == e.end {
+		lines[0] = strings.TrimSuffix(lines[0], "\n") + " " + comment + "\n"
+	}
+	p.replace(e.start, e.end, lines)
+}
+
+// identity of the item of the sequence at path
+func (p *patcher) identity(path []string, item *yamlv3.Node) (string, bool) {
+	if p.id == nil || path == nil {
+		return "", false
+	}
+	v, err := nodeValue(item)
+	if err != nil {
+		return "", false
+	}
+	return p.id(path, v)
+}
+
+// render the value as a mapping entry with the key, or as a sequence
+// item if key is empty, indented by indent spaces
+func render(indent int, value *yamlv3.Node, key string) []string {
+	v, _ := nodeValue(value)
+	var data []byte
+	if key != "" {
+		data, _ = yaml.Marshal(map[string]interface{}{key: v})
+	} else {
+		data, _ = yaml.Marshal([]interface{}{v})
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines = lines[:len(lines)-1]
+	prefix := strings.Repeat(" ", indent)
+	for i := range lines {
+		lines[i] = prefix + lines[i]
+	}
+	return lines
+}
+
+// lcs returns the indices of the longest common subsequence
+// of equal nodes in a and b
+func lcs(a, b []*yamlv3.Node) [][2]int {
+	av, bv := make([]interface{}, len(a)), make([]interface{}, len(b))
+	for i, n := range a {
+		av[i], _ = nodeValue(n)
+	}
+	for i, n := range b {
+		bv[i], _ = nodeValue(n)
+	}
+
+	l := make([][]int, len(a)+1)
+	for i := range l {
+		l[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case reflect.DeepEqual(av[i], bv[j]):
+				l[i][j] = l[i+1][j+1] + 1
+			case l[i+1][j] >= l[i][j+1]:
+				l[i][j] = l[i+1][j]
+			default:
+				l[i][j] = l[i][j+1]
+			}
+		}
+	}
+
+	var matches [][2]int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case reflect.DeepEqual(av[i], bv[j]):
+			matches = append(matches, [2]int{i, j})
+			i++
+			j++
+		case l[i+1][j] >= l[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
+
+// nodeValue decodes the node into the value that it has in JSON
+func nodeValue(n *yamlv3.Node) (interface{}, error) {
+	var v interface{}
+	if err := n.Decode(&v); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &v)
+	return v, err
+}
+
+// equal returns true if the nodes have the same value
+func equal(a, b *yamlv3.Node) bool {
+	av, err := nodeValue(a)
+	if err != nil {
+		return false
+	}
+	bv, err := nodeValue(b)
+	return err == nil && reflect.DeepEqual(av, bv)
+}
+
+// isEmpty returns true if v is null or an empty collection
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// isBlock returns true if n is a non-empty collection of the
+// kind in block style
+func isBlock(n *yamlv3.Node, kind yamlv3.Kind) bool {
+	return n.Kind == kind && n.Style&yamlv3.FlowStyle == 0 && len(n.Content) > 0
+}
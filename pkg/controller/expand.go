@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/user"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// variables of the form ${VAR} or ${VAR:-default}
+var variable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// templateFuncs that can be used in config values, e.g. {{ home }}
+var templateFuncs = template.FuncMap{
+	"home": func() (string, error) {
+		usr, err := user.Current()
+		if err != nil {
+			return "", err
+		}
+		return usr.HomeDir, nil
+	},
+	"hostname": func() (string, error) { return hostname() },
+	"goos":     func() string { return hostOS },
+	"goarch":   func() string { return hostArch },
+	"env": func(key string) string {
+		v, _ := lookupEnv(key)
+		return v
+	},
+}
+
+// expandString expands the templates and the environment variables in
+// s. Variables that are not set or empty expand to their default, or
+// to an empty string if they have none.
+func expandString(s string) (string, error) {
+	if strings.Contains(s, "{{") {
+		t, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(s)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid template %q", s)
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, nil); err != nil {
+			return "", errors.Wrapf(err, "could not expand %q", s)
+		}
+		s = b.String()
+	}
+
+	return variable.ReplaceAllStringFunc(s, func(v string) string {
+		m := variable.FindStringSubmatch(v)
+		if value, _ := lookupEnv(m[1]); value != "" {
+			return value
+		}
+		return m[3]
+	}), nil
+}
+
+// expandable returns true if raw contains anything that can be expanded
+func expandable(raw []byte) bool {
+	return bytes.Contains(raw, []byte("${")) || bytes.Contains(raw, []byte("{{"))
+}
+
+// expand all string values in raw, see expandString. raw is returned
+// as is if there is nothing to expand.
+func expand(raw json.RawMessage) (json.RawMessage, error) {
+	if !expandable(raw) {
+		return raw, nil
+	}
+	v, err := decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	v, err = expandValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func expandValue(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case string:
+		return expandString(v)
+	case map[string]interface{}:
+		for k := range v {
+			if v[k], err = expandValue(v[k]); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			if v[i], err = expandValue(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// expandSettings returns the expanded settings of a handler
+func expandSettings(settings *json.RawMessage) (*json.RawMessage, error) {
+	if settings == nil {
+		return nil, nil
+	}
+	raw, err := expand(*settings)
+	if err != nil {
+		return nil, err
+	}
+	return &raw, nil
+}
+
+// unexpand replaces the values in pkg that are the expansion of the
+// value at the same place in original with the original value, so that
+// the expanded values are not written back to the configuration
+func unexpand(pkg, original json.RawMessage) (json.RawMessage, error) {
+	if !expandable(original) {
+		return pkg, nil
+	}
+	p, err := decode(pkg)
+	if err != nil {
+		return nil, err
+	}
+	o, err := decode(original)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(unexpandValue(p, o))
+}
+
+func unexpandValue(v, original interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		o, ok := original.(string)
+		if !ok {
+			return v
+		}
+		if expanded, err := expandString(o); err == nil && expanded == v {
+			return o
+		}
+	case map[string]interface{}:
+		o, _ := original.(map[string]interface{})
+		for k := range v {
+			v[k] = unexpandValue(v[k], o[k])
+		}
+	case []interface{}:
+		o, _ := original.([]interface{})
+		for i := range v {
+			if i < len(o) {
+				v[i] = unexpandValue(v[i], o[i])
+			}
+		}
+	}
+	return v
+}
+
+// decode raw without losing the precision of numbers
+func decode(raw json.RawMessage) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	err := d.Decode(&v)
+	return v, errors.Wrapf(err, "could not decode %s", raw)
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"encoding/json"
+	"os/user"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestExpand(t *testing.T) {
+	is := is.New(t)
+
+	defer func(os string, name func() (string, error), env func(string) (string, bool)) {
+		hostOS, hostname, lookupEnv = os, name, env
+	}(hostOS, hostname, lookupEnv)
+	hostOS = "linux"
+	hostname = func() (string, error) { return "box", nil }
+	env := map[string]string{"USER": "me", "EMPTY": ""}
+	lookupEnv = func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	usr, err := user.Current()
+	is.NoErr(err)
+
+	tests := map[string]string{
+		"plain":                     "plain",
+		"$USER":                     "$USER",
+		"${USER}":                   "me",
+		"/home/${USER}/bin":         "/home/me/bin",
+		"${UNSET}":                  "",
+		"${UNSET:-default}":         "default",
+		"${EMPTY:-default}":         "default",
+		"${USER:-default}":          "me",
+		"{{ goos }}-{{ hostname }}": "linux-box",
+		"{{ home }}/.packa":         usr.HomeDir + "/.packa",
+		`{{ env "USER" }}`:          "me",
+	}
+	for in, out := range tests {
+		t.Run(in, func(t *testing.T) {
+			is := is.New(t)
+			s, err := expandString(in)
+			is.NoErr(err)
+			is.Equal(out, s)
+		})
+	}
+	_, err = expandString("{{ unknown }}")
+	is.True(err != nil)
+
+	cfg := testConfig()
+	pkgs := json.RawMessage(`[{"url":"${HOST:-example.com}/one"}]`)
+	cfg.Packages["fake"] = &pkgs
+	settings := json.RawMessage(`{"workingDir":"/home/${USER}"}`)
+	cfg.Settings.Handler["fake"] = &settings
+
+	fH := &fake.Handler{}
+	ctl, err := New(
+		Config(cfg),
+		RegisterHandlers(map[string]PackageHandler{"fake": fH}),
+	)
+	is.NoErr(err)
+
+	// the handler gets the expanded values, but they are not
+	// written back to the configuration
+	is.NoErr(ctl.Install("fake", "two"))
+	is.Equal("/home/me", fH.Config.WorkingDir)
+	is.Equal([]fake.Package{{Name: "example.com/one"}, {Name: "two"}}, fH.Packages)
+	is.Equal(`[{"url":"${HOST:-example.com}/one"},{"url":"two"}]`, string(*ctl.configuration.Packages["fake"]))
+	is.Equal(`{"workingDir":"/home/${USER}"}`, string(*ctl.configuration.Settings.Handler["fake"]))
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// how often a locked flock is retried while waiting
+const flockPollInterval = 100 * time.Millisecond
+
+// errLocked is returned by tryLock if the file
+// is locked by another process
+var errLocked = errors.New("file is locked")
+
+// flock is an advisory lock on a file that ensures that only one packa
+// process modifies the configuration at a time. The file contains the
+// PID of the process that holds the lock.
+type flock struct {
+	file *os.File
+}
+
+// acquireFlock locks the file at path, creating it if needed. If the
+// file is locked by another process, it is retried until the timeout
+// has passed.
+func acquireFlock(path string, timeout time.Duration) (*flock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "could not create directory for lock file")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open lock file")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := tryLock(f)
+		if err == nil {
+			break
+		}
+		if err != errLocked {
+			f.Close()
+			return nil, errors.Wrapf(err, "could not lock %v", path)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, errors.Errorf("the config is locked by another packa process (PID %v, lock file %v), use --wait to wait for it", lockHolder(path), path)
+		}
+		klog.V(3).Infof("Waiting for lock on %v", path)
+		time.Sleep(flockPollInterval)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		klog.V(3).Infof("Could not clear lock file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		klog.V(3).Infof("Could not write PID to lock file: %v", err)
+	}
+	klog.V(3).Infof("Acquired lock on %v", path)
+	return &flock{file: f}, nil
+}
+
+// lockHolder returns the PID that has been written to the
+// lock file, or "unknown" if it cannot be read
+func lockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if pid := strings.TrimSpace(string(data)); err == nil && pid != "" {
+		return pid
+	}
+	return "unknown"
+}
+
+// release the lock. Releasing a nil flock does nothing.
+func (l *flock) release() error {
+	if l == nil {
+		return nil
+	}
+	defer l.file.Close()
+	klog.V(3).Infof("Releasing lock on %v", l.file.Name())
+	return errors.Wrapf(unlock(l.file), "could not release lock on %v", l.file.Name())
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package controller
+
+import "os"
+
+// flock is not supported on this platform, locking always succeeds
+
+func tryLock(*os.File) error {
+	return nil
+}
+
+func unlock(*os.File) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestFlock(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "packa.yml")
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte("packages: {}\n"), 0644))
+	pidFile := filepath.Join(dir, "run", "packa.pid")
+
+	first, err := New(PidFile(pidFile), BackupDir(dir), ConfigFile(cfgFile))
+	is.NoErr(err)
+
+	// the config is locked by the first controller
+	_, err = New(PidFile(pidFile), BackupDir(dir), ConfigFile(cfgFile))
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "PID "+strconv.Itoa(os.Getpid())))
+
+	// waiting for the lock succeeds as soon as it has been released
+	go func() {
+		time.Sleep(2 * flockPollInterval)
+		is.NoErr(first.Close())
+	}()
+	second, err := New(PidFile(pidFile), BackupDir(dir), WaitForLock(time.Minute), ConfigFile(cfgFile))
+	is.NoErr(err)
+	is.NoErr(second.Close())
+
+	// the lock is released if the config cannot be read
+	_, err = New(PidFile(pidFile), BackupDir(dir), ConfigFile(filepath.Join(dir, "missing.yml")))
+	is.True(err != nil)
+	third, err := New(PidFile(pidFile), BackupDir(dir), ConfigFile(cfgFile))
+	is.NoErr(err)
+	is.NoErr(third.Close())
+}
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Format of a config file
+type Format string
+
+const (
+	YAML Format = "yaml"
+	JSON Format = "json"
+	TOML Format = "toml"
+)
+
+// Formats are the supported formats of config files
+var Formats = []Format{YAML, JSON, TOML}
+
+// Extensions of the config file formats. The first extension
+// of a format is used for new files.
+var Extensions = map[Format][]string{
+	YAML: {".yml", ".yaml"},
+	JSON: {".json"},
+	TOML: {".toml"},
+}
+
+// FormatOf returns the format of the file by its extension.
+// Files with an unknown extension are YAML.
+func FormatOf(file string) Format {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, f := range Formats {
+		for _, e := range Extensions[f] {
+			if ext == e {
+				return f
+			}
+		}
+	}
+	return YAML
+}
+
+// ParseFormat returns the format with the name
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == strings.ToLower(name) || name == "yml" && f == YAML {
+			return f, nil
+		}
+	}
+	return "", errors.Errorf("unknown config format %v, supported are %v", name, Formats)
+}
+
+// ConvertConfig converts the config file to the format. The converted
+// file replaces the config file, which is kept as backup. Included
+// files are not converted.
+func (ctl *Controller) ConvertConfig(to Format) error {
+	main := ctl.configuration
+	if n := len(main.layers); n > 0 {
+		main = main.layers[n-1]
+	}
+	if main.file == "" {
+		return errorFileNotSet
+	}
+	if FormatOf(main.file) == to {
+		return errors.Errorf("config %v is already in format %v", main.file, to)
+	}
+
+	file := strings.TrimSuffix(main.file, filepath.Ext(main.file)) + Extensions[to][0]
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		return errors.Errorf("cannot convert config to %v, the file exists already", file)
+	}
+	data, err := ioutil.ReadFile(main.file)
+	if err != nil {
+		return errors.Wrapf(err, "could not read config file")
+	}
+	if err := main.backup(data); err != nil {
+		return errors.Wrapf(err, "could not back up config file")
+	}
+
+	klog.V(2).Infof("Converting config %v to %v", main.file, file)
+	old := main.file
+	main.file, main.doc = file, nil
+	ctl.configuration.file = file
+	if err := main.save(); err != nil {
+		return err
+	}
+	if err := os.Remove(old); err != nil {
+		return errors.Wrapf(err, "could not remove converted config file")
+	}
+	output.Success("Converted config %v to %v", old, file)
+	return nil
+}
+
+// unmarshal the data of the file in its format into v
+func unmarshal(file string, data []byte, v interface{}) error {
+	raw, err := FormatOf(file).toJSON(data)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse %v", file)
+	}
+	return errors.Wrapf(json.Unmarshal(raw, v), "could not unmarshal %v", file)
+}
+
+// toJSON converts the data in the format to JSON
+func (f Format) toJSON(data []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []byte("null"), nil
+	}
+	switch f {
+	case JSON:
+		return data, nil
+	case TOML:
+		var v map[string]interface{}
+		if err := toml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	}
+	return yaml.YAMLToJSON(data)
+}
+
+// marshal the value in the format
+func (f Format) marshal(v interface{}) ([]byte, error) {
+	switch f {
+	case JSON:
+		data, err := json.MarshalIndent(v, "", "  ")
+		return append(data, '\n'), err
+	case TOML:
+		// TOML has no null and only knows integers and floats,
+		// so the value is converted from JSON first
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		var value interface{}
+		if err := d.Decode(&value); err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		err = toml.NewEncoder(&b).Encode(tomlValue(value))
+		return b.Bytes(), err
+	}
+	return yaml.Marshal(v)
+}
+
+// tomlValue removes null values from v and converts the numbers to
+// integers or floats
+func tomlValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if e == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = tomlValue(e)
+		}
+	case []interface{}:
+		values := v[:0]
+		for _, e := range v {
+			if e != nil {
+				values = append(values, tomlValue(e))
+			}
+		}
+		return values
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
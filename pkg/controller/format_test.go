@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestFormatOf(t *testing.T) {
+	is := is.New(t)
+	is.Equal(YAML, FormatOf("packa.yml"))
+	is.Equal(YAML, FormatOf("packa.YAML"))
+	is.Equal(YAML, FormatOf("packa"))
+	is.Equal(JSON, FormatOf("/home/me/.packa/packa.json"))
+	is.Equal(TOML, FormatOf("packa.toml"))
+
+	f, err := ParseFormat("yml")
+	is.NoErr(err)
+	is.Equal(YAML, f)
+	_, err = ParseFormat("xml")
+	is.True(err != nil)
+}
+
+func TestFormats(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	content := func(file string) string {
+		data, err := ioutil.ReadFile(file)
+		is.NoErr(err)
+		return string(data)
+	}
+	load := func(file string) *Controller {
+		ctl, err := New(
+			PidFile(filepath.Join(dir, "packa.pid")),
+			BackupDir(filepath.Join(dir, "backups")),
+			ConfigFile(file),
+		)
+		is.NoErr(err)
+		return ctl
+	}
+
+	jsonFile := filepath.Join(dir, "packa.json")
+	is.NoErr(ioutil.WriteFile(jsonFile, []byte(`{"apiVersion": "v2", "settings": {"parallelism": 2}, "packages": {"go": [{"module": "one"}]}}`), 0600))
+	ctl := load(jsonFile)
+	is.Equal(2, ctl.configuration.Settings.Parallelism)
+	pkgs := json.RawMessage(`[{"module":"one"},{"module":"two","version":"1.0.0"}]`)
+	ctl.configuration.Packages["go"] = &pkgs
+	is.NoErr(ctl.Close())
+	is.Equal(`{
+  "apiVersion": "v2",
+  "settings": {
+    "parallelism": 2
+  },
+  "packages": {
+    "go": [
+      {
+        "module": "one"
+      },
+      {
+        "module": "two",
+        "version": "1.0.0"
+      }
+    ]
+  }
+}
+`, content(jsonFile))
+
+	// convert to TOML and back to YAML
+	ctl = load(jsonFile)
+	is.True(ctl.ConvertConfig(JSON) != nil) // already JSON
+	is.NoErr(ctl.ConvertConfig(TOML))
+	is.NoErr(ctl.Close())
+	tomlFile := filepath.Join(dir, "packa.toml")
+	_, err = os.Stat(jsonFile)
+	is.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "backups", "packa.json.~1~"))
+	is.NoErr(err)
+	is.Equal(`apiVersion = "v2"
+
+[packages]
+
+  [[packages.go]]
+    module = "one"
+
+  [[packages.go]]
+    module = "two"
+    version = "1.0.0"
+
+[settings]
+  parallelism = 2
+`, content(tomlFile))
+
+	ctl = load(tomlFile)
+	is.Equal(`[{"module":"one"},{"module":"two","version":"1.0.0"}]`, string(*ctl.configuration.Packages["go"]))
+	is.NoErr(ctl.ConvertConfig(YAML))
+	is.NoErr(ctl.Close())
+	is.Equal(`apiVersion: v2
+packages:
+  go:
+  - module: one
+  - module: two
+    version: 1.0.0
+settings:
+  parallelism: 2
+`, content(filepath.Join(dir, "packa.yml")))
+}
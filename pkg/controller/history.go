@@ -0,0 +1,302 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+const (
+	// size above which the history file is rotated
+	historyMaxSize = 1 << 20
+	// number of rotated history files that are kept
+	historyBackups = 3
+)
+
+// history is an append-only log of the operations that the controller
+// has executed, one JSON object per line. The file is rotated once it
+// grows above maxSize, see rotate. A nil history records nothing.
+type history struct {
+	file    string
+	maxSize int64
+	// the command line of this run
+	command string
+}
+
+// historyEntry is a step that the controller has executed
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Command   string    `json:"command"`
+	Handler   string    `json:"handler"`
+	Operation Operation `json:"operation"`
+	// the packages as given to the operation, none
+	// if it has been executed on all packages
+	Args     []string         `json:"args,omitempty"`
+	Packages []historyPackage `json:"packages,omitempty"`
+	// succeeded, failed or skipped
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// historyPackage is the outcome of a step for a package, with the
+// versions before and after the step as recorded in the lockfile
+type historyPackage struct {
+	Name    string           `json:"name"`
+	Outcome handlers.Outcome `json:"outcome"`
+	From    string           `json:"from,omitempty"`
+	To      string           `json:"to,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// Option for the controller initialisation.
+// History records every operation in the history file, with the command
+// line of this run. Nothing is recorded if file is empty.
+func History(file string, args []string) Option {
+	return func(ctl *Controller) error {
+		if file == "" {
+			ctl.history = nil
+			return nil
+		}
+		command := args
+		if len(args) > 0 {
+			command = append([]string{filepath.Base(args[0])}, args[1:]...)
+		}
+		ctl.history = &history{
+			file:    file,
+			maxSize: historyMaxSize,
+			command: strings.Join(command, " "),
+		}
+		return nil
+	}
+}
+
+// backupFile returns the path of the n-th most recent rotated
+// history file, e.g. history.jsonl.1
+func (h *history) backupFile(n int) string {
+	return fmt.Sprintf("%v.%v", h.file, n)
+}
+
+// rotate the history file if it has grown above maxSize, dropping
+// the oldest rotated file
+func (h *history) rotate() error {
+	info, err := os.Stat(h.file)
+	if os.IsNotExist(err) || err == nil && info.Size() < h.maxSize {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	klog.V(3).Infof("Rotating history file %v", h.file)
+	for n := historyBackups - 1; n > 0; n-- {
+		err := os.Rename(h.backupFile(n), h.backupFile(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(h.file, h.backupFile(1))
+}
+
+// append the entry to the history file
+func (h *history) append(e historyEntry) error {
+	if h == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.file), 0755); err != nil {
+		return errors.Wrapf(err, "could not create directory of history")
+	}
+	if err := h.rotate(); err != nil {
+		return errors.Wrapf(err, "could not rotate history")
+	}
+
+	e.Command = h.command
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal history entry")
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not open history")
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "could not write history")
+	}
+	return errors.Wrapf(f.Close(), "could not write history")
+}
+
+// entries returns the entries of the history, the oldest first,
+// including the rotated files. Entries that cannot be parsed are
+// skipped.
+func (h *history) entries() ([]historyEntry, error) {
+	files := []string{h.file}
+	for n := 1; n <= historyBackups; n++ {
+		files = append([]string{h.backupFile(n)}, files...)
+	}
+
+	var entries []historyEntry
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not open history")
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, historyMaxSize)
+		for scanner.Scan() {
+			var e historyEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				klog.V(2).Infof("Skipping invalid history entry in %v: %v", file, err)
+				continue
+			}
+			entries = append(entries, e)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read history %v", file)
+		}
+	}
+	return entries, nil
+}
+
+// record the step in the history, with the versions of the handler's
+// packages before the step. The outcomes of the packages are those of
+// the summary, see summary.record. Must be called with ctl.mu held.
+func (ctl *Controller) record(step Step, before map[string]string, res *handlers.Result, err error) {
+	if ctl.history == nil {
+		return
+	}
+
+	var after map[string]string
+	if ctl.lock != nil {
+		after = ctl.lock.versions[step.Handler]
+	}
+	s := make(summary)
+	s.record(step, res, err)
+	e := historyEntry{
+		Time:      time.Now(),
+		Handler:   step.Handler,
+		Operation: step.Operation,
+		Args:      step.Packages,
+		Result:    "succeeded",
+	}
+	for _, name := range s.packages(step.Handler) {
+		o := s[step.Handler][name]
+		e.Packages = append(e.Packages, historyPackage{
+			Name:    name,
+			Outcome: o.kind,
+			From:    before[name],
+			To:      after[name],
+			Error:   o.reason,
+		})
+	}
+	switch err.(type) {
+	case nil:
+	case errorSkipped:
+		e.Result, e.Error = "skipped", err.Error()
+	default:
+		e.Result, e.Error = "failed", err.Error()
+	}
+
+	if err := ctl.history.append(e); err != nil {
+		output.Warn("Could not record operation in history: %v", err)
+	}
+}
+
+// versions returns a copy of the locked versions of the
+// handler's packages. Must be called with ctl.mu held.
+func (ctl *Controller) versions(handler string) map[string]string {
+	if ctl.history == nil || ctl.lock == nil {
+		return nil
+	}
+	versions := make(map[string]string, len(ctl.lock.versions[handler]))
+	for pkg, version := range ctl.lock.versions[handler] {
+		versions[pkg] = version
+	}
+	return versions
+}
+
+// PrintHistory prints the operations that have been recorded in the
+// history, the oldest first. If handler is set, only its operations are
+// printed, if since is set, only the operations after it. As JSON, the
+// entries are printed as they are recorded.
+func (ctl *Controller) PrintHistory(handler string, since time.Time) error {
+	if ctl.history == nil {
+		return errors.New("no history is recorded")
+	}
+	entries, err := ctl.history.entries()
+	if err != nil {
+		return err
+	}
+
+	printed := 0
+	for _, e := range entries {
+		if handler != "" && e.Handler != handler || e.Time.Before(since) {
+			continue
+		}
+		printed++
+		if output.GetFormat() == output.JSON {
+			if err := output.Record(e); err != nil {
+				return err
+			}
+			continue
+		}
+		printEntry(e)
+	}
+	if printed == 0 && output.GetFormat() != output.JSON {
+		output.Info("No operations have been recorded")
+	}
+	return nil
+}
+
+// printEntry prints the entry and the outcomes of its packages
+func printEntry(e historyEntry) {
+	line := fmt.Sprintf("%v  %v %v", e.Time.Local().Format("2006-01-02 15:04:05"), e.Handler, e.Operation)
+	if len(e.Args) > 0 {
+		line += " " + strings.Join(e.Args, " ")
+	}
+	line += fmt.Sprintf("  (%v)", e.Command)
+	switch e.Result {
+	case "failed":
+		output.Error("%v", line)
+	case "skipped":
+		output.Warn("%v", line)
+	default:
+		output.Info("%v", line)
+	}
+
+	pkgs := e.Packages
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+	for _, p := range pkgs {
+		name := p.Name
+		if name == "" {
+			name = "(all)"
+		}
+		s := fmt.Sprintf("    %v: %v", name, p.Outcome)
+		switch {
+		case p.From != "" && p.To != "" && p.From != p.To:
+			s += fmt.Sprintf(" (%v -> %v)", p.From, p.To)
+		case p.From != "" && p.To == "":
+			s += fmt.Sprintf(" (was %v)", p.From)
+		case p.To != "":
+			s += fmt.Sprintf(" (%v)", p.To)
+		}
+		if p.Error != "" {
+			s += ": " + strings.Join(strings.Fields(p.Error), " ")
+		}
+		output.Info("%v", s)
+	}
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestHistory(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.jsonl")
+
+	cfg := testConfig()
+	cfg.Packages["other"] = fake.EmptyPackages
+	ctl := &Controller{
+		configuration: cfg,
+		lock:          newLockfile(""),
+		handlers: map[string]*handler{
+			"fake":  {PackageHandler: &fake.Handler{Fail: []string{"bad"}}},
+			"other": {PackageHandler: &fake.Handler{}},
+		},
+	}
+	is.NoErr(History(file, []string{"/usr/local/bin/packa", "fake", "install"})(ctl))
+
+	is.True(ctl.Install("fake", "one", "bad") != nil)
+	is.NoErr(ctl.Upgrade("fake", "one"))
+	is.NoErr(ctl.Install("other", "two"))
+	is.NoErr(ctl.Remove("fake", "one"))
+
+	entries, err := ctl.history.entries()
+	is.NoErr(err)
+	is.Equal(4, len(entries))
+	is.Equal("packa fake install", entries[0].Command)
+	is.Equal(OperationInstall, entries[0].Operation)
+	is.Equal([]string{"one", "bad"}, entries[0].Args)
+	is.Equal("failed", entries[0].Result)
+	is.Equal("could not install bad", entries[0].Error)
+	is.Equal([]historyPackage{
+		{Name: "", Outcome: handlers.OutcomeFailed, Error: "could not install bad"},
+		{Name: "one", Outcome: handlers.OutcomeInstalled, To: "1.0.0"},
+	}, entries[0].Packages)
+	is.Equal([]historyPackage{{Name: "one", Outcome: handlers.OutcomeUpgraded, From: "1.0.0", To: "1.1.0"}}, entries[1].Packages)
+	is.Equal("succeeded", entries[1].Result)
+	is.Equal([]historyPackage{{Name: "one", Outcome: handlers.OutcomeRemoved, From: "1.1.0"}}, entries[3].Packages)
+
+	// only the operations of the handler since the time are printed
+	buf.Reset()
+	is.NoErr(ctl.PrintHistory("other", time.Time{}))
+	is.True(strings.Contains(buf.String(), "other install two  (packa fake install)"))
+	is.True(strings.Contains(buf.String(), "    two: installed (1.0.0)"))
+	is.True(!strings.Contains(buf.String(), "one:"))
+	buf.Reset()
+	is.NoErr(ctl.PrintHistory("", time.Now().Add(time.Hour)))
+	is.Equal("No operations have been recorded\n", buf.String())
+
+	// the history is rotated once it is too large, the
+	// entries of the rotated files are kept
+	ctl.history.maxSize = 1
+	is.NoErr(ctl.Install("other", "three"))
+	is.NoErr(ctl.Install("other", "four"))
+	_, err = os.Stat(file + ".1")
+	is.NoErr(err)
+	_, err = os.Stat(file + ".2")
+	is.NoErr(err)
+	entries, err = ctl.history.entries()
+	is.NoErr(err)
+	is.Equal(6, len(entries))
+	is.Equal("four", entries[5].Args[0])
+
+	for i := 0; i < historyBackups+1; i++ {
+		is.NoErr(ctl.Install("other", "five"))
+	}
+	entries, err = ctl.history.entries()
+	is.NoErr(err)
+	is.Equal(historyBackups+1, len(entries))
+}
@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Hooks are commands that are run before and after an operation on a
+// package. They are set with the "hooks" key of a package entry or of
+// the settings of a handler, whose hooks run for all of its packages.
+// The commands are executed with "sh -c", with the handler, operation
+// and package in the environment, see runHook. Post hooks only run for
+// the packages that the operation installed, upgraded or removed.
+type Hooks struct {
+	PreInstall  string `json:"preInstall,omitempty"`
+	PostInstall string `json:"postInstall,omitempty"`
+	PreUpgrade  string `json:"preUpgrade,omitempty"`
+	PostUpgrade string `json:"postUpgrade,omitempty"`
+	PreRemove   string `json:"preRemove,omitempty"`
+	PostRemove  string `json:"postRemove,omitempty"`
+}
+
+// hook returns the name and the command of the hook that runs
+// before or after the operation
+func (h *Hooks) hook(op Operation, post bool) (string, string) {
+	if h == nil {
+		return "", ""
+	}
+	switch {
+	case op == OperationInstall && !post:
+		return "preInstall", h.PreInstall
+	case op == OperationInstall:
+		return "postInstall", h.PostInstall
+	case op == OperationUpgrade && !post:
+		return "preUpgrade", h.PreUpgrade
+	case op == OperationUpgrade:
+		return "postUpgrade", h.PostUpgrade
+	case op == OperationRemove && !post:
+		return "preRemove", h.PreRemove
+	case op == OperationRemove:
+		return "postRemove", h.PostRemove
+	}
+	return "", ""
+}
+
+// PinChecker is an optional interface for PackageHandlers that do not
+// upgrade packages that are pinned to a version when all packages are
+// upgraded. Pinned reports whether the package in the handler's package
+// list is pinned, so that no hooks are run for it then.
+type PinChecker interface {
+	Pinned(pkg json.RawMessage) bool
+}
+
+// hooksOf returns the hooks of the package entry or settings
+// block, nil if it has none
+func hooksOf(raw json.RawMessage) (*Hooks, error) {
+	var entry map[string]json.RawMessage
+	// entries that are not objects cannot have hooks
+	if err := json.Unmarshal(raw, &entry); err != nil || entry["hooks"] == nil {
+		return nil, nil
+	}
+	var h Hooks
+	err := json.Unmarshal(entry["hooks"], &h)
+	return &h, errors.Wrapf(err, "invalid hooks %s", entry["hooks"])
+}
+
+// hooks returns the hooks of the handler's settings and of its
+// packages, by package identity. The hooks are not expanded, so
+// that the shell can expand the variables.
+func (ctl *Controller) hooks(handler string) (*Hooks, map[string]*Hooks, error) {
+	var h *Hooks
+	if settings := ctl.configuration.Settings.Handler[handler]; settings != nil {
+		var err error
+		if h, err = hooksOf(*settings); err != nil {
+			return nil, nil, errors.Wrapf(err, "could not parse settings of handler %v", handler)
+		}
+	}
+
+	list, err := packageList(ctl.configuration, handler)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkgs := make(map[string]*Hooks)
+	for _, pkg := range list {
+		hooks, err := hooksOf(pkg)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not parse package %s of handler %v", pkg, handler)
+		}
+		if hooks == nil {
+			continue
+		}
+		exp, err := expand(pkg)
+		if err != nil {
+			return nil, nil, err
+		}
+		pkgs[ctl.packageID(handler, exp)] = hooks
+	}
+	return h, pkgs, nil
+}
+
+// hookRun is a package that hooks are run for
+type hookRun struct {
+	// the package as given to the operation
+	arg     string
+	id      string
+	version string
+}
+
+// withHooks executes the operation of the step between the hooks of the
+// handler and of its packages. Packages whose hooks fail before the
+// operation are left out of it. If the step has no packages and runs
+// for all packages of the handler, it is not executed at all then.
+// The errors of the hooks are returned under the package's key.
+func (ctl *Controller) withHooks(step Step, f func(pkgs ...string) (*handlers.Result, error)) (*handlers.Result, error) {
+	ctl.mu.Lock()
+	handlerHooks, pkgHooks, err := ctl.hooks(step.Handler)
+	ctl.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if handlerHooks == nil && len(pkgHooks) == 0 || step.Operation == OperationSync {
+		return f(step.Packages...)
+	}
+	runs, err := ctl.hookRuns(step)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs := step.Packages
+	hookErrs := ctl.runHooks(step, false, handlerHooks, pkgHooks, runs)
+	if len(hookErrs) > 0 {
+		if len(pkgs) == 0 {
+			return nil, errors.Wrapf(hookErrs.IfNotEmpty(), "not executing %v", step.Operation)
+		}
+		pkgs, runs = nil, withoutFailed(runs, hookErrs)
+		for _, r := range runs {
+			pkgs = append(pkgs, r.arg)
+		}
+		if len(pkgs) == 0 {
+			return nil, hookErrs.IfNotEmpty()
+		}
+	}
+
+	res, err := f(pkgs...)
+	runs = changed(withoutFailed(runs, failedPackages(err)), res)
+	if res != nil {
+		for i := range runs {
+			if v, ok := res.Resolved[runs[i].id]; ok {
+				runs[i].version = v
+			}
+		}
+	}
+	hookErrs.Merge(ctl.runHooks(step, true, handlerHooks, pkgHooks, runs))
+	if len(hookErrs) == 0 {
+		return res, err
+	}
+	switch ce := errors.Cause(err).(type) {
+	case nil:
+	case *collection.Error:
+		hookErrs.Merge(*ce)
+	default:
+		hookErrs.Add(string(step.Operation), err)
+	}
+	return res, hookErrs.IfNotEmpty()
+}
+
+// runHooks runs the hooks of the handler and of the packages that run
+// before or after the operation of the step, the handler's hooks first.
+// Returns the errors of the failed hooks under the package's key.
+func (ctl *Controller) runHooks(step Step, post bool, handlerHooks *Hooks, pkgHooks map[string]*Hooks, runs []hookRun) collection.Error {
+	var cerr collection.Error
+	for _, r := range runs {
+		for _, hooks := range []*Hooks{handlerHooks, pkgHooks[r.id]} {
+			name, command := hooks.hook(step.Operation, post)
+			if command == "" {
+				continue
+			}
+			if err := runHook(step, name, command, r); err != nil {
+				cerr.Add(r.id, err)
+				break
+			}
+		}
+	}
+	return cerr
+}
+
+// runHook executes the command of the hook for the package, with the
+// handler, operation, hook and package in the environment
+func runHook(step Step, name, command string, r hookRun) error {
+	op := output.NewOperation(step.Handler, name, r.id, r.version)
+	op.Start("📦 %v\tRunning %v hook of package %v", step.Handler, name, r.id)
+	klog.V(3).Infof("Executing hook %v of package %v: %v", name, r.id, command)
+	_, err := cmd.Execute([]string{"sh", "-c", command},
+		cmd.Env(
+			"PACKA_HANDLER="+step.Handler,
+			"PACKA_OPERATION="+string(step.Operation),
+			"PACKA_HOOK="+name,
+			"PACKA_PACKAGE="+r.id,
+			"PACKA_VERSION="+r.version,
+		),
+		cmd.DirectPrintOperation(true, op, "📦 "+step.Handler+"\t"),
+	)
+	if err != nil {
+		return op.Fail(errors.Wrapf(err, "%v hook failed", name))
+	}
+	op.Succeed("📦 %v\tRan %v hook of package %v", step.Handler, name, r.id)
+	return nil
+}
+
+// hookRuns returns the packages of the step that hooks are run for.
+// If the step has no packages, it is run for all enabled packages
+// of the handler, except for the pinned packages if it is an upgrade,
+// see PinChecker.
+func (ctl *Controller) hookRuns(step Step) ([]hookRun, error) {
+	if len(step.Packages) > 0 {
+		runs := make([]hookRun, 0, len(step.Packages))
+		for _, arg := range step.Packages {
+			id, version := splitVersion(arg)
+			runs = append(runs, hookRun{arg: arg, id: id, version: version})
+		}
+		return runs, nil
+	}
+
+	ctl.mu.Lock()
+	pkgs, _, err := ctl.enabledPackages(step.Handler, true)
+	ctl.mu.Unlock()
+	if err != nil || pkgs == nil {
+		return nil, err
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(*pkgs), &list); err != nil {
+		return nil, errors.Wrapf(err, "could not parse packages of handler %v", step.Handler)
+	}
+	checker, _ := ctl.handlers[step.Handler].PackageHandler.(PinChecker)
+	var runs []hookRun
+	for _, pkg := range list {
+		if step.Operation == OperationUpgrade && checker != nil && checker.Pinned(pkg) {
+			// the handler does not upgrade the package
+			continue
+		}
+		id := ctl.packageID(step.Handler, pkg)
+		runs = append(runs, hookRun{id: id})
+	}
+	return runs, nil
+}
+
+// changed returns the runs of the packages that the operation installed,
+// upgraded or removed, as reported by their outcomes. If the handler does
+// not report outcomes, all runs are returned.
+func changed(runs []hookRun, res *handlers.Result) []hookRun {
+	if res == nil || res.Outcomes == nil {
+		return runs
+	}
+	var kept []hookRun
+	for _, r := range runs {
+		switch res.Outcomes[r.id] {
+		case handlers.OutcomeInstalled, handlers.OutcomeUpgraded, handlers.OutcomeRemoved:
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// failedPackages returns the packages that the operation failed for.
+// Handlers report them in a collection.Error, any other error fails
+// all packages and is returned under an empty key.
+func failedPackages(err error) collection.Error {
+	switch ce := errors.Cause(err).(type) {
+	case nil:
+		return nil
+	case *collection.Error:
+		return *ce
+	case collection.Error:
+		return ce
+	}
+	return collection.Error{"": err}
+}
+
+// withoutFailed returns the packages that have not failed, by the
+// package as given to the operation or its identity
+func withoutFailed(runs []hookRun, failed collection.Error) []hookRun {
+	if _, all := failed[""]; all {
+		return nil
+	}
+	var ok []hookRun
+	for _, r := range runs {
+		_, argFailed := failed[r.arg]
+		_, idFailed := failed[r.id]
+		if !argFailed && !idFailed {
+			ok = append(ok, r)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestHooks(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	readLog := func() []string {
+		data, err := ioutil.ReadFile(log)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		is.NoErr(err)
+		is.NoErr(os.Remove(log))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	record := `echo $PACKA_HOOK $PACKA_OPERATION $PACKA_PACKAGE $PACKA_VERSION >> ` + log
+
+	cfg := testConfig()
+	settings := json.RawMessage(`{"workingDir": "tmp", "hooks": {"preInstall": "` + record + `"}}`)
+	cfg.Settings.Handler["fake"] = &settings
+	packages := json.RawMessage(`[
+		{"url": "one", "hooks": {"postInstall": "` + record + `", "preRemove": "` + record + `"}},
+		{"url": "bad", "hooks": {"preInstall": "exit 1", "preUpgrade": "exit 1"}},
+		{"url": "two", "hooks": {"postUpgrade": "` + record + ` && exit 1"}}
+	]`)
+	cfg.Packages["fake"] = &packages
+	fH := &fake.Handler{}
+	ctl := &Controller{
+		configuration: cfg,
+		handlers:      map[string]*handler{"fake": {PackageHandler: fH}},
+	}
+
+	// the handler's hooks run first
+	is.NoErr(ctl.Install("fake", "one@2.0.0"))
+	is.Equal([]string{
+		"preInstall install one 2.0.0",
+		"postInstall install one 2.0.0",
+	}, readLog())
+
+	// packages whose hooks fail before the operation are left out
+	err = ctl.Install("fake", "bad", "three")
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "preInstall hook failed"))
+	is.Equal([]string{
+		"preInstall install bad",
+		"preInstall install three",
+	}, readLog())
+	is.Equal("three", fH.Packages[len(fH.Packages)-1].Name)
+
+	// failing hooks after the operation are reported under the package's key
+	err = ctl.Upgrade("fake", "two")
+	is.True(err != nil)
+	ce, ok := errors.Cause(err).(*collection.Error)
+	is.True(ok)
+	is.Equal(1, len(*ce))
+	is.Equal("postUpgrade hook failed: exit status 1", (*ce)["two"].Error())
+	is.Equal([]string{"postUpgrade upgrade two 1.1.0"}, readLog())
+
+	// operations on all packages are not executed if a hook fails before
+	err = ctl.Upgrade("fake")
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), "error executing action on handler fake: not executing upgrade"))
+	is.Equal(nil, readLog())
+
+	is.NoErr(ctl.Remove("fake", "one"))
+	is.Equal([]string{"preRemove remove one"}, readLog())
+
+	// the hooks are kept in the config
+	is.True(strings.Contains(string(*cfg.Packages["fake"]), `{"hooks":{"postUpgrade":`))
+}
+
+// pinningHandler pins the packages with a version, like the brew handler
+type pinningHandler struct {
+	*fake.Handler
+}
+
+func (h pinningHandler) Pinned(pkg json.RawMessage) bool {
+	var p fake.Package
+	return json.Unmarshal(pkg, &p) == nil && strings.Contains(p.Name, "@")
+}
+
+// Upgrade reports the pinned packages as pinned and installed packages
+// as unchanged, the others as upgraded
+func (h pinningHandler) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	res, err := h.Handler.Upgrade(pkgs...)
+	if res == nil {
+		return res, err
+	}
+	res.Outcomes = make(map[string]handlers.Outcome)
+	for name := range res.Resolved {
+		id, version := splitVersion(name)
+		switch {
+		case version != "":
+			res.Outcomes[id] = handlers.OutcomePinned
+		case contains(h.Installed, id):
+			res.Outcomes[id] = handlers.OutcomeUnchanged
+		default:
+			res.Outcomes[id] = handlers.OutcomeUpgraded
+		}
+	}
+	return res, err
+}
+
+func contains(pkgs []fake.Package, name string) bool {
+	for _, p := range pkgs {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHooksOutcomes(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	record := `echo $PACKA_HOOK $PACKA_PACKAGE >> ` + log
+
+	cfg := testConfig()
+	settings := json.RawMessage(`{"workingDir": "tmp", "hooks": {"preUpgrade": "` + record + `", "postUpgrade": "` + record + `"}}`)
+	cfg.Settings.Handler["fake"] = &settings
+	packages := json.RawMessage(`[{"url": "one"}, {"url": "pinned@1.0"}, {"url": "current"}]`)
+	cfg.Packages["fake"] = &packages
+	ctl := &Controller{
+		configuration: cfg,
+		handlers: map[string]*handler{"fake": {PackageHandler: pinningHandler{&fake.Handler{
+			Installed: []fake.Package{{Name: "current"}},
+		}}}},
+	}
+
+	// no hooks run for pinned packages, and no post hooks
+	// for packages that the upgrade did not change
+	is.NoErr(ctl.Upgrade("fake"))
+	data, err := ioutil.ReadFile(log)
+	is.NoErr(err)
+	is.Equal([]string{
+		"preUpgrade one",
+		"preUpgrade current",
+		"postUpgrade one",
+	}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+}
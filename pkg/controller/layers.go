@@ -0,0 +1,380 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers/script"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Identifier is an optional interface for PackageHandlers. PackageID
+// returns the identity of a package in the handler's package list,
+// e.g. its name without the version. Packages with the same identity
+// that are defined in multiple layers of the configuration are merged,
+// and changed packages are written back to the layer that defines them.
+// Without it, a package is identified by its whole definition.
+type Identifier interface {
+	PackageID(pkg json.RawMessage) (string, error)
+}
+
+// packageIDFunc returns the identity of a package of a handler
+type packageIDFunc func(handler string, pkg json.RawMessage) string
+
+// packageID returns the identity of the package as defined by the
+// handler, see Identifier
+func (ctl *Controller) packageID(handler string, pkg json.RawMessage) string {
+	if h, ok := ctl.handlers[handler]; ok {
+		if i, ok := h.PackageHandler.(Identifier); ok {
+			id, err := i.PackageID(pkg)
+			if err == nil {
+				return id
+			}
+			klog.V(4).Infof("Could not identify package %s of handler %v: %v", pkg, handler, err)
+		}
+	}
+	var b bytes.Buffer
+	if err := json.Compact(&b, pkg); err != nil {
+		return string(pkg)
+	}
+	return b.String()
+}
+
+// readConfig reads the configuration from file, without resolving
+// its includes
+func readConfig(file string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read config file")
+	}
+	cfg := defaultConfig()
+	if err := unmarshal(file, data, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Settings == nil {
+		cfg.Settings = defaultConfig().Settings
+	}
+	cfg.file = file
+	if FormatOf(file) != YAML {
+		return cfg, nil
+	}
+	if cfg.doc, err = parseDocument(data); err != nil {
+		klog.V(2).Infof("Could not parse %v, it is rewritten when saved: %v", file, err)
+	}
+	return cfg, nil
+}
+
+// includes reads the files that cfg includes, recursively, and returns
+// them in the order in which they are layered: included files come
+// before the file that includes them, files that are matched by a
+// glob in lexical order. Every file is only included once and read
+// with read.
+func includes(cfg *Configuration, seen map[string]bool, read func(string) (*Configuration, error)) ([]*Configuration, error) {
+	seen[absPath(cfg.file)] = true
+
+	var layers []*Configuration
+	for _, pattern := range cfg.Include {
+		pattern = expandPath(pattern, filepath.Dir(cfg.file))
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid include %v in %v", pattern, cfg.file)
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, errors.Errorf("included file %v of %v does not exist", pattern, cfg.file)
+		}
+
+		for _, file := range files {
+			if seen[absPath(file)] {
+				continue
+			}
+			klog.V(3).Infof("Including config file %v", file)
+			inc, err := read(file)
+			if err != nil {
+				return nil, err
+			}
+			sub, err := includes(inc, seen, read)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, sub...)
+			layers = append(layers, inc)
+		}
+	}
+	return layers, nil
+}
+
+// merge the layers into a single configuration. Settings of later
+// layers override the ones of earlier layers, per handler, as do
+// profiles and handler definitions with the same name. Packages are
+// merged per handler by their identity, where the definition of a later
+// layer overrides the one of an earlier layer. The layers are saved
+// separately, see split.
+func merge(layers []*Configuration, id packageIDFunc) (*Configuration, error) {
+	cfg := defaultConfig()
+	cfg.packageID = id
+	cfg.owners = make(map[string]map[string]*Configuration)
+
+	for _, l := range layers {
+		if l.Settings.Parallelism != 0 {
+			cfg.Settings.Parallelism = l.Settings.Parallelism
+		}
+		if l.Settings.Profile != "" {
+			cfg.Settings.Profile = l.Settings.Profile
+		}
+		for name, p := range l.Profiles {
+			if cfg.Profiles == nil {
+				cfg.Profiles = make(map[string]*Profile)
+			}
+			cfg.Profiles[name] = p
+		}
+		for h, s := range l.Settings.Handler {
+			cfg.Settings.Handler[h] = s
+		}
+		for name, def := range l.Handlers {
+			if cfg.Handlers == nil {
+				cfg.Handlers = make(map[string]*script.Definition)
+			}
+			cfg.Handlers[name] = def
+		}
+	}
+
+	for _, h := range handlersOf(layers) {
+		var ids []string
+		pkgs := make(map[string]json.RawMessage)
+		cfg.owners[h] = make(map[string]*Configuration)
+		for _, l := range layers {
+			list, err := packageList(l, h)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range list {
+				pid := id(h, p)
+				if _, ok := pkgs[pid]; !ok {
+					ids = append(ids, pid)
+				}
+				pkgs[pid] = p
+				cfg.owners[h][pid] = l
+			}
+		}
+
+		merged := make([]json.RawMessage, 0, len(ids))
+		for _, pid := range ids {
+			merged = append(merged, pkgs[pid])
+		}
+		raw, err := json.Marshal(merged)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not merge packages of handler %v", h)
+		}
+		msg := json.RawMessage(raw)
+		cfg.Packages[h] = &msg
+	}
+	return cfg, nil
+}
+
+// split the packages of the merged configuration into the layers. Every
+// layer keeps its own definitions, a changed package is only written to
+// the layer that defines the package as merged, see merge. Packages that
+// are not defined by any layer are added to the local layer, packages
+// that have been removed are removed from all layers. The packages of a
+// layer are only replaced if they have changed.
+func (cfg *Configuration) split() error {
+	owners := make(map[string]map[string]*Configuration)
+	for h, pkgs := range cfg.Packages {
+		owners[h] = make(map[string]*Configuration)
+		var list []json.RawMessage
+		if pkgs != nil {
+			if err := json.Unmarshal([]byte(*pkgs), &list); err != nil {
+				return errors.Wrapf(err, "could not parse packages of handler %v", h)
+			}
+		}
+		merged := make(map[string]json.RawMessage, len(list))
+		for _, p := range list {
+			pid := cfg.packageID(h, p)
+			owner, ok := cfg.owners[h][pid]
+			if !ok {
+				owner = cfg.local
+			}
+			owners[h][pid] = owner
+			merged[pid] = p
+		}
+
+		for _, l := range cfg.layers {
+			own, err := packageList(l, h)
+			if err != nil {
+				return err
+			}
+			updated := make([]json.RawMessage, 0, len(own))
+			defined := make(map[string]bool, len(own))
+			for _, p := range own {
+				pid := cfg.packageID(h, p)
+				defined[pid] = true
+				switch m, ok := merged[pid]; {
+				case !ok:
+					// the package has been removed
+				case owners[h][pid] == l:
+					updated = append(updated, m)
+				default:
+					updated = append(updated, p)
+				}
+			}
+			for _, p := range list {
+				pid := cfg.packageID(h, p)
+				if owners[h][pid] == l && !defined[pid] {
+					updated = append(updated, p)
+				}
+			}
+			if equalPackages(own, updated) {
+				continue
+			}
+			raw, err := json.Marshal(updated)
+			if err != nil {
+				return errors.Wrapf(err, "could not marshal packages of handler %v", h)
+			}
+			msg := json.RawMessage(raw)
+			l.Packages[h] = &msg
+		}
+	}
+	cfg.owners = owners
+	return nil
+}
+
+// equalPackages returns true if both lists contain the
+// same package definitions in the same order
+func equalPackages(a, b []json.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// layerOf returns the file of the layer that defines the package
+func (cfg *Configuration) layerOf(handler string, pkg json.RawMessage) string {
+	if owner, ok := cfg.owners[handler][cfg.packageID(handler, pkg)]; ok {
+		return owner.file
+	}
+	return cfg.local.file
+}
+
+// printLayers prints the packages of the handler, grouped
+// by the layer that defines them
+func (cfg *Configuration) printLayers(handler string, pkgs *json.RawMessage) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(*pkgs), &list); err != nil {
+		return errors.Wrapf(err, "could not parse packages of handler %v", handler)
+	}
+	var files []string
+	byLayer := make(map[string][]json.RawMessage)
+	for _, p := range list {
+		file := cfg.layerOf(handler, p)
+		if _, ok := byLayer[file]; !ok {
+			files = append(files, file)
+		}
+		byLayer[file] = append(byLayer[file], p)
+	}
+
+	for _, file := range files {
+		raw, err := json.Marshal(byLayer[file])
+		if err != nil {
+			return err
+		}
+		out, err := yaml.JSONToYAML(raw)
+		if err != nil {
+			return err
+		}
+		output.Info("%s (%s):\n%s", handler, file, out)
+	}
+	return nil
+}
+
+// listedPackage is a package of a handler as printed as JSON record,
+// with the file that defines it if the config includes other files
+type listedPackage struct {
+	Handler string          `json:"handler"`
+	File    string          `json:"file,omitempty"`
+	Package json.RawMessage `json:"package"`
+}
+
+// recordPackages prints every package of the handler as JSON record
+func (cfg *Configuration) recordPackages(handler string, pkgs *json.RawMessage) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(*pkgs), &list); err != nil {
+		return errors.Wrapf(err, "could not parse packages of handler %v", handler)
+	}
+	for _, p := range list {
+		r := listedPackage{Handler: handler, Package: p}
+		if len(cfg.layers) > 0 {
+			r.File = cfg.layerOf(handler, p)
+		}
+		if err := output.Record(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packageList returns the parsed package list of the handler in cfg
+func packageList(cfg *Configuration, handler string) ([]json.RawMessage, error) {
+	var list []json.RawMessage
+	pkgs := cfg.Packages[handler]
+	if pkgs == nil {
+		return nil, nil
+	}
+	err := json.Unmarshal([]byte(*pkgs), &list)
+	return list, errors.Wrapf(err, "could not parse packages of handler %v in %v", handler, cfg.file)
+}
+
+// handlersOf returns the sorted names of the handlers
+// that have packages defined in any of the layers
+func handlersOf(layers []*Configuration) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, l := range layers {
+		for h := range l.Packages {
+			if !seen[h] {
+				seen[h] = true
+				names = append(names, h)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expandPath expands a leading ~ to the home directory of the user
+// and makes relative paths relative to dir
+func expandPath(path, dir string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if usr, err := user.Current(); err == nil {
+			path = filepath.Join(usr.HomeDir, path[1:])
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
+
+// absPath returns the absolute path of file with all symlinks
+// resolved, or the cleaned path if that fails
+func absPath(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(file); err == nil {
+		file = resolved
+	}
+	return filepath.Clean(file)
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestLayers(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	write := func(file, content string) {
+		is.NoErr(os.MkdirAll(filepath.Dir(file), 0755))
+		is.NoErr(ioutil.WriteFile(file, []byte(content), 0600))
+	}
+	content := func(file string) string {
+		data, err := ioutil.ReadFile(file)
+		is.NoErr(err)
+		return string(data)
+	}
+
+	base := filepath.Join(dir, "base.yml")
+	work := filepath.Join(dir, "conf.d", "work.yml")
+	local := filepath.Join(dir, "conf.d", "local.yml")
+	main := filepath.Join(dir, "packa.yml")
+	write(base, "settings:\n  parallelism: 2\npackages:\n  fake:\n  - url: one\n  - url: two\n")
+	write(work, "packages:\n  fake:\n  - url: two@2.0.0\n  - url: three\n")
+	write(local, "packages:\n  fake: []\n")
+	write(main, "include:\n- base.yml\n- conf.d/*.yml\nlocal: conf.d/local.yml\n")
+
+	fH := &fake.Handler{}
+	newController := func() *Controller {
+		ctl, err := New(
+			PidFile(filepath.Join(dir, "packa.pid")),
+			BackupDir(filepath.Join(dir, "backups")),
+			RegisterHandlers(map[string]PackageHandler{"fake": fH}),
+			ConfigFile(main),
+		)
+		is.NoErr(err)
+		return ctl
+	}
+
+	ctl := newController()
+	is.Equal(2, ctl.configuration.Settings.Parallelism)
+	// two is overridden by the later layer, but keeps its position
+	is.Equal(`[{"url":"one"},{"url":"two@2.0.0"},{"url":"three"}]`, string(*ctl.configuration.Packages["fake"]))
+
+	is.NoErr(ctl.PrintPackages("fake"))
+	is.True(strings.Contains(buf.String(), "fake ("+base+"):\n- url: one\n"))
+	is.True(strings.Contains(buf.String(), "fake ("+work+"):\n- url: two@2.0.0\n- url: three\n"))
+
+	// a package that is overridden by a later layer is kept in
+	// the earlier layer, files without changes are not rewritten
+	files := map[string]string{base: content(base), work: content(work), local: content(local), main: content(main)}
+	is.NoErr(ctl.Close())
+	for file, c := range files {
+		is.Equal(c, content(file))
+	}
+	ctl = newController()
+
+	// as JSON, every package is printed as record with its file
+	is.NoErr(output.SetFormat("json"))
+	buf.Reset()
+	is.NoErr(ctl.PrintPackages("fake"))
+	is.NoErr(output.SetFormat("text"))
+	is.True(strings.Contains(buf.String(), `{"handler":"fake","file":"`+base+`","package":{"url":"one"}}`))
+
+	// new packages are added to the local layer, removed
+	// and upgraded ones are written back to their owner
+	is.NoErr(ctl.Install("fake", "four"))
+	is.NoErr(ctl.Remove("fake", "one"))
+	is.NoErr(ctl.Upgrade("fake", "three"))
+	is.NoErr(ctl.Close())
+
+	is.Equal("apiVersion: v2\nsettings:\n  parallelism: 2\npackages:\n  fake:\n  - url: two\n", content(base))
+	is.Equal("apiVersion: v2\npackages:\n  fake:\n  - url: two@2.0.0\n  - url: three+\n", content(work))
+	is.Equal("apiVersion: v2\npackages:\n  fake:\n  - url: four\n", content(local))
+	// files without changes are not rewritten to add the apiVersion
+	is.Equal("include:\n- base.yml\n- conf.d/*.yml\nlocal: conf.d/local.yml\n", content(main))
+
+	// an unknown local layer is an error
+	write(main, "include:\n- base.yml\nlocal: other.yml\n")
+	_, err = New(
+		PidFile(filepath.Join(dir, "packa.pid")),
+		RegisterHandlers(map[string]PackageHandler{"fake": &fake.Handler{}}),
+		ConfigFile(main),
+	)
+	is.True(err != nil)
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"k8s.io/klog"
+)
+
+// lockfile records the exact version of every package that has been
+// installed or upgraded by a handler, keyed by handler and package name.
+// A nil lockfile records nothing.
+type lockfile struct {
+	versions map[string]map[string]string
+	// for operations on the lockfile (save / close)
+	file string
+	// if the lockfile has been modified since reading it
+	changed bool
+}
+
+func newLockfile(file string) *lockfile {
+	return &lockfile{
+		versions: make(map[string]map[string]string),
+		file:     file,
+	}
+}
+
+// readLockfile reads the lockfile from file. A lockfile that
+// does not exist yet is returned empty.
+func readLockfile(file string) (*lockfile, error) {
+	l := newLockfile(file)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		klog.V(3).Infof("Lockfile %v does not exist yet", file)
+		return l, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read lockfile")
+	}
+
+	if err := yaml.Unmarshal(data, &l.versions); err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshal lockfile %v", file)
+	}
+	if l.versions == nil {
+		l.versions = make(map[string]map[string]string)
+	}
+	return l, nil
+}
+
+// update the lockfile with the versions that have been resolved
+// and the packages that have been removed by the handler
+func (l *lockfile) update(handler string, res *handlers.Result) {
+	if l == nil || len(res.Resolved) == 0 && len(res.Removed) == 0 {
+		return
+	}
+
+	if l.versions[handler] == nil {
+		l.versions[handler] = make(map[string]string)
+	}
+	for pkg, version := range res.Resolved {
+		klog.V(4).Infof("Locking package %v of handler %v to version %v", pkg, handler, version)
+		l.versions[handler][pkg] = version
+	}
+	for _, pkg := range res.Removed {
+		delete(l.versions[handler], pkg)
+	}
+	if len(l.versions[handler]) == 0 {
+		delete(l.versions, handler)
+	}
+	l.changed = true
+}
+
+// locked returns the locked packages of the handler in the format
+// name@version, sorted by name. If pkgs are given, only those are
+// returned, an error is returned if one of them is not locked.
+func (l *lockfile) locked(handler string, pkgs ...string) ([]string, error) {
+	var versions map[string]string
+	if l != nil {
+		versions = l.versions[handler]
+	}
+	if len(pkgs) == 0 {
+		for pkg := range versions {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+	}
+
+	locked := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		version, ok := versions[pkg]
+		if !ok {
+			return nil, errors.Errorf("package %v of handler %v is not locked", pkg, handler)
+		}
+		locked = append(locked, pkg+"@"+version)
+	}
+	return locked, nil
+}
+
+// splitVersion splits a package as given to the operations of a
+// handler into its identity and its version, see lockfile.locked
+func splitVersion(pkg string) (string, string) {
+	if i := strings.LastIndex(pkg, "@"); i > 0 {
+		return pkg[:i], pkg[i+1:]
+	}
+	return pkg, ""
+}
+
+// copy returns a deep copy of the lockfile
+func (l *lockfile) copy() *lockfile {
+	if l == nil {
+		return nil
+	}
+	c := newLockfile(l.file)
+	for handler, versions := range l.versions {
+		c.versions[handler] = make(map[string]string, len(versions))
+		for pkg, version := range versions {
+			c.versions[handler][pkg] = version
+		}
+	}
+	c.changed = l.changed
+	return c
+}
+
+// save the lockfile to its file, if it has been changed
+func (l *lockfile) save() error {
+	if l == nil || !l.changed {
+		return nil
+	}
+	if l.file == "" {
+		return errorFileNotSet
+	}
+
+	data, err := yaml.Marshal(l.versions)
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal lockfile")
+	}
+	err = writeFileAtomic(l.file, data)
+	if err != nil {
+		return errors.Wrapf(err, "could not write lockfile")
+	}
+	l.changed = false
+	return nil
+}
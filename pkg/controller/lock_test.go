@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+// frozenHandler records the locked versions of frozen installs
+type frozenHandler struct {
+	*fake.Handler
+	locked map[string]string
+}
+
+func (h *frozenHandler) InstallFrozen(locked map[string]string) (*handlers.Result, error) {
+	h.locked = locked
+	return &handlers.Result{Resolved: locked}, nil
+}
+
+func TestLockfile(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "packa.yml")
+	lockFile := filepath.Join(dir, "packa.lock")
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte("packages:\n  fake: []\n"), 0644))
+
+	newController := func(fH *fake.Handler) *Controller {
+		ctl, err := New(
+			PidFile(filepath.Join(dir, "packa.pid")),
+			BackupDir(dir),
+			ConfigFile(cfgFile),
+			RegisterHandlers(map[string]PackageHandler{"fake": fH}),
+		)
+		is.NoErr(err)
+		return ctl
+	}
+
+	// listing packages does not create a lockfile
+	ctl := newController(&fake.Handler{})
+	is.NoErr(ctl.PrintPackages())
+	is.NoErr(ctl.Close())
+	_, err = os.Stat(lockFile)
+	is.True(os.IsNotExist(err))
+
+	ctl = newController(&fake.Handler{})
+	is.NoErr(ctl.Install("fake", "one", "two@2.0.0", "three"))
+	is.NoErr(ctl.Remove("fake", "three"))
+	is.NoErr(ctl.Close())
+
+	lock, err := ioutil.ReadFile(lockFile)
+	is.NoErr(err)
+	is.Equal(`fake:
+  one: `+fake.DefaultVersion+`
+  two: 2.0.0
+`, string(lock))
+	cfg, err := ioutil.ReadFile(cfgFile)
+	is.NoErr(err)
+
+	// a frozen install installs the locked versions
+	// without modifying the index
+	fH := &fake.Handler{}
+	ctl = newController(fH)
+	is.NoErr(ctl.InstallFrozen("fake"))
+	is.Equal([]fake.Package{{Name: "one"}, {Name: "two"}}, fH.Installed)
+
+	err = ctl.InstallFrozen("fake", "three")
+	is.True(err != nil) // three has been removed from the lockfile
+	is.NoErr(ctl.Close())
+
+	// handlers that cannot install name@version get the locked versions
+	fI := &frozenHandler{Handler: &fake.Handler{}}
+	ctl, err = New(
+		PidFile(filepath.Join(dir, "packa.pid")),
+		BackupDir(dir),
+		ConfigFile(cfgFile),
+		RegisterHandlers(map[string]PackageHandler{"fake": fI}),
+	)
+	is.NoErr(err)
+	is.NoErr(ctl.InstallFrozen("fake"))
+	is.Equal(map[string]string{"one": fake.DefaultVersion, "two": "2.0.0"}, fI.locked)
+	is.Equal(0, len(fI.Installed))
+	is.NoErr(ctl.Close())
+
+	after, err := ioutil.ReadFile(cfgFile)
+	is.NoErr(err)
+	is.Equal(string(cfg), string(after))
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// apiVersions of the configuration, oldest first. Configurations
+// without an apiVersion have the oldest version.
+var apiVersions = []string{"v1", "v2"}
+
+// currentAPIVersion is the apiVersion that configurations are migrated to
+var currentAPIVersion = apiVersions[len(apiVersions)-1]
+
+// Migrator is an optional interface for PackageHandlers. Migrations
+// returns the migrations of the handler's settings and packages, which
+// are executed when a configuration of an older apiVersion is loaded.
+type Migrator interface {
+	Migrations() []handlers.Migration
+}
+
+// loadConfig reads the configuration from file and migrates it to the
+// current apiVersion. A migrated configuration is only saved once it
+// has been validated, see saveMigrated. If nothing had to be migrated,
+// the apiVersion of the file is kept until it is saved for another
+// change.
+func (ctl *Controller) loadConfig(file string) (*Configuration, error) {
+	cfg, err := readConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	version := cfg.APIVersion
+	changed, err := ctl.migrate(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not migrate %v", file)
+	}
+	if !changed {
+		cfg.APIVersion = version
+		return cfg, nil
+	}
+	klog.V(2).Infof("Migrated config %v from apiVersion %q", file, version)
+	cfg.migrated = true
+	return cfg, nil
+}
+
+// saveMigrated saves the configuration if it has been migrated
+// when it was loaded, keeping the previous version as backup
+func (ctl *Controller) saveMigrated(cfg *Configuration) error {
+	if !cfg.migrated {
+		return nil
+	}
+	cfg.backupDir = ctl.backupDir
+	if err := cfg.save(); err != nil {
+		return errors.Wrapf(err, "could not save migrated config %v", cfg.file)
+	}
+	cfg.migrated = false
+	output.Info("Migrated config %v to apiVersion %v", cfg.file, currentAPIVersion)
+	return nil
+}
+
+// migrate the configuration to the current apiVersion by executing the
+// migrations of the handlers for every version in between. Returns true
+// if the settings or packages have been changed.
+func (ctl *Controller) migrate(cfg *Configuration) (bool, error) {
+	version := cfg.APIVersion
+	if version == "" {
+		version = apiVersions[0]
+	}
+	from := -1
+	for i, v := range apiVersions {
+		if v == version {
+			from = i
+		}
+	}
+	if from < 0 {
+		return false, errors.Errorf("unknown apiVersion %v, the latest supported version is %v", version, currentAPIVersion)
+	}
+
+	cfg.APIVersion = currentAPIVersion
+	before, err := json.Marshal(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range apiVersions[from : len(apiVersions)-1] {
+		for _, name := range ctl.registeredHandlers() {
+			m, ok := ctl.handlers[name].PackageHandler.(Migrator)
+			if !ok {
+				continue
+			}
+			for _, migration := range m.Migrations() {
+				if migration.From != v {
+					continue
+				}
+				klog.V(2).Infof("Migrating handler %v from apiVersion %v: %v", name, v, migration.Description)
+				if err := cfg.migrateHandler(name, migration); err != nil {
+					return false, errors.Wrapf(err, "could not migrate handler %v from apiVersion %v", name, v)
+				}
+			}
+		}
+	}
+
+	after, err := json.Marshal(cfg)
+	return !bytes.Equal(before, after), err
+}
+
+// migrateHandler executes the migration on the handler's settings
+// and packages
+func (cfg *Configuration) migrateHandler(name string, m handlers.Migration) error {
+	settings, hasSettings := cfg.Settings.Handler[name]
+	packages, hasPackages := cfg.Packages[name]
+	settings, packages, err := m.Migrate(settings, packages)
+	if err != nil {
+		return err
+	}
+	if settings != nil || hasSettings {
+		cfg.Settings.Handler[name] = settings
+	}
+	if packages != nil || hasPackages {
+		cfg.Packages[name] = packages
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+// migrateHandler is a fake handler that renames the settings key
+// "dir" to "workingDir" and the package key "url" to "name"
+type migrateHandler struct {
+	fake.Handler
+}
+
+func (h *migrateHandler) Schema() handlers.Schema {
+	return handlers.Schema{
+		Package: json.RawMessage(`{"type": "object", "properties": {"name": {"type": "string"}}}`),
+	}
+}
+
+func (h *migrateHandler) Migrations() []handlers.Migration {
+	rename := func(raw *json.RawMessage, from, to string) (*json.RawMessage, error) {
+		if raw == nil {
+			return nil, nil
+		}
+		var v interface{}
+		if err := json.Unmarshal(*raw, &v); err != nil {
+			return nil, err
+		}
+		objs := []interface{}{v}
+		if list, ok := v.([]interface{}); ok {
+			objs = list
+		}
+		for _, o := range objs {
+			m := o.(map[string]interface{})
+			if val, ok := m[from]; ok {
+				m[to] = val
+				delete(m, from)
+			}
+		}
+		b, err := json.Marshal(v)
+		msg := json.RawMessage(b)
+		return &msg, err
+	}
+	return []handlers.Migration{{
+		From:        "v1",
+		Description: "rename keys",
+		Migrate: func(settings, packages *json.RawMessage) (*json.RawMessage, *json.RawMessage, error) {
+			settings, err := rename(settings, "dir", "workingDir")
+			if err != nil {
+				return nil, nil, err
+			}
+			packages, err = rename(packages, "url", "name")
+			return settings, packages, err
+		},
+	}}
+}
+
+func TestMigrate(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "packa.yml")
+	backups := filepath.Join(dir, "backups")
+	newController := func() (*Controller, error) {
+		return New(
+			PidFile(filepath.Join(dir, "packa.pid")),
+			BackupDir(backups),
+			RegisterHandlers(map[string]PackageHandler{"fake": &migrateHandler{}}),
+			ConfigFile(cfgFile),
+		)
+	}
+	content := func(file string) string {
+		c, err := ioutil.ReadFile(file)
+		is.NoErr(err)
+		return string(c)
+	}
+
+	old := "settings:\n  handler:\n    fake:\n      dir: /tmp\npackages:\n  fake:\n  - url: one\n"
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte(old), 0600))
+	ctl, err := New(RegisterHandlers(map[string]PackageHandler{"fake": &migrateHandler{}}))
+	is.NoErr(err)
+	is.True(ctl.ValidateConfig(cfgFile) != nil) // the file has to be migrated first
+
+	ctl, err = newController()
+	is.NoErr(err)
+	is.NoErr(ctl.Close())
+
+	migrated := "apiVersion: v2\nsettings:\n  handler:\n    fake:\n      workingDir: /tmp\npackages:\n  fake:\n  - name: one\n"
+	is.Equal(migrated, content(cfgFile))
+	is.Equal(old, content(filepath.Join(backups, "packa.yml.~1~")))
+
+	// a migrated config is not migrated again
+	ctl, err = newController()
+	is.NoErr(err)
+	is.NoErr(ctl.ValidateConfig(cfgFile))
+	is.NoErr(ctl.Close())
+	is.Equal(migrated, content(cfgFile))
+
+	// the apiVersion is only added to files that are written anyway
+	current := "packages:\n  fake:\n  - name: one\nsettings: {}\n"
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte(current), 0600))
+	ctl, err = newController()
+	is.NoErr(err)
+	is.NoErr(ctl.Close())
+	is.Equal(current, content(cfgFile))
+
+	// an invalid config is not saved after migrating it
+	invalid := "packages:\n  fake:\n  - url: [one]\n"
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte(invalid), 0600))
+	_, err = newController()
+	is.True(err != nil)
+	is.Equal(invalid, content(cfgFile))
+
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte("apiVersion: v3\n"), 0600))
+	_, err = newController()
+	is.True(err != nil) // unknown apiVersion
+}
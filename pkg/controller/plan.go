@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Planner is an optional interface for PackageHandlers. Handlers that
+// implement it can report the changes they would make to the system
+// without executing anything.
+type Planner interface {
+	// Plan compares the packages in the handler's index to the
+	// packages installed on the system and returns the changes
+	// that are needed to reach the state defined in the index.
+	Plan() ([]handlers.Change, error)
+}
+
+// planChecker is an optional interface for Planners that can only
+// plan in some configurations, e.g. script handlers with a list command
+type planChecker interface {
+	CanPlan() bool
+}
+
+// planner returns the handler as Planner, if it can be planned
+func planner(h PackageHandler) (Planner, bool) {
+	p, ok := h.(Planner)
+	if c, checks := h.(planChecker); ok && checks {
+		ok = c.CanPlan()
+	}
+	return p, ok
+}
+
+// Plan returns the changes that the given handlers would make to the
+// system, keyed by the handler's name. If no handler is specified,
+// plan for all handlers that support planning, see plannerNames.
+func (ctl *Controller) Plan(names ...string) (map[string][]handlers.Change, error) {
+	if len(names) == 0 {
+		klog.V(1).Infof("Planning changes of all handlers")
+		names = ctl.plannerNames()
+	}
+
+	plans := make(map[string][]handlers.Change)
+	var cerr collection.Error
+	for _, name := range names {
+		klog.V(2).Infof("Planning changes of handler %v", name)
+		changes, err := ctl.plan(name)
+		if err != nil {
+			cerr.Add(name, err)
+		}
+		// even if an error occurred, the handler may have
+		// returned the changes it could determine
+		if err == nil || len(changes) > 0 {
+			plans[name] = changes
+		}
+	}
+	return plans, cerr.IfNotEmpty()
+}
+
+// PrintPlan prints the changes that the given handlers would make
+// to the system. If no handler is specified, print the plan of all
+// handlers.
+func (ctl *Controller) PrintPlan(names ...string) error {
+	plans, err := ctl.Plan(names...)
+	if perr := printChanges(plans); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// plannedChange is a change of a handler as printed as JSON record
+type plannedChange struct {
+	Handler string `json:"handler"`
+	handlers.Change
+}
+
+// printChanges prints the changes of every handler, sorted by
+// the handler's name. As JSON, every change is printed as record.
+func printChanges(plans map[string][]handlers.Change) error {
+	for _, name := range sortedKeys(plans) {
+		if output.GetFormat() == output.JSON {
+			for _, c := range plans[name] {
+				if err := output.Record(plannedChange{name, c}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if len(plans[name]) == 0 {
+			output.Info("%v: no changes", name)
+			continue
+		}
+		output.Info("%v:", name)
+		for _, c := range plans[name] {
+			output.Info("  %v %v", changeSymbol(c.Action), c)
+		}
+	}
+	return nil
+}
+
+// plannerNames returns the names of the handlers that can be
+// planned, see handlerNames. The other handlers are skipped.
+func (ctl *Controller) plannerNames() []string {
+	var names []string
+	for _, name := range ctl.handlerNames() {
+		if _, ok := planner(ctl.handlers[name].PackageHandler); !ok {
+			klog.V(2).Infof("Skipping handler %v, it does not support planning", name)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// plan initialises the handler if needed and asks it for its changes
+func (ctl *Controller) plan(name string) ([]handlers.Change, error) {
+	if ctl.handlers[name] == nil {
+		return nil, errors.Errorf("handler \"%v\" does not exist or has not been registered", name)
+	}
+
+	p, ok := planner(ctl.handlers[name].PackageHandler)
+	if !ok {
+		return nil, errors.Errorf("handler \"%v\" does not support planning", name)
+	}
+
+	if !ctl.handlers[name].initialised {
+		klog.V(2).Infof("Initialising handler %v", name)
+		if err := ctl.initialiseHandler(name); err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := ctl.configuration.handlerSettings(name)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := p.Plan()
+	if !settings.Prune {
+		// without pruning, packages that are not in the
+		// index are left on the system
+		var kept []handlers.Change
+		for _, c := range changes {
+			if c.Action != handlers.ActionRemove {
+				kept = append(kept, c)
+			}
+		}
+		changes = kept
+	}
+	return changes, errors.Wrapf(err, "could not plan changes of handler %v", name)
+}
+
+// changeSymbol returns a diff-like prefix for the action
+func changeSymbol(a handlers.Action) string {
+	switch a {
+	case handlers.ActionInstall, handlers.ActionTap:
+		return "+"
+	case handlers.ActionRemove, handlers.ActionUntap:
+		return "-"
+	default:
+		return "~"
+	}
+}
+
+func sortedKeys(plans map[string][]handlers.Change) []string {
+	keys := make([]string, 0, len(plans))
+	for k := range plans {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Profile enables a subset of the handlers and packages of the
+// configuration, e.g. to share a config between the work and home
+// machine.
+type Profile struct {
+	// Handlers that are enabled, all handlers if empty
+	Handlers []string `json:"handlers,omitempty"`
+	// Packages that are enabled, per handler. Packages are identified by
+	// their identity (e.g. the URL without the version, see Identifier).
+	// All packages of handlers without an entry are enabled.
+	Packages map[string][]string `json:"packages,omitempty"`
+}
+
+// hasHandler returns true if the handler is enabled in the profile
+func (p *Profile) hasHandler(name string) bool {
+	if p == nil || len(p.Handlers) == 0 {
+		return true
+	}
+	for _, h := range p.Handlers {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// packages returns the identities of the enabled packages of the
+// handler and if the profile restricts them at all
+func (p *Profile) packages(handler string) (map[string]bool, bool) {
+	if p == nil {
+		return nil, false
+	}
+	ids, ok := p.Packages[handler]
+	if !ok {
+		return nil, false
+	}
+	enabled := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		enabled[id] = true
+	}
+	return enabled, true
+}
+
+// Option for the controller initialisation.
+// SelectProfile selects the profile that is active instead of the
+// default profile in the settings.
+func SelectProfile(name string) Option {
+	return func(ctl *Controller) error {
+		ctl.profile = name
+		return nil
+	}
+}
+
+// activeProfile returns the name of the active profile and the profile
+// itself, which is nil if no profile is active
+func (ctl *Controller) activeProfile() (string, *Profile, error) {
+	name := ctl.profile
+	if name == "" {
+		name = ctl.configuration.Settings.Profile
+	}
+	if name == "" {
+		return "", nil, nil
+	}
+	p, ok := ctl.configuration.Profiles[name]
+	if !ok {
+		return name, nil, errors.Errorf("profile %v does not exist", name)
+	}
+	return name, p, nil
+}
+
+// SetDefaultProfile sets the profile that is active if no other profile
+// is selected and saves it in the settings. An empty name disables
+// the default profile.
+func (ctl *Controller) SetDefaultProfile(name string) error {
+	if _, ok := ctl.configuration.Profiles[name]; name != "" && !ok {
+		return errors.Errorf("profile %v does not exist", name)
+	}
+	klog.V(2).Infof("Setting default profile to %q", name)
+	ctl.configuration.Settings.Profile = name
+	if n := len(ctl.configuration.layers); n > 0 {
+		// settings are saved to the main config file
+		ctl.configuration.layers[n-1].Settings.Profile = name
+	}
+	return nil
+}
+
+// PrintProfile prints the name of the active profile
+func (ctl *Controller) PrintProfile() error {
+	name, _, err := ctl.activeProfile()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		output.Info("No profile is active")
+		return nil
+	}
+	output.Info("%v", name)
+	return nil
+}
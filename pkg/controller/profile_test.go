@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestProfiles(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	newController := func(profile string) (*Controller, *fake.Handler) {
+		cfg := testConfig()
+		pkgs := json.RawMessage(`[{"url":"one"},{"url":"two"},{"url":"three"}]`)
+		cfg.Packages["fake"] = &pkgs
+		cfg.Profiles = map[string]*Profile{
+			"work": {Packages: map[string][]string{"fake": {"one", "three"}}},
+			"home": {Handlers: []string{"other"}},
+		}
+		fH := &fake.Handler{}
+		ctl, err := New(
+			Config(cfg),
+			RegisterHandlers(map[string]PackageHandler{"fake": fH}),
+			SelectProfile(profile),
+		)
+		is.NoErr(err)
+		return ctl, fH
+	}
+
+	ctl, fH := newController("work")
+	is.NoErr(ctl.PrintPackages())
+	is.True(strings.Contains(buf.String(), "- url: one\n- url: three\n"))
+	is.True(!strings.Contains(buf.String(), "two"))
+
+	// the handler only knows the packages of the profile, the others
+	// are kept as they are
+	is.NoErr(ctl.Install("fake", "four"))
+	is.Equal([]fake.Package{{Name: "one"}, {Name: "three"}, {Name: "four"}}, fH.Packages)
+	is.NoErr(ctl.Remove("fake", "one"))
+	is.NoErr(ctl.UpgradeAll())
+	is.Equal(`[{"url":"two"},{"url":"three+"},{"url":"four+"}]`, string(*ctl.configuration.Packages["fake"]))
+	is.Equal([]string{"one", "three", "four"}, ctl.configuration.Profiles["work"].Packages["fake"])
+
+	// handlers that are not enabled are skipped or refused
+	ctl, fH = newController("home")
+	is.NoErr(ctl.UpgradeAll())
+	is.True(ctl.Install("fake", "four") != nil)
+	is.True(ctl.PrintPackages("fake") != nil)
+	is.Equal(0, len(fH.Packages))
+
+	// the default profile is used if none is selected
+	ctl, _ = newController("")
+	is.True(ctl.SetDefaultProfile("nope") != nil)
+	is.NoErr(ctl.SetDefaultProfile("home"))
+	is.Equal("home", ctl.configuration.Settings.Profile)
+	is.True(ctl.Install("fake", "four") != nil)
+
+	ctl, _ = newController("nope")
+	is.True(ctl.PrintPackages() != nil)
+}
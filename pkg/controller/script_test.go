@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/handlers/script"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestScriptHandlers(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	write := func(file, content string) {
+		is.NoErr(ioutil.WriteFile(file, []byte(content), 0600))
+	}
+	newController := func(cfgFile string, h map[string]PackageHandler) (*Controller, error) {
+		return New(
+			PidFile(filepath.Join(dir, "packa.pid")),
+			BackupDir(filepath.Join(dir, "backups")),
+			RegisterHandlers(h),
+			ConfigFile(cfgFile),
+		)
+	}
+
+	main := filepath.Join(dir, "packa.yml")
+	write(filepath.Join(dir, "cargo.yml"), `handlers:
+  cargo:
+    install: echo cargo install {{.Name}} >> log
+    remove: echo cargo uninstall {{.Name}} >> log
+`)
+	write(main, `include:
+- cargo.yml
+handlers:
+  pipx:
+    install: pipx install {{.Name}}
+    remove: pipx uninstall {{.Name}}
+packages:
+  cargo:
+  - name: ripgrep
+    version: 12.1.1
+`)
+
+	defs, err := HandlerDefinitions(main)
+	is.NoErr(err)
+	is.Equal(2, len(defs))
+	is.Equal("echo cargo install {{.Name}} >> log", defs["cargo"].Install)
+	is.Equal("pipx uninstall {{.Name}}", defs["pipx"].Remove)
+
+	defs, err = HandlerDefinitions(filepath.Join(dir, "missing.yml"))
+	is.NoErr(err)
+	is.Equal(0, len(defs))
+
+	// handlers that have not been registered are registered with the config
+	ctl, err := newController(main, map[string]PackageHandler{"fake": &fake.Handler{}})
+	is.NoErr(err)
+	cargo, ok := ctl.handlers["cargo"].PackageHandler.(*script.Handler)
+	is.True(ok)
+	is.NoErr(ctl.initialiseHandler("cargo"))
+	is.Equal([]script.Package{{Name: "ripgrep", Version: "12.1.1"}}, cargo.Packages)
+	_, ok = ctl.handlers["pipx"]
+	is.True(ok)
+	is.NoErr(ctl.Close())
+
+	// the packages are validated against the schema of the handler
+	write(main, "include:\n- cargo.yml\npackages:\n  cargo:\n  - url: ripgrep\n")
+	_, err = newController(main, nil)
+	is.True(err != nil)
+
+	// handlers must not shadow other handlers
+	write(main, "include:\n- cargo.yml\nhandlers:\n  fake:\n    install: 'true'\n    remove: 'true'\n")
+	_, err = newController(main, map[string]PackageHandler{"fake": &fake.Handler{}})
+	is.True(err != nil)
+
+	// install and remove are required
+	write(main, "handlers:\n  pipx:\n    install: pipx install {{.Name}}\n")
+	_, err = newController(main, nil)
+	is.True(err != nil)
+}
+
+func TestPlanScriptHandlers(t *testing.T) {
+	is := is.New(t)
+
+	listed, err := script.New("listed", script.Definition{Install: "true", Remove: "true", List: "echo one 1.0"})
+	is.NoErr(err)
+	unlisted, err := script.New("unlisted", script.Definition{Install: "true", Remove: "true"})
+	is.NoErr(err)
+
+	cfg := testConfig()
+	prune := json.RawMessage(`{"prune": true}`)
+	cfg.Settings.Handler["listed"] = &prune
+	ctl := &Controller{
+		configuration: cfg,
+		handlers: map[string]*handler{
+			"listed":   {PackageHandler: listed},
+			"unlisted": {PackageHandler: unlisted},
+		},
+	}
+
+	// handlers without a list command are skipped
+	plans, err := ctl.Plan()
+	is.NoErr(err)
+	is.Equal(map[string][]handlers.Change{
+		"listed": {{Action: handlers.ActionRemove, Package: "one", From: "1.0"}},
+	}, plans)
+
+	_, err = ctl.Plan("unlisted")
+	is.Equal("handler \"unlisted\" does not support planning", err.Error())
+}
@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"k8s.io/klog"
+)
+
+// Selector restricts a package or a handler to the hosts that it
+// matches. It is set with the "when" key of a package entry or of the
+// settings of a handler. All conditions that are set have to match.
+type Selector struct {
+	// OS of the host, as in GOOS (e.g. darwin or linux)
+	OS string `json:"os,omitempty"`
+	// Arch of the host, as in GOARCH (e.g. amd64)
+	Arch string `json:"arch,omitempty"`
+	// Hostname glob (e.g. "*.example.com")
+	Hostname string `json:"hostname,omitempty"`
+	// Env is the name of an environment variable that has to be set
+	Env string `json:"env,omitempty"`
+}
+
+// the host that selectors are evaluated on, can be replaced in tests
+var (
+	hostOS    = runtime.GOOS
+	hostArch  = runtime.GOARCH
+	hostname  = os.Hostname
+	lookupEnv = os.LookupEnv
+)
+
+// matches returns true if the selector matches the host. A nil
+// selector matches all hosts.
+func (s *Selector) matches() (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	if s.OS != "" && s.OS != hostOS {
+		return false, nil
+	}
+	if s.Arch != "" && s.Arch != hostArch {
+		return false, nil
+	}
+	if s.Hostname != "" {
+		name, err := hostname()
+		if err != nil {
+			return false, errors.Wrapf(err, "could not get hostname")
+		}
+		ok, err := path.Match(s.Hostname, name)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid hostname glob %v", s.Hostname)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	if s.Env != "" {
+		if _, ok := lookupEnv(s.Env); !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// selected returns the selector of the package entry or settings
+// block, if any, and if it matches the host
+func selected(raw json.RawMessage) (json.RawMessage, bool, error) {
+	var entry struct {
+		When json.RawMessage `json:"when"`
+	}
+	// entries that are not objects cannot have a selector
+	if err := json.Unmarshal(raw, &entry); err != nil || entry.When == nil {
+		return nil, true, nil
+	}
+	var s *Selector
+	if err := json.Unmarshal(entry.When, &s); err != nil {
+		return nil, false, errors.Wrapf(err, "invalid selector %s", entry.When)
+	}
+	ok, err := s.matches()
+	return entry.When, ok, err
+}
+
+// errorDisabled is returned for handlers that are not enabled
+type errorDisabled string
+
+func (e errorDisabled) Error() string {
+	return string(e)
+}
+
+// checkHandler returns an errorDisabled if the handler is not enabled
+// in the active profile or if its settings do not select this host
+func (ctl *Controller) checkHandler(name string) error {
+	profile, p, err := ctl.activeProfile()
+	if err != nil {
+		return err
+	}
+	if !p.hasHandler(name) {
+		return errorDisabled(fmt.Sprintf("handler %v is not enabled in profile %v", name, profile))
+	}
+	if settings := ctl.configuration.Settings.Handler[name]; settings != nil {
+		_, ok, err := selected(*settings)
+		if err != nil {
+			return errors.Wrapf(err, "could not evaluate settings of handler %v", name)
+		}
+		if !ok {
+			return errorDisabled(fmt.Sprintf("handler %v is not enabled on this host", name))
+		}
+	}
+	return nil
+}
+
+// enabledPackages returns the packages of the handler that are enabled
+// in the active profile and select this host, with their values expanded
+// if expanded is set. If any package has been filtered, has a selector,
+// hooks or expandable values, the identities of the returned packages are returned
+// as well, so that the result of the handler can be merged back, see
+// mergePackages.
+func (ctl *Controller) enabledPackages(handler string, expanded bool) (*json.RawMessage, map[string]bool, error) {
+	packages := ctl.configuration.Packages[handler]
+	if packages == nil {
+		return nil, nil, nil
+	}
+	_, p, err := ctl.activeProfile()
+	if err != nil {
+		return nil, nil, err
+	}
+	enabled, restricted := p.packages(handler)
+
+	list, err := packageList(ctl.configuration, handler)
+	if err != nil {
+		return nil, nil, err
+	}
+	filtered := []json.RawMessage{}
+	visible := make(map[string]bool)
+	merge := restricted
+	for _, pkg := range list {
+		exp, err := expand(pkg)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not expand package of handler %v", handler)
+		}
+		id := ctl.packageID(handler, exp)
+		when, ok, err := selected(pkg)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not evaluate package %v of handler %v", id, handler)
+		}
+		hooks, err := hooksOf(pkg)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not parse package %v of handler %v", id, handler)
+		}
+		merge = merge || when != nil || hooks != nil || !bytes.Equal(exp, pkg)
+		if !ok || restricted && !enabled[id] {
+			klog.V(4).Infof("Package %v of handler %v is not enabled", id, handler)
+			continue
+		}
+		if expanded {
+			pkg = exp
+		}
+		filtered = append(filtered, pkg)
+		visible[id] = true
+	}
+	if !merge {
+		return packages, nil, nil
+	}
+
+	raw, err := json.Marshal(filtered)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not marshal packages of handler %v", handler)
+	}
+	msg := json.RawMessage(raw)
+	return &msg, visible, nil
+}
+
+// mergePackages merges the packages of the result of a handler, which
+// only knows the visible packages, into all packages of the handler.
+// Packages that the handler does not know are kept, as are the selectors
+// and hooks and the unexpanded values of the packages it knows. Packages that have been
+// added are enabled in the handler's profile.
+func (ctl *Controller) mergePackages(handler string, visible map[string]bool, res *handlers.Result) (*json.RawMessage, error) {
+	removed := make(map[string]bool, len(res.Removed))
+	for _, r := range res.Removed {
+		removed[r] = true
+	}
+
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(*res.Packages), &list); err != nil {
+		return nil, errors.Wrapf(err, "could not parse packages of handler %v", handler)
+	}
+	var ids []string
+	result := make(map[string]json.RawMessage, len(list))
+	for _, pkg := range list {
+		id := ctl.packageID(handler, pkg)
+		ids = append(ids, id)
+		result[id] = pkg
+	}
+
+	all, err := packageList(ctl.configuration, handler)
+	if err != nil {
+		return nil, err
+	}
+	merged := []json.RawMessage{}
+	seen := make(map[string]bool)
+	for _, pkg := range all {
+		exp, err := expand(pkg)
+		if err != nil {
+			return nil, err
+		}
+		id := ctl.packageID(handler, exp)
+		switch r, ok := result[id]; {
+		case seen[id]:
+		case ok:
+			r, err := unexpand(r, pkg)
+			if err != nil {
+				return nil, err
+			}
+			r, err = withControllerKeys(r, pkg)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, r)
+			seen[id] = true
+		case !visible[id] && !removed[id]:
+			merged = append(merged, pkg)
+		}
+	}
+	p := ctl.handlers[handler].profile
+	for _, id := range ids {
+		if !seen[id] {
+			merged = append(merged, result[id])
+			seen[id] = true
+		}
+		if enabled, restricted := p.packages(handler); restricted && !enabled[id] {
+			klog.V(3).Infof("Enabling package %v of handler %v in profile", id, handler)
+			p.Packages[handler] = append(p.Packages[handler], id)
+		}
+	}
+
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not marshal packages of handler %v", handler)
+	}
+	msg := json.RawMessage(raw)
+	return &msg, nil
+}
+
+// withControllerKeys adds the selector and the hooks of the original
+// package entry to pkg, as handlers do not know about them
+func withControllerKeys(pkg, original json.RawMessage) (json.RawMessage, error) {
+	var orig map[string]json.RawMessage
+	if err := json.Unmarshal(original, &orig); err != nil {
+		return pkg, nil
+	}
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(pkg, &entry); err != nil {
+		return pkg, nil
+	}
+	var changed bool
+	for _, key := range []string{"when", "hooks"} {
+		if v, ok := orig[key]; ok {
+			entry[key] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return pkg, nil
+	}
+	return json.Marshal(entry)
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+// invalidHandler returns packages that cannot be merged
+type invalidHandler struct {
+	*fake.Handler
+}
+
+func (h invalidHandler) Install(pkgs ...string) (*handlers.Result, error) {
+	res, err := h.Handler.Install(pkgs...)
+	invalid := json.RawMessage(`{}`)
+	res.Packages = &invalid
+	return res, err
+}
+
+func TestSelector(t *testing.T) {
+	is := is.New(t)
+
+	defer func(os, arch string, name func() (string, error), env func(string) (string, bool)) {
+		hostOS, hostArch, hostname, lookupEnv = os, arch, name, env
+	}(hostOS, hostArch, hostname, lookupEnv)
+	hostOS, hostArch = "linux", "amd64"
+	hostname = func() (string, error) { return "box.example.com", nil }
+	lookupEnv = func(key string) (string, bool) { return "", key == "WORK" }
+
+	tests := map[string]struct {
+		selector *Selector
+		matches  bool
+	}{
+		"nil":           {nil, true},
+		"empty":         {&Selector{}, true},
+		"os":            {&Selector{OS: "linux"}, true},
+		"other os":      {&Selector{OS: "darwin"}, false},
+		"arch":          {&Selector{OS: "linux", Arch: "amd64"}, true},
+		"other arch":    {&Selector{OS: "linux", Arch: "arm64"}, false},
+		"hostname":      {&Selector{Hostname: "*.example.com"}, true},
+		"other host":    {&Selector{Hostname: "*.example.org"}, false},
+		"env":           {&Selector{Env: "WORK"}, true},
+		"env not set":   {&Selector{Env: "HOME"}, false},
+		"all match":     {&Selector{OS: "linux", Arch: "amd64", Hostname: "box.*", Env: "WORK"}, true},
+		"one not match": {&Selector{OS: "linux", Arch: "amd64", Hostname: "box.*", Env: "HOME"}, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			ok, err := tt.selector.matches()
+			is.NoErr(err)
+			is.Equal(tt.matches, ok)
+		})
+	}
+
+	cfg := testConfig()
+	pkgs := json.RawMessage(`[{"url":"one"},{"url":"two","when":{"os":"darwin"}},{"url":"three","when":{"arch":"amd64"}}]`)
+	cfg.Packages["fake"] = &pkgs
+	cfg.Packages["mac"] = fake.EmptyPackages
+	macSettings := json.RawMessage(`{"when":{"os":"darwin"}}`)
+	cfg.Settings.Handler["mac"] = &macSettings
+
+	fH := &fake.Handler{}
+	ctl, err := New(
+		Config(cfg),
+		RegisterHandlers(map[string]PackageHandler{"fake": fH, "mac": &fake.Handler{}}),
+	)
+	is.NoErr(err)
+
+	// handlers that do not select the host are skipped
+	is.Equal([]string{"fake"}, ctl.handlerNames())
+	is.True(ctl.Install("mac", "one") != nil)
+
+	// packages that do not select the host are kept, as are the
+	// selectors of the packages that do
+	is.NoErr(ctl.UpgradeAll())
+	is.Equal([]fake.Package{{Name: "one+"}, {Name: "three+"}}, fH.Packages)
+	is.Equal(`[{"url":"one+"},{"url":"two","when":{"os":"darwin"}},{"url":"three+","when":{"arch":"amd64"}}]`, string(*ctl.configuration.Packages["fake"]))
+
+	// if the result cannot be merged, the index is kept, but the
+	// changes are recorded so that they can be rolled back
+	ctl.handlers["fake"].PackageHandler = invalidHandler{fH}
+	ctl.atomic = true
+	index := string(*ctl.configuration.Packages["fake"])
+	is.True(ctl.Install("fake", "four") != nil)
+	is.Equal(index, string(*ctl.configuration.Packages["fake"]))
+	for _, pkg := range fH.Installed {
+		is.True(pkg.Name != "four") // rolled back
+	}
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+)
+
+// ErrDrift is returned by PrintStatus if the system does not match
+// the configuration
+var ErrDrift = errors.New("the system has drifted from the configuration")
+
+// DriftKind describes how a package differs from its definition
+type DriftKind string
+
+const (
+	// declared but not installed
+	DriftMissing DriftKind = "missing"
+	// installed at a different version than declared
+	DriftVersion DriftKind = "version"
+	// a newer version than the installed is available
+	DriftOutdated DriftKind = "outdated"
+	// installed but not declared
+	DriftUnlisted DriftKind = "unlisted"
+	// pinned but declared without a version
+	DriftPinned DriftKind = "pinned"
+	// declared with a version but not pinned
+	DriftUnpinned DriftKind = "unpinned"
+	// declared tap that has not been tapped
+	DriftTapMissing DriftKind = "tap missing"
+	// tapped but not declared
+	DriftTapUnlisted DriftKind = "tap unlisted"
+)
+
+// Drift is a single difference between the configuration of
+// a handler and the system
+type Drift struct {
+	Handler   string    `json:"handler"`
+	Package   string    `json:"package"`
+	Kind      DriftKind `json:"drift"`
+	Installed string    `json:"installed,omitempty"`
+	Declared  string    `json:"declared,omitempty"`
+}
+
+// Status returns the differences between the configuration of the
+// given handlers and the system. If no handler is specified, check
+// all handlers.
+func (ctl *Controller) Status(names ...string) ([]Drift, error) {
+	plans, err := ctl.Plan(names...)
+
+	var drift []Drift
+	for _, name := range sortedKeys(plans) {
+		for _, c := range plans[name] {
+			drift = append(drift, Drift{
+				Handler:   name,
+				Package:   c.Package,
+				Kind:      driftKind(c),
+				Installed: c.From,
+				Declared:  c.To,
+			})
+		}
+	}
+	return drift, err
+}
+
+// PrintStatus prints the differences between the configuration of the
+// given handlers and the system as table, or every difference as JSON
+// record. If no handler is specified, check all handlers. Returns
+// ErrDrift if there is any difference. The differences of the handlers
+// that could be checked are printed even if other handlers failed, their
+// errors are returned together with ErrDrift.
+func (ctl *Controller) PrintStatus(names ...string) error {
+	drift, err := ctl.Status(names...)
+
+	switch {
+	case output.GetFormat() == output.JSON:
+		for _, d := range drift {
+			if err := output.Record(d); err != nil {
+				return err
+			}
+		}
+	case len(drift) == 0:
+		if err == nil {
+			output.Success("The system matches the configuration")
+		}
+	default:
+		out := output.LineWriter("", false)
+		defer out.Close()
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HANDLER\tPACKAGE\tDRIFT\tINSTALLED\tDECLARED")
+		for _, d := range drift {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", d.Handler, d.Package, d.Kind, d.Installed, d.Declared)
+		}
+		if err := w.Flush(); err != nil {
+			return errors.Wrapf(err, "could not print status")
+		}
+	}
+
+	if len(drift) == 0 {
+		return err
+	}
+	if err == nil {
+		return ErrDrift
+	}
+	cerr := collection.Error{"drift": ErrDrift}
+	if c, ok := err.(*collection.Error); ok {
+		cerr.Merge(*c)
+	} else {
+		cerr.Add("status", err)
+	}
+	return &cerr
+}
+
+// driftKind returns the kind of drift that the change would resolve
+func driftKind(c handlers.Change) DriftKind {
+	switch c.Action {
+	case handlers.ActionInstall:
+		if c.From != "" {
+			return DriftVersion
+		}
+		return DriftMissing
+	case handlers.ActionUpgrade:
+		return DriftOutdated
+	case handlers.ActionRemove:
+		return DriftUnlisted
+	case handlers.ActionPin:
+		return DriftUnpinned
+	case handlers.ActionUnpin:
+		return DriftPinned
+	case handlers.ActionTap:
+		return DriftTapMissing
+	case handlers.ActionUntap:
+		return DriftTapUnlisted
+	}
+	return DriftKind(c.Action)
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+)
+
+// Operation is the name of an operation that can be executed
+// on a handler
+type Operation string
+
+const (
+	OperationInstall Operation = "install"
+	OperationRemove  Operation = "remove"
+	OperationUpgrade Operation = "upgrade"
+	// OperationSync only syncs the handler, see Syncer
+	OperationSync Operation = "sync"
+	// OperationPin and OperationUnpin pin and unpin
+	// installed packages, see Pinner
+	OperationPin   Operation = "pin"
+	OperationUnpin Operation = "unpin"
+)
+
+// handlerOperation is a function taken from the PackageHandler interface.
+type handlerOperation func(handler PackageHandler, pkgs ...string) (result *handlers.Result, err error)
+
+// operations maps the operations to their functions
+var operations = map[Operation]handlerOperation{
+	OperationInstall: PackageHandler.Install,
+	OperationRemove:  PackageHandler.Remove,
+	OperationUpgrade: PackageHandler.Upgrade,
+	// handlers are synced before any operation,
+	// so there is nothing left to do
+	OperationSync: func(PackageHandler, ...string) (*handlers.Result, error) {
+		return nil, nil
+	},
+	OperationPin: func(h PackageHandler, pkgs ...string) (*handlers.Result, error) {
+		p, ok := h.(Pinner)
+		if !ok {
+			return nil, errors.New("handler does not support pinning")
+		}
+		return p.Pin(pkgs...)
+	},
+	OperationUnpin: func(h PackageHandler, pkgs ...string) (*handlers.Result, error) {
+		p, ok := h.(Pinner)
+		if !ok {
+			return nil, errors.New("handler does not support pinning")
+		}
+		return p.Unpin(pkgs...)
+	},
+}
+
+// Step is a single operation on a handler, executed with the
+// given packages. Steps can be serialised to be executed later on.
+type Step struct {
+	Handler   string    `json:"handler"`
+	Operation Operation `json:"operation"`
+	Packages  []string  `json:"packages,omitempty"`
+	// frozen steps install the locked versions of the
+	// packages and do not modify the handler's index
+	frozen bool
+}
+
+func (s Step) String() string {
+	if len(s.Packages) == 0 {
+		return fmt.Sprintf("%v %v", s.Handler, s.Operation)
+	}
+	return fmt.Sprintf("%v %v %v", s.Handler, s.Operation, strings.Join(s.Packages, " "))
+}
@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+)
+
+// outcome of the operations on a package, with the reason if it failed
+type outcome struct {
+	kind   handlers.Outcome
+	reason string
+}
+
+// summary collects the outcomes of the packages that have been operated
+// on during a run, by handler and package. A failure of a handler that
+// is not specific to a package is recorded under an empty package.
+type summary map[string]map[string]outcome
+
+// defaultOutcomes of the operations, for the packages of handlers
+// that do not report their outcomes
+var defaultOutcomes = map[Operation]handlers.Outcome{
+	OperationInstall: handlers.OutcomeInstalled,
+	OperationUpgrade: handlers.OutcomeUpgraded,
+}
+
+// record the outcomes of the step's result and the packages that
+// failed as reported in err, see failedPackages
+func (s summary) record(step Step, res *handlers.Result, err error) {
+	pkgs := s[step.Handler]
+	if pkgs == nil {
+		pkgs = make(map[string]outcome)
+		s[step.Handler] = pkgs
+	}
+	if res != nil {
+		if kind, ok := defaultOutcomes[step.Operation]; ok {
+			for name := range res.Resolved {
+				if _, reported := res.Outcomes[name]; !reported {
+					pkgs[name] = outcome{kind: kind}
+				}
+			}
+		}
+		for _, name := range res.Removed {
+			if _, reported := res.Outcomes[name]; !reported {
+				pkgs[name] = outcome{kind: handlers.OutcomeRemoved}
+			}
+		}
+		for name, kind := range res.Outcomes {
+			pkgs[name] = outcome{kind: kind}
+		}
+	}
+	if _, skipped := err.(errorSkipped); skipped {
+		// the step has not been executed
+		names := step.Packages
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, pkg := range names {
+			id, _ := splitVersion(pkg)
+			pkgs[id] = outcome{kind: handlers.OutcomeSkipped, reason: err.Error()}
+		}
+		err = nil
+	}
+	for key, err := range failedPackages(err) {
+		id, _ := splitVersion(key)
+		pkgs[id] = outcome{kind: handlers.OutcomeFailed, reason: err.Error()}
+	}
+	if len(pkgs) == 0 {
+		delete(s, step.Handler)
+	}
+}
+
+// rolledBack marks the packages that have been changed as failed,
+// as their changes have been rolled back
+func (s summary) rolledBack() {
+	for _, pkgs := range s {
+		for name, o := range pkgs {
+			switch o.kind {
+			case handlers.OutcomeInstalled, handlers.OutcomeUpgraded, handlers.OutcomeRemoved:
+				pkgs[name] = outcome{kind: handlers.OutcomeFailed, reason: fmt.Sprintf("%v, but rolled back", o.kind)}
+			}
+		}
+	}
+}
+
+// handlers returns the names of the handlers in the summary, sorted
+func (s summary) handlers() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packages returns the packages of the handler in the summary, sorted
+func (s summary) packages(handler string) []string {
+	pkgs := make([]string, 0, len(s[handler]))
+	for pkg := range s[handler] {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// report the outcomes of the step in the summary and the history, with
+// the versions of the handler's packages before the step, see record
+func (ctl *Controller) report(step Step, before map[string]string, res *handlers.Result, err error) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if ctl.summary == nil {
+		ctl.summary = make(summary)
+	}
+	ctl.summary.record(step, res, err)
+	ctl.record(step, before, res, err)
+}
+
+// PrintSummary prints the outcomes of the packages that have been
+// operated on as table, and how many packages of each handler had
+// which outcome. Prints nothing if no packages have been operated on.
+// Returns an error if any package has failed.
+func (ctl *Controller) PrintSummary() error {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if len(ctl.summary) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HANDLER\tPACKAGE\tOUTCOME\tREASON")
+	var counts []string
+	failed := 0
+	for _, name := range ctl.summary.handlers() {
+		pkgs := ctl.summary[name]
+		perKind := make(map[handlers.Outcome]int)
+		for _, pkg := range ctl.summary.packages(name) {
+			o := pkgs[pkg]
+			perKind[o.kind]++
+			reason := strings.Join(strings.Fields(o.reason), " ")
+			output.Summarise(name, pkg, string(o.kind), reason)
+			if pkg == "" {
+				pkg = "(all)"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", name, pkg, o.kind, reason)
+		}
+		failed += perKind[handlers.OutcomeFailed]
+
+		var c []string
+		for _, kind := range []handlers.Outcome{
+			handlers.OutcomeInstalled,
+			handlers.OutcomeUpgraded,
+			handlers.OutcomeRemoved,
+			handlers.OutcomeUnchanged,
+			handlers.OutcomePinned,
+			handlers.OutcomeSkipped,
+			handlers.OutcomeFailed,
+		} {
+			if perKind[kind] > 0 {
+				c = append(c, fmt.Sprintf("%v %v", perKind[kind], kind))
+			}
+		}
+		counts = append(counts, fmt.Sprintf("%v: %v", name, strings.Join(c, ", ")))
+	}
+	_ = w.Flush()
+
+	if output.GetFormat() != output.JSON {
+		// the padding of the last column of rows without reason
+		table := strings.TrimSuffix(buf.String(), "\n")
+		lines := strings.Split(table, "\n")
+		for i := range lines {
+			lines[i] = strings.TrimRight(lines[i], " ")
+		}
+		output.Info("\nSummary:\n%s", strings.Join(lines, "\n"))
+		for _, c := range counts {
+			output.Info("%v", c)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%v package(s) failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+// outcomeHandler reports the outcomes of its upgrades
+type outcomeHandler struct {
+	*fake.Handler
+	outcomes map[string]handlers.Outcome
+}
+
+func (h *outcomeHandler) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	res, err := h.Handler.Upgrade(pkgs...)
+	if res != nil {
+		res.Outcomes = h.outcomes
+	}
+	return res, err
+}
+
+func TestSummary(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	cfg := testConfig()
+	cfg.Packages["other"] = fake.DefaultPackagesRaw
+	ctl := &Controller{
+		configuration: cfg,
+		handlers: map[string]*handler{
+			"fake": {PackageHandler: &fake.Handler{Fail: []string{"bad"}}},
+			"other": {PackageHandler: &outcomeHandler{
+				Handler: &fake.Handler{},
+				outcomes: map[string]handlers.Outcome{
+					"fakePackage1": handlers.OutcomeUnchanged,
+					"fakePackage2": handlers.OutcomePinned,
+				},
+			}},
+		},
+	}
+
+	// nothing is printed before any package has been operated on
+	is.NoErr(ctl.PrintSummary())
+	is.Equal("", buf.String())
+
+	is.True(ctl.Install("fake", "one@2.0.0", "two", "bad") != nil)
+	is.NoErr(ctl.Upgrade("other"))
+	is.NoErr(ctl.Remove("fake", "one"))
+	is.NoErr(ctl.Upgrade("fake", "two"))
+
+	buf.Reset()
+	err := ctl.PrintSummary()
+	is.True(err != nil)
+	is.Equal("1 package(s) failed", err.Error())
+	is.Equal(`
+Summary:
+HANDLER  PACKAGE       OUTCOME    REASON
+fake     (all)         failed     could not install bad
+fake     one           removed
+fake     two           upgraded
+other    fakePackage1  unchanged
+other    fakePackage2  pinned
+fake: 1 upgraded, 1 removed, 1 failed
+other: 1 unchanged, 1 pinned
+`, buf.String())
+
+	// as JSON, every package is a summary event
+	buf.Reset()
+	is.NoErr(output.SetFormat("json"))
+	defer func() { _ = output.SetFormat("text") }()
+	is.True(ctl.PrintSummary() != nil)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	is.Equal(5, len(lines))
+	is.True(strings.Contains(lines[0], `"kind":"summary","handler":"fake","outcome":"failed","error":"could not install bad"`))
+	is.True(strings.Contains(lines[4], `"kind":"summary","handler":"other","package":"fakePackage2","outcome":"pinned"`))
+}
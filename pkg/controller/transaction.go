@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Option for the controller initialisation.
+// Atomic makes the operations of the controller all-or-nothing: if
+// an operation fails on one package, the changes to all other packages
+// are rolled back as well.
+func Atomic(atomic bool) Option {
+	return func(ctl *Controller) error {
+		ctl.atomic = atomic
+		return nil
+	}
+}
+
+// transaction executes f, which executes operations on handlers. The
+// steps that the handlers have executed are committed as soon as f
+// returns. If f fails and the controller is atomic, the steps are rolled
+// back instead and the index and lockfile are reset.
+func (ctl *Controller) transaction(f func() error) error {
+	var packages map[string]*json.RawMessage
+	var lock *lockfile
+	if ctl.atomic {
+		ctl.mu.Lock()
+		packages = make(map[string]*json.RawMessage, len(ctl.configuration.Packages))
+		for name, pkgs := range ctl.configuration.Packages {
+			packages[name] = pkgs
+		}
+		lock = ctl.lock.copy()
+		ctl.mu.Unlock()
+	}
+
+	err := f()
+	if err == nil || !ctl.atomic {
+		if cerr := ctl.journal.Commit(); cerr != nil {
+			output.Warn("Could not clean up after the operation: %v", cerr)
+		}
+		return err
+	}
+
+	output.Warn("Rolling back all changes because of errors")
+	ctl.mu.Lock()
+	ctl.configuration.Packages = packages
+	ctl.lock = lock
+	ctl.summary.rolledBack()
+	ctl.mu.Unlock()
+
+	if rerr := ctl.journal.Rollback(); rerr != nil {
+		return errors.Wrapf(err, "could not roll back all changes (%v)", rerr)
+	}
+	klog.V(2).Infof("Rolled back all changes")
+	return errors.Wrap(err, "rolled back all changes")
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestAtomic(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+
+	newController := func(fH *fake.Handler, atomic bool) *Controller {
+		ctl, err := New(
+			Config(testConfig()),
+			RegisterHandlers(map[string]PackageHandler{"fake": fH}),
+			Atomic(atomic),
+		)
+		is.NoErr(err)
+		return ctl
+	}
+
+	// without atomic, the packages that could be installed are kept
+	fH := &fake.Handler{Fail: []string{"two"}}
+	ctl := newController(fH, false)
+	is.True(ctl.Install("fake", "one", "two", "three") != nil)
+	is.Equal([]fake.Package{{Name: "one"}, {Name: "three"}}, fH.Installed)
+	is.Equal(`[{"url":"one"},{"url":"three"}]`, string(*ctl.configuration.Packages["fake"]))
+	is.Equal(2, len(ctl.lock.versions["fake"]))
+
+	// with atomic, they are rolled back, as are the index and lockfile
+	fH = &fake.Handler{Fail: []string{"two"}}
+	ctl = newController(fH, true)
+	err := ctl.Install("fake", "one", "two", "three")
+	is.True(err != nil)
+	is.Equal(0, len(fH.Installed))
+	is.Equal(string(*fake.EmptyPackages), string(*ctl.configuration.Packages["fake"]))
+	is.Equal(0, len(ctl.lock.versions))
+
+	// successful operations are not rolled back
+	is.NoErr(ctl.Install("fake", "one"))
+	is.Equal([]fake.Package{{Name: "one"}}, fH.Installed)
+}
@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/schema"
+	yamlv3 "gopkg.in/yaml.v3"
+	"k8s.io/klog"
+)
+
+// Schemer is an optional interface for PackageHandlers. Schema returns
+// the JSON Schemas of the handler's settings and package entries, which
+// are used to validate the configuration. The controller adds its own
+// keys (like "when") to them.
+type Schemer interface {
+	Schema() handlers.Schema
+}
+
+// configSchema is the schema of the configuration, without the
+// settings and packages of the handlers
+const configSchema = `{
+	"type": ["object", "null"],
+	"additionalProperties": false,
+	"properties": {
+		"apiVersion": {"type": "string"},
+		"include": {"type": "array", "items": {"type": "string"}},
+		"local": {"type": "string"},
+		"settings": {
+			"type": ["object", "null"],
+			"additionalProperties": false,
+			"properties": {
+				"parallelism": {"type": "integer"},
+				"profile": {"type": "string"},
+				"handler": {"type": ["object", "null"]}
+			}
+		},
+		"packages": {"type": ["object", "null"]},
+		"handlers": {
+			"type": ["object", "null"],
+			"additionalProperties": {
+				"type": "object",
+				"additionalProperties": false,
+				"required": ["install", "remove"],
+				"properties": {
+					"description": {"type": "string"},
+					"install": {"type": "string"},
+					"remove": {"type": "string"},
+					"upgrade": {"type": "string"},
+					"list": {"type": "string"}
+				}
+			}
+		},
+		"profiles": {
+			"type": ["object", "null"],
+			"additionalProperties": {
+				"type": "object",
+				"additionalProperties": false,
+				"properties": {
+					"handlers": {"type": "array", "items": {"type": "string"}},
+					"packages": {
+						"type": "object",
+						"additionalProperties": {"type": "array", "items": {"type": "string"}}
+					}
+				}
+			}
+		}
+	}
+}`
+
+// selectorSchema is the schema of the "when" key, see Selector
+const selectorSchema = `{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"os": {"type": "string"},
+		"arch": {"type": "string"},
+		"hostname": {"type": "string"},
+		"env": {"type": "string"}
+	}
+}`
+
+// hooksSchema is the schema of the "hooks" key, see Hooks
+const hooksSchema = `{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"preInstall": {"type": "string"},
+		"postInstall": {"type": "string"},
+		"preUpgrade": {"type": "string"},
+		"postUpgrade": {"type": "string"},
+		"preRemove": {"type": "string"},
+		"postRemove": {"type": "string"}
+	}
+}`
+
+// schema returns the schema of the configuration, including the schemas
+// of the registered handlers that implement Schemer
+func (ctl *Controller) schema() (*schema.Schema, error) {
+	root, err := schema.Parse([]byte(configSchema))
+	if err != nil {
+		return nil, err
+	}
+	settings := root.Properties["settings"].Properties["handler"]
+	packages := root.Properties["packages"]
+	settings.Properties = make(map[string]*schema.Schema)
+	packages.Properties = make(map[string]*schema.Schema)
+
+	for _, name := range ctl.registeredHandlers() {
+		s, ok := ctl.handlers[name].PackageHandler.(Schemer)
+		if !ok {
+			continue
+		}
+		hs := s.Schema()
+		if hs.Settings != nil {
+			if settings.Properties[name], err = handlerSchema(hs.Settings, "prune"); err != nil {
+				return nil, errors.Wrapf(err, "invalid settings schema of handler %v", name)
+			}
+			settings.Properties[name].Properties["dependsOn"] = &schema.Schema{
+				Type:  schema.Types{"array"},
+				Items: &schema.Schema{Type: schema.Types{"string"}},
+			}
+		}
+		if hs.Package != nil {
+			items, err := handlerSchema(hs.Package)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid package schema of handler %v", name)
+			}
+			packages.Properties[name] = &schema.Schema{Type: schema.Types{"array", "null"}, Items: items}
+		}
+	}
+	return root, nil
+}
+
+// handlerSchema parses the schema of a handler and adds the "when" and
+// "hooks" keys and the given boolean keys, which are evaluated by the
+// controller
+func handlerSchema(raw json.RawMessage, flags ...string) (*schema.Schema, error) {
+	s, err := schema.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	when, err := schema.Parse([]byte(selectorSchema))
+	if err != nil {
+		return nil, err
+	}
+	if s.Properties == nil {
+		s.Properties = make(map[string]*schema.Schema)
+	}
+	s.Properties["when"] = when
+	if s.Properties["hooks"], err = schema.Parse([]byte(hooksSchema)); err != nil {
+		return nil, err
+	}
+	for _, f := range flags {
+		s.Properties[f] = &schema.Schema{Type: schema.Types{"boolean"}}
+	}
+	return s, nil
+}
+
+// registeredHandlers returns the names of all registered handlers, sorted
+func (ctl *Controller) registeredHandlers() []string {
+	names := make([]string, 0, len(ctl.handlers))
+	for name := range ctl.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateConfig validates the config file and all files that it
+// includes against the schema of the configuration, without loading it.
+// Files of an older apiVersion that have to be migrated are not
+// validated, as they are migrated when they are loaded. Handlers have to be registered before.
+func (ctl *Controller) ValidateConfig(file string) error {
+	cfg, err := readConfig(file)
+	if err != nil {
+		return err
+	}
+	layers, err := includes(cfg, make(map[string]bool), readConfig)
+	if err != nil {
+		return err
+	}
+	for _, l := range append(layers, cfg) {
+		version := l.APIVersion
+		changed, err := ctl.migrate(l)
+		if err != nil {
+			return errors.Wrapf(err, "could not migrate %v", l.file)
+		}
+		if changed {
+			return errors.Errorf("%v has apiVersion %q, it is migrated to %v when it is loaded", l.file, version, currentAPIVersion)
+		}
+		if err := ctl.validate(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate the config file of cfg against the schema of the configuration,
+// reporting the positions of all violations in the file. A migrated
+// configuration is validated as it would be saved.
+func (ctl *Controller) validate(cfg *Configuration) error {
+	file := cfg.file
+	klog.V(3).Infof("Validating config file %v", file)
+	s, err := ctl.schema()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if cfg.migrated {
+		data, err = cfg.encode()
+		if err != nil {
+			return errors.Wrapf(err, "could not marshal config file")
+		}
+	} else {
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "could not read config file")
+		}
+	}
+	raw, err := FormatOf(file).toJSON(data)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse %v", file)
+	}
+	violations, err := s.Validate(raw)
+	if err != nil {
+		return errors.Wrapf(err, "could not validate %v", file)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(violations))
+	// positions are only known in YAML and JSON files
+	if FormatOf(file) == TOML {
+		for _, v := range violations {
+			msgs = append(msgs, fmt.Sprintf("%v: %v", file, v))
+		}
+		return errors.Errorf("invalid config:\n%v", strings.Join(msgs, "\n"))
+	}
+
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return errors.Wrapf(err, "could not parse %v", file)
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		li, _ := position(&root, violations[i].Path)
+		lj, _ := position(&root, violations[j].Path)
+		return li < lj
+	})
+	for _, v := range violations {
+		line, col := position(&root, v.Path)
+		msgs = append(msgs, fmt.Sprintf("%v:%v:%v: %v", file, line, col, v))
+	}
+	return errors.Errorf("invalid config:\n%v", strings.Join(msgs, "\n"))
+}
+
+// position returns the line and column of the value at path in the
+// YAML document. For properties, the position of the key is returned.
+// If the path cannot be found, the position of the closest parent is
+// returned.
+func position(node *yamlv3.Node, path schema.Path) (int, int) {
+	if node.Kind == yamlv3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line, col := node.Line, node.Column
+	for _, e := range path {
+		if node.Kind == yamlv3.AliasNode {
+			node = node.Alias
+		}
+		var next *yamlv3.Node
+		switch e := e.(type) {
+		case string:
+			if node.Kind != yamlv3.MappingNode {
+				return line, col
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == e {
+					line, col = node.Content[i].Line, node.Content[i].Column
+					next = node.Content[i+1]
+				}
+			}
+		case int:
+			if node.Kind != yamlv3.SequenceNode || e >= len(node.Content) {
+				return line, col
+			}
+			next = node.Content[e]
+			line, col = next.Line, next.Column
+		}
+		if next == nil {
+			return line, col
+		}
+		node = next
+	}
+	return line, col
+}
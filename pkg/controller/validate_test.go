@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+// schemaHandler is a fake handler with a schema
+type schemaHandler struct {
+	fake.Handler
+}
+
+func (h *schemaHandler) Schema() handlers.Schema {
+	return handlers.Schema{
+		Settings: json.RawMessage(`{"type":"object","additionalProperties":false,"properties":{"workingDir":{"type":"string"}}}`),
+		Package:  json.RawMessage(`{"type":"object","additionalProperties":false,"required":["url"],"properties":{"url":{"type":"string"}}}`),
+	}
+}
+
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "packa.yml")
+	included := filepath.Join(dir, "base.yml")
+	newController := func() (*Controller, error) {
+		return New(
+			PidFile(filepath.Join(dir, "packa.pid")),
+			BackupDir(dir),
+			RegisterHandlers(map[string]PackageHandler{"fake": &schemaHandler{}, "other": &fake.Handler{}}),
+			ConfigFile(cfgFile),
+		)
+	}
+
+	is.NoErr(ioutil.WriteFile(included, []byte("packages:\n  fake:\n  - url: one\n    when:\n      os: linux\n"), 0600))
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte(`include:
+- base.yml
+settings:
+  handler:
+    fake:
+      workingDir: /tmp
+      prune: true
+    other:
+      anything: true
+packages:
+  other:
+  - whatever: 1
+`), 0600))
+	ctl, err := newController()
+	is.NoErr(err)
+	is.NoErr(ctl.Close())
+
+	is.NoErr(ioutil.WriteFile(included, []byte(`packages:
+  fake:
+  - url: one
+  - name: two
+    when:
+      os: linux
+      hostnme: box
+`), 0600))
+	_, err = newController()
+	is.True(err != nil)
+	is.Equal(strings.Join([]string{
+		"could not add option: invalid config:",
+		included + ":4:5: packages.fake[1]: missing property url",
+		included + ":4:5: packages.fake[1].name: unknown property",
+		included + ":7:7: packages.fake[1].when.hostnme: unknown property",
+	}, "\n"), err.Error())
+
+	is.NoErr(ioutil.WriteFile(cfgFile, []byte("apiVersion: v2\nsettings:\n  paralelism: 2\n"), 0600))
+	ctl = &Controller{handlers: make(map[string]*handler)}
+	err = ctl.ValidateConfig(cfgFile)
+	is.True(err != nil)
+	is.Equal("invalid config:\n"+cfgFile+":3:3: settings.paralelism: unknown property", err.Error())
+}
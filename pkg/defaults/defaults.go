@@ -1,13 +1,18 @@
 package defaults
 
 import (
+	"os"
 	"os/user"
 	"path"
 )
 
 const (
 	packaHiddenDir = ".packa"
-	configFileName = "packa.yml"
+	configFileName = "packa"
+	lockFileName   = "packa.lock"
+	pidFileName    = "packa.pid"
+	handlersDir    = "handlers"
+	historyFile    = "history.jsonl"
 )
 
 // WorkingDir returns the default working directory
@@ -16,9 +21,44 @@ func WorkingDir() string {
 	return path.Join(usr.HomeDir, packaHiddenDir)
 }
 
+// configFileExtensions are the extensions of the supported
+// config formats, the first one is used if no file exists
+var configFileExtensions = []string{".yml", ".yaml", ".json", ".toml"}
+
 // ConfigFileFullPath returns the full path to the
-// configuration file
+// configuration file, in any of the supported formats
 func ConfigFileFullPath() string {
 	usr, _ := user.Current()
-	return path.Join(usr.HomeDir, packaHiddenDir, configFileName)
+	for _, ext := range configFileExtensions {
+		file := path.Join(usr.HomeDir, packaHiddenDir, configFileName+ext)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return path.Join(usr.HomeDir, packaHiddenDir, configFileName+configFileExtensions[0])
+}
+
+// LockFileFullPath returns the full path to the lockfile
+// that belongs to the given configuration file. It is
+// stored next to the configuration file.
+func LockFileFullPath(cfgFile string) string {
+	return path.Join(path.Dir(cfgFile), lockFileName)
+}
+
+// PidFileFullPath returns the full path to the file that
+// is locked while a packa process uses the configuration
+func PidFileFullPath() string {
+	return path.Join(WorkingDir(), pidFileName)
+}
+
+// HandlersDir returns the directory that plugins are
+// searched in, next to PATH
+func HandlersDir() string {
+	return path.Join(WorkingDir(), handlersDir)
+}
+
+// HistoryFileFullPath returns the full path to the log
+// of the operations that packa has executed
+func HistoryFileFullPath() string {
+	return path.Join(WorkingDir(), historyFile)
 }
@@ -2,11 +2,13 @@ package brew
 
 import (
 	"encoding/json"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/tommyknows/packa/pkg/cmd"
 	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
 	"github.com/tommyknows/packa/pkg/output"
 	"k8s.io/klog"
 )
@@ -27,9 +29,9 @@ type Handler struct {
 
 type configuration struct {
 	// Defines a list of additional taps to install
-	Taps               taps `json:"taps;omitempty"`
-	PrintCommandOutput bool `json:"printCommandOutput;omitempty"`
-	UpdateOnInit       bool `json:"updateOnInit;omitempty"`
+	Taps               taps `json:"taps,omitempty"`
+	PrintCommandOutput bool `json:"printCommandOutput,omitempty"`
+	UpdateOnInit       bool `json:"updateOnInit,omitempty"`
 }
 
 // Init initialises the handler.
@@ -56,8 +58,15 @@ func (b *Handler) Init(config *json.RawMessage, formulaeList *json.RawMessage) e
 		}
 	}
 
-	err := b.Config.Taps.sync()
-	return err
+	// taps are synced through Sync, so that
+	// planning does not modify the system
+	return nil
+}
+
+// Sync installs and removes taps as defined in the configuration.
+// Formulae are pinned and unpinned by Pin and Unpin.
+func (b *Handler) Sync() error {
+	return b.Config.Taps.sync()
 }
 
 func (b *Handler) Command() *cobra.Command {
@@ -102,6 +111,59 @@ func (b *Handler) Name() string {
 	return handlerName
 }
 
+// Schema of the brew settings and formulae
+func (b *Handler) Schema() handlers.Schema {
+	return handlers.Schema{
+		Settings: json.RawMessage(`{
+			"type": "object",
+			"additionalProperties": false,
+			"properties": {
+				"taps": {
+					"type": "array",
+					"items": {
+						"type": ["string", "object"],
+						"additionalProperties": false,
+						"required": ["name"],
+						"properties": {
+							"name": {"type": "string"},
+							"full": {"type": "boolean"}
+						}
+					}
+				},
+				"printCommandOutput": {"type": "boolean"},
+				"updateOnInit": {"type": "boolean"}
+			}
+		}`),
+		Package: json.RawMessage(`{
+			"type": "object",
+			"additionalProperties": false,
+			"required": ["name"],
+			"properties": {
+				"name": {"type": "string"},
+				"tap": {"type": "string"},
+				"version": {"type": "string"},
+				"cask": {"type": "boolean"}
+			}
+		}`),
+	}
+}
+
+// PackageID identifies a formula by its name, including its tap
+func (b *Handler) PackageID(pkg json.RawMessage) (string, error) {
+	var f formula
+	if err := json.Unmarshal(pkg, &f); err != nil {
+		return "", errors.Wrapf(err, "could not parse formula %s", pkg)
+	}
+	return f.fullname(), nil
+}
+
+// Pinned reports whether the formula is pinned to its version, see
+// controller.PinChecker
+func (b *Handler) Pinned(pkg json.RawMessage) bool {
+	var f formula
+	return json.Unmarshal(pkg, &f) == nil && f.Version != ""
+}
+
 // New returns a handler with the default settings. They will be overwritten
 // (if set) on Init()
 func New() *Handler {
@@ -112,52 +174,125 @@ func New() *Handler {
 }
 
 // Install the formulae and add them to the index. If an error occurs while installing
-// a formula, the other formulae will be handled / installed nonetheless
-func (b *Handler) Install(pkgs ...string) (formulaList *json.RawMessage, err error) {
-	return b.do(b.install, b.addToIndex, pkgs...)
+// a formula, the other formulae will be handled / installed nonetheless.
+// The formulae are installed one at a time, as concurrent brew runs fail
+// on brew's locks.
+func (b *Handler) Install(pkgs ...string) (*handlers.Result, error) {
+	// formulae that have been installed before are not
+	// uninstalled when rolling back
+	installed, err := b.installedFormulae()
+	if err != nil {
+		return nil, err
+	}
+	install := func(j *handlers.Journal, f formula) (handlers.Outcome, error) {
+		_, ok := installed[f.Name]
+		return b.install(j, f, ok)
+	}
+
+	res, done, err := b.do(install, b.addToIndex, pkgs...)
+	resolve(res, done)
+	return res, err
+}
+
+// InstallFrozen checks that the formulae are installed at the versions
+// that have been locked. brew cannot install a formula at an exact
+// version, as name@version installs a versioned formula (e.g. python@3.9)
+// instead. So formulae that are not installed at their locked version
+// fail, the others are left unchanged.
+func (b *Handler) InstallFrozen(locked map[string]string) (*handlers.Result, error) {
+	st, err := b.installedState()
+	if err != nil {
+		return nil, err
+	}
+
+	var cerr collection.Error
+	res := &handlers.Result{Resolved: make(map[string]string), Outcomes: make(map[string]handlers.Outcome)}
+	for name, version := range locked {
+		// installed formulae are listed without their tap
+		current, ok := st.versions[name[strings.LastIndex(name, "/")+1:]]
+		switch {
+		case !ok:
+			cerr.Add(name, errors.Errorf("brew cannot install formula %v at the locked version %v", name, version))
+		case current != version:
+			cerr.Add(name, errors.Errorf("formula %v is installed at version %v, brew cannot install the locked version %v", name, current, version))
+		default:
+			res.Resolved[name] = current
+			res.Outcomes[name] = handlers.OutcomeUnchanged
+		}
+	}
+	return res, cerr.IfNotEmpty()
 }
 
 // Remove formulae from the system. If an error occurs while installing
 // a formula, the other formulae will be handled / installed nonetheless
-func (b *Handler) Remove(pkgs ...string) (formulaList *json.RawMessage, err error) {
-	return b.do(b.remove, b.removeFromIndex, pkgs...)
+func (b *Handler) Remove(pkgs ...string) (*handlers.Result, error) {
+	res, done, err := b.do(b.remove, b.removeFromIndex, pkgs...)
+	if res != nil {
+		for _, f := range done {
+			res.Removed = append(res.Removed, f.fullname())
+		}
+	}
+	return res, err
 }
 
 // Upgrade a formula, if it is in the index. Returns an error if a formula
-// should not exist in the index, but still processes all other formulae
-func (b *Handler) Upgrade(pkgs ...string) (formulaList *json.RawMessage, err error) {
-	return b.do(b.upgrade, b.upgradeIndex, pkgs...)
+// should not exist in the index, but still processes all other formulae.
+// The formulae are upgraded one at a time, see Install.
+func (b *Handler) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	res, done, err := b.do(b.upgrade, b.upgradeIndex, pkgs...)
+	resolve(res, done)
+	return res, err
 }
 
 // do the formula action and indexAction for a list of formulae, handling
-// errors and marshaling the index in the end
+// errors and marshaling the index in the end. The formulae are handled
+// one at a time, as concurrent brew runs fail on brew's locks. Returns
+// the formulae whose formula action succeeded, their outcomes are
+// reported in the result. The steps of a formula action that fails
+// are rolled back, the steps of all others are returned in the result's
+// journal.
 // NOTE: this code is more or less exactly the same to the method in the goget-package...
-func (b *Handler) do(formulaAction func(formula) error, indexAction func(formula), pkgs ...string) (*json.RawMessage, error) {
+func (b *Handler) do(formulaAction func(*handlers.Journal, formula) (handlers.Outcome, error), indexAction func(formula), pkgs ...string) (*handlers.Result, formulae, error) {
 	var pError collection.Error
 	forms, err := b.getFormulae(pkgs...)
 	if err != nil {
 		pe, ok := err.(*collection.Error)
 		if !ok {
 			// we always expect a collection.Error from getFormulae
-			return nil, errors.Wrapf(err, "unexpected error occured when getting formulae list")
+			return nil, nil, errors.Wrapf(err, "unexpected error occured when getting formulae list")
 		}
 		pError.Merge(*pe)
 	}
 
 	// should never occur, but as a safety check
 	if formulaAction == nil {
-		return nil, errors.New("no formula action defined")
+		return nil, nil, errors.New("no formula action defined")
 	}
 
+	var done formulae
+	journal := &handlers.Journal{}
+	res := &handlers.Result{Journal: journal, Outcomes: make(map[string]handlers.Outcome)}
 	for _, p := range forms {
-		// execute the formulaAction and then the index action, if applicable
-		switch err := formulaAction(p); {
-		case indexAction == nil:
-			klog.V(5).Infof("Brew: Not executing index action because none is defined")
+		var j handlers.Journal
+		outcome, err := formulaAction(&j, p)
+		if err != nil {
+			if rerr := j.Rollback(); rerr != nil {
+				err = errors.Wrapf(rerr, "%v, rollback failed", err)
+			}
+		} else {
+			done = append(done, p)
+			journal.Append(&j)
+			res.Outcomes[p.fullname()] = outcome
+		}
+
+		// execute the index action, if applicable
+		switch {
 		case err != nil:
 			klog.V(4).Infof("Brew: Error while executing formula action for %v, adding error to collection", p.String())
 			pError.Add(p.String(), err)
 			klog.V(5).Infof("Brew: Not executing index action because of error on formula action")
+		case indexAction == nil:
+			klog.V(5).Infof("Brew: Not executing index action because none is defined")
 		default:
 			indexAction(p)
 		}
@@ -166,77 +301,125 @@ func (b *Handler) do(formulaAction func(formula) error, indexAction func(formula
 	klog.V(6).Infof("Brew: Marshaling formulae")
 	raw, err := json.Marshal(b.Formulae)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	msg := json.RawMessage(raw)
-	return &msg, pError.IfNotEmpty()
+	res.Packages = &msg
+	return res, done, pError.IfNotEmpty()
 }
 
-func (b *Handler) install(f formula) error {
-	output.Info("📦 Brew\t\tInstalling formula %s", f)
-	err := f.install(b.Config.PrintCommandOutput)
+func (b *Handler) install(j *handlers.Journal, f formula, installed bool) (handlers.Outcome, error) {
+	op := output.NewOperation(handlerName, "install", f.fullname(), f.Version)
+	op.Start("📦 Brew\t\tInstalling formula %s", f)
+	err := f.install(op, b.Config.PrintCommandOutput)
 	if err != nil {
-		return err
+		return handlers.OutcomeFailed, op.Fail(err)
+	}
+	op.Succeed("📦 Brew\t\tInstalled formula %s", f)
+	if !installed {
+		j.Record("install "+f.String(), func() error {
+			return f.uninstall(nil, b.Config.PrintCommandOutput)
+		})
 	}
-	output.Success("📦 Brew\t\tInstalled formula %s", f)
 
 	if f.Version == "" {
-		return err
+		return handlers.OutcomeInstalled, nil
 	}
 
 	// pin package if version is defined
-	err = f.pin()
-	if err == nil {
-		output.Success("📦 Brew\t\tPinned formula %s", f)
-	}
-	return err
+	return handlers.OutcomeInstalled, b.pin(j, f)
 }
 
-func (b *Handler) remove(f formula) error {
-	output.Info("📦 Brew\t\tRemoving formula %s", f)
-	err := f.uninstall(b.Config.PrintCommandOutput)
-	if err == nil {
-		output.Success("📦 Brew\t\tRemoved formula %s", f)
+func (b *Handler) remove(j *handlers.Journal, f formula) (handlers.Outcome, error) {
+	op := output.NewOperation(handlerName, "remove", f.fullname(), f.Version)
+	op.Start("📦 Brew\t\tRemoving formula %s", f)
+	err := f.uninstall(op, b.Config.PrintCommandOutput)
+	if err != nil {
+		return handlers.OutcomeFailed, op.Fail(err)
 	}
-	return err
+	op.Succeed("📦 Brew\t\tRemoved formula %s", f)
+	j.Record("remove "+f.String(), func() error {
+		return f.install(nil, b.Config.PrintCommandOutput)
+	})
+	return handlers.OutcomeRemoved, nil
 }
 
-func (b *Handler) upgrade(f formula) error {
+// upgrade the formula. As brew cannot downgrade formulae, the upgrade
+// itself cannot be rolled back, only the pinning and unpinning. Formulae
+// that brew did not need to upgrade are reported as unchanged.
+func (b *Handler) upgrade(j *handlers.Journal, f formula) (handlers.Outcome, error) {
+	op := output.NewOperation(handlerName, "upgrade", f.fullname(), f.Version)
 	if definedVersion := b.indexVersion(f); definedVersion != "" {
 		if f.Version == definedVersion {
-			output.Warn("📦 Brew\t\tNot upgrading package because it is pinned: %s", f)
-			return nil
+			op.Skip("📦 Brew\t\tNot upgrading package because it is pinned: %s", f)
+			return handlers.OutcomePinned, nil
 		}
 
 		output.Warn("📦 Brew\t\tUnpinning pinned package %s for upgrade", f)
 		err := f.unpin()
 		if err != nil {
-			return errors.Wrapf(err, "could not unpin package %v", f.Name)
+			return handlers.OutcomeFailed, op.Fail(errors.Wrapf(err, "could not unpin package %v", f.Name))
 		}
+		j.Record("unpin "+f.fullname(), f.pin)
 	}
 
-	output.Info("📦 Brew\t\tUpgrading package %s", f)
-	err := f.upgrade(b.Config.PrintCommandOutput)
+	op.Start("📦 Brew\t\tUpgrading package %s", f)
+	outcome := handlers.OutcomeUpgraded
+	err := f.upgrade(op, b.Config.PrintCommandOutput)
 	if err != nil && err != ErrNoUpgradeNeeded {
-		return err
+		return handlers.OutcomeFailed, op.Fail(err)
 	}
 	if err == ErrNoUpgradeNeeded {
-		output.Success("📦 Brew\t\tNo upgrade was needed for formula %s", f)
-		err = nil
+		op.Succeed("📦 Brew\t\tNo upgrade was needed for formula %s", f)
+		outcome = handlers.OutcomeUnchanged
 	} else {
-		output.Success("📦 Brew\t\tUpgraded Package %s", f)
+		op.Succeed("📦 Brew\t\tUpgraded Package %s", f)
 	}
 
 	if f.Version == "" {
-		return err
+		return outcome, nil
 	}
 
 	// pin package if version is defined
-	err = f.pin()
-	if err == nil {
-		output.Success("📦 Brew\t\tPinned Package %s", f)
+	return outcome, b.pin(j, f)
+}
+
+// pin the formula and record unpinning it
+func (b *Handler) pin(j *handlers.Journal, f formula) error {
+	op := output.NewOperation(handlerName, "pin", f.fullname(), f.Version)
+	if err := f.pin(); err != nil {
+		return op.Fail(err)
 	}
-	return err
+	op.Succeed("📦 Brew\t\tPinned formula %s", f)
+	j.Record("pin "+f.fullname(), f.unpin)
+	return nil
+}
+
+// Pin the installed formulae, so that they are not upgraded. Used to
+// apply the pin changes of a plan, the index is not modified.
+func (b *Handler) Pin(pkgs ...string) (*handlers.Result, error) {
+	res, _, err := b.do(func(j *handlers.Journal, f formula) (handlers.Outcome, error) {
+		return handlers.OutcomePinned, b.pin(j, f)
+	}, nil, pkgs...)
+	return res, err
+}
+
+// Unpin the installed formulae, so that they are upgraded again. Used
+// to apply the unpin changes of a plan, the index is not modified.
+func (b *Handler) Unpin(pkgs ...string) (*handlers.Result, error) {
+	res, _, err := b.do(b.unpin, nil, pkgs...)
+	return res, err
+}
+
+// unpin the formula and record pinning it again
+func (b *Handler) unpin(j *handlers.Journal, f formula) (handlers.Outcome, error) {
+	op := output.NewOperation(handlerName, "unpin", f.fullname(), f.Version)
+	if err := f.unpin(); err != nil {
+		return handlers.OutcomeFailed, op.Fail(err)
+	}
+	op.Succeed("📦 Brew\t\tUnpinned formula %s", f)
+	j.Record("unpin "+f.fullname(), f.pin)
+	return handlers.OutcomeUnchanged, nil
 }
 
 // returns the version of the package as defined in the index
@@ -250,6 +433,17 @@ func (b *Handler) indexVersion(f formula) string {
 	return ""
 }
 
+// returns true if the formula is defined as cask in the index
+func (b *Handler) indexCask(f formula) bool {
+	for _, form := range b.Formulae {
+		if form.Name == f.Name &&
+			form.Tap == f.Tap {
+			return form.Cask
+		}
+	}
+	return false
+}
+
 func (b *Handler) upgradeIndex(f formula) {
 	for _, formula := range b.Formulae {
 		if formula.Name == f.Name &&
@@ -308,6 +502,12 @@ func (b *Handler) getFormulae(forms ...string) (formulae, error) {
 			e.Add(pkg, err)
 			continue
 		}
+		// formulae that are passed without the cask flag,
+		// e.g. from an applied plan, are casks if they have
+		// been defined as such in the index
+		if !p.Cask {
+			p.Cask = b.indexCask(p)
+		}
 		klog.V(6).Infof("Brew: Successfully parsed package %v (%s)", pkg, p)
 		f = append(f, p)
 	}
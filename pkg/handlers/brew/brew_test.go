@@ -3,10 +3,13 @@ package brew
 import (
 	"bytes"
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/matryer/is"
 	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
 	"github.com/tommyknows/packa/pkg/output"
 	"github.com/tommyknows/packa/test/fake"
 )
@@ -111,7 +114,7 @@ func TestInstall(t *testing.T) {
 	defer cmd.ResetGlobalOptions()
 	list, err := b.Install("thispackage", "pkg@version", "from/tap/betterpkg", "this/tap/another@0.0.1", "somepackage@newer")
 	is.NoErr(err)
-	is.Equal(afterInstJSON, []byte(*list))
+	is.Equal(afterInstJSON, []byte(*list.Packages))
 
 	close(c)
 	var executedCommands [][]string
@@ -120,6 +123,7 @@ func TestInstall(t *testing.T) {
 	}
 
 	is.Equal(executedCommands, [][]string{
+		{"brew", "list", "--versions"},
 		{"brew", "install", "thispackage"},
 		{"brew", "install", "pkg@version"},
 		{"brew", "pin", "pkg"},
@@ -128,9 +132,46 @@ func TestInstall(t *testing.T) {
 		{"brew", "pin", "this/tap/another"},
 		{"brew", "install", "somepackage@newer"},
 		{"brew", "pin", "somepackage"},
+		{"brew", "list", "--versions", "thispackage", "pkg", "from/tap/betterpkg", "this/tap/another", "somepackage"},
 	})
 }
 
+func TestInstallFrozen(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	defer buf.Reset()
+
+	b := Handler{cask: &isNotCask}
+	c := make(chan []string, 20)
+	cmd.AddGlobalOptions(fake.Respond(c, map[string]string{
+		"brew list --versions": "vim 8.2 9.0.2150\ngit 2.30.0",
+	}))
+	defer cmd.ResetGlobalOptions()
+
+	// formulae are never installed, only checked against the locked versions
+	res, err := b.InstallFrozen(map[string]string{
+		"vim":          "9.0.2150",
+		"from/tap/git": "2.29.0",
+		"fzf":          "0.24.0",
+	})
+	is.True(err != nil)
+	ce, ok := err.(*collection.Error)
+	is.True(ok)
+	is.Equal(2, len(*ce))
+	is.Equal("formula from/tap/git is installed at version 2.30.0, brew cannot install the locked version 2.29.0", (*ce)["from/tap/git"].Error())
+	is.Equal("brew cannot install formula fzf at the locked version 0.24.0", (*ce)["fzf"].Error())
+	is.Equal(map[string]string{"vim": "9.0.2150"}, res.Resolved)
+	is.Equal(map[string]handlers.Outcome{"vim": handlers.OutcomeUnchanged}, res.Outcomes)
+	is.True(res.Packages == nil)
+
+	close(c)
+	for execedCmd := range c {
+		is.True(execedCmd[1] != "install")
+	}
+}
+
 func TestUninstall(t *testing.T) {
 	is := is.New(t)
 
@@ -172,7 +213,7 @@ func TestUninstall(t *testing.T) {
 	defer cmd.ResetGlobalOptions()
 	list, err := b.Remove("somepackage@newer", "from/tap/betterpkg")
 	is.NoErr(err)
-	is.Equal(afterRmJSON, []byte(*list))
+	is.Equal(afterRmJSON, []byte(*list.Packages))
 
 	close(c)
 	var executedCommands [][]string
@@ -235,7 +276,11 @@ func TestUpgrade(t *testing.T) {
 	defer cmd.ResetGlobalOptions()
 	list, err := b.Upgrade("somepackage@evennewer", "from/tap/betterpkg")
 	is.NoErr(err)
-	is.Equal(afterUpJSON, []byte(*list))
+	is.Equal(afterUpJSON, []byte(*list.Packages))
+	is.Equal(map[string]handlers.Outcome{
+		"somepackage":        handlers.OutcomeUpgraded,
+		"from/tap/betterpkg": handlers.OutcomeUpgraded,
+	}, list.Outcomes)
 
 	close(c)
 	var executedCommands [][]string
@@ -248,6 +293,7 @@ func TestUpgrade(t *testing.T) {
 		{"brew", "upgrade", "somepackage@evennewer"},
 		{"brew", "pin", "somepackage"},
 		{"brew", "upgrade", "from/tap/betterpkg"},
+		{"brew", "list", "--versions", "somepackage", "from/tap/betterpkg"},
 	})
 
 	b = Handler{
@@ -270,13 +316,18 @@ func TestUpgrade(t *testing.T) {
 	afterUpJSON, err = json.Marshal(afterUpgrade)
 	is.NoErr(err)
 
+	// brew fails if no upgrade is needed
 	c = make(chan []string, 20)
 	cmd.ResetGlobalOptions()
-	cmd.AddGlobalOptions(fake.NoOp(c, "someoutput"))
+	cmd.AddGlobalOptions(fake.NoOpError(c, "Error: thispackage 1.0 already installed"))
 	defer cmd.ResetGlobalOptions()
 	list, err = b.Upgrade()
 	is.NoErr(err)
-	is.Equal(afterUpJSON, []byte(*list))
+	is.Equal(afterUpJSON, []byte(*list.Packages))
+	is.Equal(map[string]handlers.Outcome{
+		"somepackage": handlers.OutcomePinned,
+		"thispackage": handlers.OutcomeUnchanged,
+	}, list.Outcomes)
 
 	close(c)
 	executedCommands = nil
@@ -284,7 +335,10 @@ func TestUpgrade(t *testing.T) {
 		executedCommands = append(executedCommands, execedCmd)
 	}
 
-	is.Equal(executedCommands, [][]string{{"brew", "upgrade", "thispackage"}})
+	is.Equal(executedCommands, [][]string{
+		{"brew", "upgrade", "thispackage"},
+		{"brew", "list", "--versions", "somepackage", "thispackage"},
+	})
 }
 
 func TestCaskInstall(t *testing.T) {
@@ -337,7 +391,7 @@ func TestCaskInstall(t *testing.T) {
 	defer cmd.ResetGlobalOptions()
 	list, err := b.Install("thispackage", "pkg@version", "from/tap/betterpkg", "this/tap/another@0.0.1", "somepackage@newer")
 	is.NoErr(err)
-	is.Equal(afterInstJSON, []byte(*list))
+	is.Equal(afterInstJSON, []byte(*list.Packages))
 
 	close(c)
 	var executedCommands [][]string
@@ -346,6 +400,8 @@ func TestCaskInstall(t *testing.T) {
 	}
 
 	is.Equal(executedCommands, [][]string{
+		{"brew", "list", "--versions"},
+		{"brew", "cask", "list", "--versions"},
 		{"brew", "cask", "install", "thispackage"},
 		{"brew", "cask", "install", "pkg@version"},
 		{"brew", "pin", "pkg"},
@@ -354,5 +410,102 @@ func TestCaskInstall(t *testing.T) {
 		{"brew", "pin", "this/tap/another"},
 		{"brew", "cask", "install", "somepackage@newer"},
 		{"brew", "pin", "somepackage"},
+		{"brew", "cask", "list", "--versions", "thispackage", "pkg", "from/tap/betterpkg", "this/tap/another", "somepackage"},
 	})
 }
+
+func TestInstallSequential(t *testing.T) {
+	is := is.New(t)
+
+	// redirect the output logs
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	defer buf.Reset()
+	b := Handler{
+		cask: &isNotCask,
+	}
+	pkgs := []string{"one", "two@2.0", "three", "four", "five@5.0"}
+	var afterInstall formulae
+	for _, pkg := range pkgs {
+		f, err := parse(pkg, false)
+		is.NoErr(err)
+		afterInstall = append(afterInstall, f)
+	}
+	afterInstJSON, err := json.Marshal(afterInstall)
+	is.NoErr(err)
+
+	c := make(chan []string, 20)
+	cmd.AddGlobalOptions(fake.NoOp(c, "someoutput"))
+	defer cmd.ResetGlobalOptions()
+	list, err := b.Install(pkgs...)
+	is.NoErr(err)
+	// the index should be in the order of the given formulae
+	is.Equal(string(afterInstJSON), string(*list.Packages))
+
+	// the formulae are installed one at a time
+	close(c)
+	var installs []string
+	for execedCmd := range c {
+		if execedCmd[1] == "install" || execedCmd[1] == "pin" {
+			installs = append(installs, strings.Join(execedCmd, " "))
+		}
+	}
+	is.Equal([]string{
+		"brew install one",
+		"brew install two@2.0",
+		"brew pin two",
+		"brew install three",
+		"brew install four",
+		"brew install five@5.0",
+		"brew pin five",
+	}, installs)
+}
+
+func TestUpgradeRollback(t *testing.T) {
+	is := is.New(t)
+
+	// redirect the output logs
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	defer buf.Reset()
+
+	b := Handler{
+		Formulae: []formula{
+			{
+				Name:    "somepackage",
+				Version: "newer",
+			},
+			{Name: "thispackage"},
+		},
+		cask: &isNotCask,
+	}
+
+	c := make(chan []string, 20)
+	cmd.AddGlobalOptions(fake.Fail(c, "brew upgrade somepackage@evennewer"))
+	defer cmd.ResetGlobalOptions()
+	res, err := b.Upgrade("somepackage@evennewer", "thispackage")
+	is.True(err != nil)
+
+	close(c)
+	var executedCommands [][]string
+	for execedCmd := range c {
+		executedCommands = append(executedCommands, execedCmd)
+	}
+
+	// the formula that failed to upgrade is pinned again
+	is.Equal(executedCommands, [][]string{
+		{"brew", "unpin", "somepackage"},
+		{"brew", "upgrade", "somepackage@evennewer"},
+		{"brew", "pin", "somepackage"},
+		{"brew", "upgrade", "thispackage"},
+		{"brew", "list", "--versions", "thispackage"},
+	})
+
+	// nothing has to be undone for the successful upgrade
+	c = make(chan []string, 20)
+	cmd.ResetGlobalOptions()
+	cmd.AddGlobalOptions(fake.NoOp(c, "someoutput"))
+	is.NoErr(res.Journal.Rollback())
+	close(c)
+	is.Equal(0, len(c))
+}
@@ -21,6 +21,17 @@ type formula struct {
 
 type formulae []formula
 
+// has returns true if the formula with the given name is in the
+// list. The name may be prefixed with the formula's tap.
+func (fs formulae) has(name string) bool {
+	for _, f := range fs {
+		if f.Name == name || f.fullname() == name {
+			return true
+		}
+	}
+	return false
+}
+
 // format for printing packages is
 // [tap]/<name>@[version]
 func (f formula) String() string {
@@ -52,27 +63,29 @@ func (f formula) pin() error {
 	return errors.Wrapf(err, "could not pin formula %s", f)
 }
 
-func (f formula) install(printOutput bool) error {
+// install the formula, printing the output of brew as output of the
+// operation, which may be nil
+func (f formula) install(op *output.Operation, printOutput bool) error {
 	e := brewExec
 	if f.Cask {
 		e = brewCaskExec
 	}
 
-	_, err := e("install", f.String(), printOutput)
+	_, err := e(op, "install", f.String(), printOutput)
 	return errors.Wrapf(err, "could not install formula %s", f)
 }
 
-func (f formula) uninstall(printOutput bool) error {
+func (f formula) uninstall(op *output.Operation, printOutput bool) error {
 	e := brewExec
 	if f.Cask {
 		e = brewCaskExec
 	}
 
-	_, err := e("uninstall", f.fullname(), printOutput)
+	_, err := e(op, "uninstall", f.fullname(), printOutput)
 	return errors.Wrapf(err, "could not remove formula %s", f)
 }
 
-func (f formula) upgrade(printOutput bool) error {
+func (f formula) upgrade(op *output.Operation, printOutput bool) error {
 	args := []string{"brew"}
 	if f.Cask {
 		args = append(args, "cask")
@@ -80,7 +93,7 @@ func (f formula) upgrade(printOutput bool) error {
 	// code from brewExec, but with additional error handling
 	out, err := cmd.Execute(
 		append(args, "upgrade", f.String()),
-		cmd.DirectPrint(bool(klog.V(5)) || printOutput),
+		cmd.DirectPrintOperation(bool(klog.V(5)) || printOutput, op, "📦 Brew\t\t"),
 	)
 	// only print output if error occured and we have
 	// not printed the output already
@@ -95,20 +108,20 @@ func (f formula) upgrade(printOutput bool) error {
 	return errors.Wrapf(err, "could not upgrade formula %s", f)
 }
 
-func brewExec(action, form string, printOutput bool) (out string, err error) {
-	out, err = exec(printOutput, action, form)
+func brewExec(op *output.Operation, action, form string, printOutput bool) (out string, err error) {
+	out, err = exec(op, printOutput, action, form)
 	return out, errors.Wrapf(err, "could not %s %s", action, form)
 }
 
-func brewCaskExec(action, form string, printOutput bool) (out string, err error) {
-	out, err = exec(printOutput, "cask", action, form)
+func brewCaskExec(op *output.Operation, action, form string, printOutput bool) (out string, err error) {
+	out, err = exec(op, printOutput, "cask", action, form)
 	return out, errors.Wrapf(err, "could not %s cask %s", action, form)
 }
 
-func exec(printOutput bool, args ...string) (out string, err error) {
+func exec(op *output.Operation, printOutput bool, args ...string) (out string, err error) {
 	out, err = cmd.Execute(
 		append([]string{"brew"}, args...),
-		cmd.DirectPrint(bool(klog.V(5)) || printOutput),
+		cmd.DirectPrintOperation(bool(klog.V(5)) || printOutput, op, "📦 Brew\t\t"),
 	)
 	// only print output if error occured and we have
 	// not printed the output already
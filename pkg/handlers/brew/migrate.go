@@ -0,0 +1,64 @@
+package brew
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+)
+
+// Migrations of the brew settings and formulae
+func (b *Handler) Migrations() []handlers.Migration {
+	return []handlers.Migration{
+		{
+			From:        "v1",
+			Description: "move the cask setting into the formulae",
+			Migrate:     moveCask,
+		},
+	}
+}
+
+// moveCask removes the cask flag from the settings and sets it on
+// all formulae instead, as it applied to all of them
+func moveCask(settings, formulae *json.RawMessage) (*json.RawMessage, *json.RawMessage, error) {
+	if settings == nil {
+		return nil, formulae, nil
+	}
+	var s map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*settings), &s); err != nil {
+		return nil, nil, errors.Wrapf(err, "could not parse settings %s", settings)
+	}
+	cask, ok := s["cask"]
+	if !ok {
+		return settings, formulae, nil
+	}
+	delete(s, "cask")
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := json.RawMessage(raw)
+	settings = &msg
+
+	var isCask bool
+	if err := json.Unmarshal(cask, &isCask); err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid cask setting %s", cask)
+	}
+	if !isCask || formulae == nil {
+		return settings, formulae, nil
+	}
+
+	var fs []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*formulae), &fs); err != nil {
+		return nil, nil, errors.Wrapf(err, "could not parse formulae %s", formulae)
+	}
+	for _, f := range fs {
+		f["cask"] = json.RawMessage("true")
+	}
+	raw, err = json.Marshal(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmsg := json.RawMessage(raw)
+	return settings, &fmsg, nil
+}
@@ -0,0 +1,25 @@
+package brew
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestMoveCask(t *testing.T) {
+	is := is.New(t)
+
+	settings := json.RawMessage(`{"cask":true,"updateOnInit":true}`)
+	formulae := json.RawMessage(`[{"name":"firefox"}]`)
+	s, f, err := moveCask(&settings, &formulae)
+	is.NoErr(err)
+	is.Equal(`{"updateOnInit":true}`, string(*s))
+	is.Equal(`[{"cask":true,"name":"firefox"}]`, string(*f))
+
+	settings = json.RawMessage(`{"updateOnInit":true}`)
+	s, f, err = moveCask(&settings, &formulae)
+	is.NoErr(err)
+	is.Equal(&settings, s)
+	is.Equal(&formulae, f)
+}
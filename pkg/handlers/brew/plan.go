@@ -0,0 +1,223 @@
+package brew
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+)
+
+// state of the formulae that are installed on the system
+type state struct {
+	// installed formulae and their versions
+	versions map[string]string
+	pinned   map[string]bool
+	outdated map[string]bool
+}
+
+// Plan compares the formulae and taps in the index with the ones
+// installed on the system and returns the changes that an install
+// or upgrade would make.
+func (b *Handler) Plan() ([]handlers.Change, error) {
+	var changes []handlers.Change
+
+	installedTaps, err := getInstalledTaps()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get list of installed taps")
+	}
+	missing, spare := filterTaps(installedTaps, b.Config.Taps.names())
+	for _, m := range missing {
+		changes = append(changes, handlers.Change{Action: handlers.ActionTap, Package: m})
+	}
+	for _, s := range spare {
+		changes = append(changes, handlers.Change{Action: handlers.ActionUntap, Package: s})
+	}
+
+	st, err := b.installedState()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range b.Formulae {
+		changes = append(changes, st.plan(f)...)
+	}
+
+	// leaves are installed formulae that are not a
+	// dependency of another installed formula
+	leaves, err := query("leaves")
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range leaves {
+		if !b.Formulae.has(fields[0]) {
+			name := fields[0][strings.LastIndex(fields[0], "/")+1:]
+			changes = append(changes, handlers.Change{Action: handlers.ActionRemove, Package: fields[0], From: st.versions[name]})
+		}
+	}
+	return changes, nil
+}
+
+// plan returns the changes needed to bring the formula into the
+// state defined in the index
+func (st state) plan(f formula) []handlers.Change {
+	installed, ok := st.versions[f.Name]
+	if !ok {
+		changes := []handlers.Change{{Action: handlers.ActionInstall, Package: f.String(), To: f.Version}}
+		if f.Version != "" {
+			changes = append(changes, handlers.Change{Action: handlers.ActionPin, Package: f.String()})
+		}
+		return changes
+	}
+
+	var changes []handlers.Change
+	if f.Version != "" && installed != f.Version {
+		// installed at another version than declared
+		changes = append(changes, handlers.Change{Action: handlers.ActionInstall, Package: f.String(), From: installed, To: f.Version})
+	}
+	switch {
+	case f.Version != "" && !st.pinned[f.Name]:
+		changes = append(changes, handlers.Change{Action: handlers.ActionPin, Package: f.String(), From: installed})
+	case f.Version == "" && st.pinned[f.Name]:
+		changes = append(changes, handlers.Change{Action: handlers.ActionUnpin, Package: f.String(), From: installed})
+		if st.outdated[f.Name] {
+			changes = append(changes, handlers.Change{Action: handlers.ActionUpgrade, Package: f.String(), From: installed})
+		}
+	case f.Version == "" && st.outdated[f.Name]:
+		changes = append(changes, handlers.Change{Action: handlers.ActionUpgrade, Package: f.String(), From: installed})
+	}
+	return changes
+}
+
+// installedState queries brew for the installed, pinned and outdated
+// formulae. Casks are only queried if the index contains a cask.
+func (b *Handler) installedState() (state, error) {
+	st := state{
+		versions: make(map[string]string),
+		pinned:   make(map[string]bool),
+		outdated: make(map[string]bool),
+	}
+
+	queries := [][]string{{}}
+	for _, f := range b.Formulae {
+		if f.Cask {
+			queries = append(queries, []string{"cask"})
+			break
+		}
+	}
+
+	for _, q := range queries {
+		out, err := query(append(q, "list", "--versions")...)
+		if err != nil {
+			return st, err
+		}
+		for _, fields := range out {
+			// if multiple versions are installed, the last one
+			// is the most recent one
+			st.versions[fields[0]] = fields[len(fields)-1]
+		}
+
+		out, err = query(append(q, "outdated", "--quiet")...)
+		if err != nil {
+			return st, err
+		}
+		for _, fields := range out {
+			st.outdated[fields[0]] = true
+		}
+	}
+
+	out, err := query("list", "--pinned")
+	if err != nil {
+		return st, err
+	}
+	for _, fields := range out {
+		st.pinned[fields[0]] = true
+	}
+	return st, nil
+}
+
+// installedFormulae returns the names of the installed formulae. Casks
+// are only queried if the cask flag is set or the index contains a cask.
+func (b *Handler) installedFormulae() (map[string]bool, error) {
+	queries := [][]string{{"list", "--versions"}}
+	cask := b.cask != nil && *b.cask
+	for _, f := range b.Formulae {
+		cask = cask || f.Cask
+	}
+	if cask {
+		queries = append(queries, []string{"cask", "list", "--versions"})
+	}
+
+	installed := make(map[string]bool)
+	for _, q := range queries {
+		out, err := query(q...)
+		if err != nil {
+			return nil, err
+		}
+		for _, fields := range out {
+			installed[fields[0]] = true
+		}
+	}
+	return installed, nil
+}
+
+// resolve adds the versions that the given formulae are installed
+// at to the result, as reported by brew
+func resolve(res *handlers.Result, fs formulae) {
+	if res == nil || len(fs) == 0 {
+		return
+	}
+
+	forms := []string{"list", "--versions"}
+	casks := []string{"cask", "list", "--versions"}
+	for _, f := range fs {
+		if f.Cask {
+			casks = append(casks, f.fullname())
+		} else {
+			forms = append(forms, f.fullname())
+		}
+	}
+
+	versions := make(map[string]string)
+	for _, q := range [][]string{forms, casks} {
+		if q[len(q)-1] == "--versions" {
+			// no formulae of this kind
+			continue
+		}
+		out, err := query(q...)
+		if err != nil {
+			output.Warn("📦 Brew\t\tCould not resolve installed versions: %v", err)
+			return
+		}
+		for _, fields := range out {
+			if len(fields) > 1 {
+				versions[fields[0]] = fields[len(fields)-1]
+			}
+		}
+	}
+
+	res.Resolved = make(map[string]string)
+	for _, f := range fs {
+		if v, ok := versions[f.Name]; ok {
+			res.Resolved[f.fullname()] = v
+		}
+	}
+}
+
+// query executes a read-only brew command and returns the
+// whitespace-separated fields of each non-empty output line
+func query(args ...string) ([][]string, error) {
+	out, err := cmd.Execute(append([]string{"brew"}, args...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not execute brew %v: %v", strings.Join(args, " "), out)
+	}
+
+	var lines [][]string
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, fields)
+		}
+	}
+	return lines, nil
+}
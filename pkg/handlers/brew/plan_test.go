@@ -0,0 +1,164 @@
+package brew
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestPlan(t *testing.T) {
+	is := is.New(t)
+
+	b := Handler{
+		Config: configuration{
+			Taps: taps{{Name: "my/tap"}},
+		},
+		Formulae: []formula{
+			{Name: "missing"},
+			{Name: "pinnedmissing", Version: "1.0"},
+			{Name: "uptodate"},
+			{Name: "outdated"},
+			{Name: "topin", Version: "2.0"},
+			{Name: "tounpin"},
+			{Name: "pinned", Version: "3.0"},
+			{Name: "otherversion", Version: "4.0"},
+		},
+	}
+
+	cmds := make(chan []string, 10)
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{
+		"brew tap":              "homebrew/core\nold/tap",
+		"brew list --versions":  "uptodate 1.0\noutdated 1.0\ntopin 2.0\ntounpin 0.9 1.0\npinned 3.0\notherversion 3.9",
+		"brew outdated --quiet": "outdated\ntounpin",
+		"brew list --pinned":    "tounpin\npinned\notherversion",
+		"brew leaves":           "uptodate\nother/tap/unlisted",
+	}))
+	defer cmd.ResetGlobalOptions()
+
+	changes, err := b.Plan()
+	is.NoErr(err)
+	is.Equal(changes, []handlers.Change{
+		{Action: handlers.ActionTap, Package: "my/tap"},
+		{Action: handlers.ActionUntap, Package: "old/tap"},
+		{Action: handlers.ActionInstall, Package: "missing"},
+		{Action: handlers.ActionInstall, Package: "pinnedmissing@1.0", To: "1.0"},
+		{Action: handlers.ActionPin, Package: "pinnedmissing@1.0"},
+		{Action: handlers.ActionUpgrade, Package: "outdated", From: "1.0"},
+		{Action: handlers.ActionPin, Package: "topin@2.0", From: "2.0"},
+		{Action: handlers.ActionUnpin, Package: "tounpin", From: "1.0"},
+		{Action: handlers.ActionUpgrade, Package: "tounpin", From: "1.0"},
+		{Action: handlers.ActionInstall, Package: "otherversion@4.0", From: "3.9", To: "4.0"},
+		{Action: handlers.ActionRemove, Package: "other/tap/unlisted"},
+	})
+
+	close(cmds)
+	var executedCommands [][]string
+	for execedCmd := range cmds {
+		executedCommands = append(executedCommands, execedCmd)
+	}
+	// casks should not be queried as there are none in the index
+	is.Equal(executedCommands, [][]string{
+		{"brew", "tap"},
+		{"brew", "list", "--versions"},
+		{"brew", "outdated", "--quiet"},
+		{"brew", "list", "--pinned"},
+		{"brew", "leaves"},
+	})
+}
+
+func TestSync(t *testing.T) {
+	is := is.New(t)
+
+	b := Handler{
+		Formulae: []formula{
+			{Name: "topin", Version: "2.0"},
+			{Name: "tounpin"},
+		},
+	}
+
+	cmds := make(chan []string, 10)
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{}))
+	defer cmd.ResetGlobalOptions()
+
+	is.NoErr(b.Sync())
+
+	close(cmds)
+	var executedCommands [][]string
+	for execedCmd := range cmds {
+		executedCommands = append(executedCommands, execedCmd)
+	}
+	// formulae are only pinned and unpinned by Pin and Unpin
+	is.Equal(executedCommands, [][]string{
+		{"brew", "tap"},
+	})
+}
+
+func TestPin(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	output.Set(&buf, &buf)
+	defer buf.Reset()
+
+	b := Handler{
+		cask: &isNotCask,
+		Formulae: []formula{
+			{Name: "topin", Version: "2.0"},
+			{Name: "tounpin"},
+		},
+	}
+
+	cmds := make(chan []string, 10)
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{}))
+	defer cmd.ResetGlobalOptions()
+
+	res, err := b.Pin("topin@2.0")
+	is.NoErr(err)
+	is.Equal(map[string]handlers.Outcome{"topin": handlers.OutcomePinned}, res.Outcomes)
+	is.NoErr(res.Journal.Rollback())
+
+	res, err = b.Unpin("tounpin")
+	is.NoErr(err)
+	is.Equal(map[string]handlers.Outcome{"tounpin": handlers.OutcomeUnchanged}, res.Outcomes)
+	is.NoErr(res.Journal.Rollback())
+
+	close(cmds)
+	var executedCommands [][]string
+	for execedCmd := range cmds {
+		executedCommands = append(executedCommands, execedCmd)
+	}
+	is.Equal(executedCommands, [][]string{
+		{"brew", "pin", "topin"},
+		{"brew", "unpin", "topin"},
+		{"brew", "unpin", "tounpin"},
+		{"brew", "pin", "tounpin"},
+	})
+}
+
+func TestResolve(t *testing.T) {
+	is := is.New(t)
+
+	cmds := make(chan []string, 10)
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{
+		"brew list --versions vim my/tap/tool": "vim 8.1 8.2\ntool 1.0_1",
+		"brew cask list --versions firefox":    "firefox 70.0",
+	}))
+	defer cmd.ResetGlobalOptions()
+
+	res := &handlers.Result{}
+	resolve(res, formulae{
+		{Name: "vim"},
+		{Name: "tool", Tap: "my/tap", Version: "1.0"},
+		{Name: "firefox", Cask: true},
+	})
+	is.Equal(res.Resolved, map[string]string{
+		"vim":         "8.2",
+		"my/tap/tool": "1.0_1",
+		"firefox":     "70.0",
+	})
+}
@@ -1,6 +1,7 @@
 package brew
 
 import (
+	"encoding/json"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -13,10 +14,19 @@ var defaultTaps = []string{"homebrew/core"}
 // cloned fully or shallow (see `brew tap -h` for
 // further info)
 type tap struct {
-	Name string `json:"name;omitempty"`
+	Name string `json:"name,omitempty"`
 	Full bool   `json:"full"`
 }
 
+// UnmarshalJSON allows a tap to be defined by its name only
+func (t *tap) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &t.Name); err == nil {
+		return nil
+	}
+	type plain tap
+	return json.Unmarshal(data, (*plain)(t))
+}
+
 func (t tap) String() string {
 	return t.Name
 }
@@ -1,6 +1,7 @@
 package brew
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 
@@ -77,3 +78,12 @@ homebrew/core
 	is.Equal([]string{"homebrew/cask", "this/test", "another/here"}, taps)
 	is.Equal([]string{"brew", "tap"}, <-cmds)
 }
+
+func TestUnmarshalTaps(t *testing.T) {
+	is := is.New(t)
+
+	var c configuration
+	is.NoErr(json.Unmarshal([]byte(`{"taps":["homebrew/cask",{"name":"my/tap","full":true}],"updateOnInit":true}`), &c))
+	is.Equal(taps{{Name: "homebrew/cask"}, {Name: "my/tap", Full: true}}, c.Taps)
+	is.True(c.UpdateOnInit)
+}
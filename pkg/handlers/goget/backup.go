@@ -0,0 +1,101 @@
+package goget
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"k8s.io/klog"
+)
+
+// directory in the working dir that binaries are backed up to
+const backupDir = "backup"
+
+// binaryPath returns the path that the binary of the package is
+// installed to
+func binaryPath(pkg Package) (string, error) {
+	dir, err := binDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, extractBinaryName(pkg.URL)), nil
+}
+
+// backup copies the binary of the package into the working dir and
+// records restoring it in the journal. If the package has not been
+// installed yet, undoing removes the binary instead. The backup is
+// named after the module, as modules may have binaries of the same name.
+// The backup is deleted as soon as the journal is done.
+func (goH *Handler) backup(j *handlers.Journal, pkg Package) error {
+	binPath, err := binaryPath(pkg)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(binPath); os.IsNotExist(err) {
+		j.Record("install "+binPath, func() error {
+			err := os.Remove(binPath)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		})
+		return nil
+	}
+
+	dir := filepath.Join(goH.Config.WorkingDir, backupDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "could not create backup directory")
+	}
+	backupPath := filepath.Join(dir, url.PathEscape(strings.TrimRight(pkg.URL, "/")))
+	klog.V(5).Infof("GoGet: Backing up binary %v to %v", binPath, backupPath)
+	if err := copyFile(binPath, backupPath); err != nil {
+		return errors.Wrapf(err, "could not back up %v", binPath)
+	}
+
+	j.Record("replace "+binPath, func() error {
+		return copyFile(backupPath, binPath)
+	})
+	j.OnDone(func() error {
+		return os.Remove(backupPath)
+	})
+	return nil
+}
+
+// copyFile copies src to dst, keeping the file mode. dst is replaced
+// atomically, so that it is never left half-written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,56 @@
+package goget
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestBackup(t *testing.T) {
+	is := is.New(t)
+
+	gobin, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(gobin)
+
+	cmds := make(chan []string, 5)
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{
+		"go env GOBIN GOPATH": gobin + "\n/go",
+	}))
+	defer cmd.ResetGlobalOptions()
+
+	h := newTestHandler(t)
+	bin := filepath.Join(gobin, "tool")
+	is.NoErr(ioutil.WriteFile(bin, []byte("old"), 0755))
+
+	var j handlers.Journal
+	is.NoErr(h.backup(&j, Package{URL: "github.com/test/tool"}))
+	is.NoErr(h.backup(&j, Package{URL: "github.com/test/new"}))
+	// another module with a binary of the same name
+	is.NoErr(ioutil.WriteFile(bin, []byte("other"), 0755))
+	is.NoErr(h.backup(&j, Package{URL: "github.com/other/tool"}))
+
+	// simulate a half-replaced and a newly installed binary
+	is.NoErr(ioutil.WriteFile(bin, []byte("ne"), 0755))
+	is.NoErr(ioutil.WriteFile(filepath.Join(gobin, "new"), []byte("new"), 0755))
+
+	is.NoErr(j.Rollback())
+	content, err := ioutil.ReadFile(bin)
+	is.NoErr(err)
+	is.Equal("old", string(content))
+	info, err := os.Stat(bin)
+	is.NoErr(err)
+	is.Equal(os.FileMode(0755), info.Mode())
+
+	_, err = os.Stat(filepath.Join(gobin, "new"))
+	is.True(os.IsNotExist(err)) // the new binary has been removed
+	backups, err := ioutil.ReadDir(filepath.Join(h.Config.WorkingDir, backupDir))
+	is.NoErr(err)
+	is.Equal(0, len(backups)) // the backups have been cleaned up
+}
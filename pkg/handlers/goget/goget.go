@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 
@@ -13,7 +12,9 @@ import (
 	"github.com/tommyknows/packa/pkg/cmd"
 	"github.com/tommyknows/packa/pkg/collection"
 	"github.com/tommyknows/packa/pkg/defaults"
+	"github.com/tommyknows/packa/pkg/handlers"
 	"github.com/tommyknows/packa/pkg/output"
+	"github.com/tommyknows/packa/pkg/parallel"
 	"k8s.io/klog"
 )
 
@@ -36,10 +37,12 @@ type configuration struct {
 	UpdateDependencies bool `json:"updateDependencies,omitempty"`
 	// Print the output of the go get command
 	PrintCommandOutput bool `json:"printCommandOutput,omitempty"`
+	// How many packages are handled concurrently
+	Parallelism int `json:"parallelism,omitempty"`
 }
 
 type Package struct {
-	URL     string `json:"url"`
+	URL     string `json:"module"`
 	Version string `json:"version,omitempty"`
 }
 
@@ -103,6 +106,48 @@ func (goH *Handler) Name() string {
 	return handlerName
 }
 
+// Schema of the go settings and packages
+func (goH *Handler) Schema() handlers.Schema {
+	return handlers.Schema{
+		Settings: json.RawMessage(`{
+			"type": "object",
+			"additionalProperties": false,
+			"properties": {
+				"workingDir": {"type": "string"},
+				"updateDependencies": {"type": "boolean"},
+				"printCommandOutput": {"type": "boolean"},
+				"parallelism": {"type": "integer"}
+			}
+		}`),
+		Package: json.RawMessage(`{
+			"type": "object",
+			"additionalProperties": false,
+			"required": ["module"],
+			"properties": {
+				"module": {"type": "string"},
+				"version": {"type": "string"}
+			}
+		}`),
+	}
+}
+
+// PackageID identifies a package by its module, so that the same package
+// is not installed at multiple versions
+func (goH *Handler) PackageID(pkg json.RawMessage) (string, error) {
+	var p Package
+	if err := json.Unmarshal(pkg, &p); err != nil {
+		return "", errors.Wrapf(err, "could not parse package %s", pkg)
+	}
+	return p.URL, nil
+}
+
+// Pinned reports whether the package is pinned to a semver version,
+// see controller.PinChecker
+func (goH *Handler) Pinned(pkg json.RawMessage) bool {
+	var p Package
+	return json.Unmarshal(pkg, &p) == nil && matchSemVer(p.Version)
+}
+
 // New returns a handler with the default settings. They will be overwritten
 // (if set) on Init()
 func New() *Handler {
@@ -118,50 +163,93 @@ func New() *Handler {
 
 // Install the packages and add them to the index. If an error occurs while installing
 // a package, the other packages will be handled / installed nonetheless
-func (goH *Handler) Install(pkgs ...string) (packageList *json.RawMessage, err error) {
-	return goH.do(goH.install, goH.addToIndex, pkgs...)
+func (goH *Handler) Install(pkgs ...string) (*handlers.Result, error) {
+	res, done, err := goH.do(goH.install, goH.addToIndex, pkgs...)
+	goH.resolve(res, done)
+	return res, err
 }
 
 // Remove a package from the system by parsing the given name and finding out the
 // binary name. then remove the package from the index
-func (goH *Handler) Remove(pkgs ...string) (packageList *json.RawMessage, err error) {
-	return goH.do(goH.remove, goH.removeFromIndex, pkgs...)
+func (goH *Handler) Remove(pkgs ...string) (*handlers.Result, error) {
+	res, done, err := goH.do(goH.remove, goH.removeFromIndex, pkgs...)
+	if res != nil {
+		for _, p := range done {
+			res.Removed = append(res.Removed, p.URL)
+		}
+	}
+	return res, err
 }
 
 // Upgrade a package, if it is in the index. Returns an error if a package
 // should not exist in the index, but still processes all other packages
-func (goH *Handler) Upgrade(pkgs ...string) (packageList *json.RawMessage, err error) {
-	return goH.do(goH.upgrade, goH.upgradeIndex, pkgs...)
+func (goH *Handler) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	res, done, err := goH.do(goH.upgrade, goH.upgradeIndex, pkgs...)
+	goH.resolve(res, done)
+	return res, err
 }
 
 // do the package action and indexAction for a list of packages, handling
-// errors and marshaling the index in the end
-func (goH *Handler) do(packageAction func(Package) error, indexAction func(Package), pkgs ...string) (*json.RawMessage, error) {
+// errors and marshaling the index in the end. Returns the packages whose
+// package action succeeded, their outcomes are reported in the result.
+// The steps of a package action that fails are rolled back, the steps of
+// all others are returned in the result's journal.
+func (goH *Handler) do(packageAction func(*handlers.Journal, Package) (handlers.Outcome, error), indexAction func(Package), pkgs ...string) (*handlers.Result, []Package, error) {
 	var pError collection.Error
 	packages, err := goH.getPackages(pkgs...)
 	if err != nil {
 		pe, ok := err.(*collection.Error)
 		if !ok {
 			// we always expect a collection.Error from getPackages
-			return nil, errors.Wrapf(err, "unexpected error occured when getting package list")
+			return nil, nil, errors.Wrapf(err, "unexpected error occured when getting package list")
 		}
 		pError.Merge(*pe)
 	}
 
 	// should never occur, but as a safety check
 	if packageAction == nil {
-		return nil, errors.New("no package action defined")
+		return nil, nil, errors.New("no package action defined")
 	}
 
-	for _, p := range packages {
-		// execute the packageAction and then the index action, if applicable
-		switch err := packageAction(p); {
+	// execute the package actions concurrently, but the index
+	// actions in order, so that the index stays deterministic
+	errs := make([]error, len(packages))
+	outcomes := make([]handlers.Outcome, len(packages))
+	journals := make([]handlers.Journal, len(packages))
+	parallel.Do(len(packages), goH.Config.Parallelism, func(i int) {
+		outcomes[i], errs[i] = packageAction(&journals[i], packages[i])
+		if errs[i] == nil {
+			return
+		}
+		if err := journals[i].Rollback(); err != nil {
+			errs[i] = errors.Wrapf(err, "%v, rollback failed", errs[i])
+		}
+	})
+
+	var done []Package
+	journal := &handlers.Journal{}
+	res := &handlers.Result{Journal: journal, Outcomes: make(map[string]handlers.Outcome)}
+	for i, p := range packages {
+		// skipped packages have not been changed
+		skipped := errs[i] == nil && outcomes[i] == handlers.OutcomeSkipped
+		if errs[i] == nil {
+			if !skipped {
+				done = append(done, p)
+			}
+			journal.Append(&journals[i])
+			res.Outcomes[p.URL] = outcomes[i]
+		}
+
+		// execute the index action, if applicable
+		switch err := errs[i]; {
 		case indexAction == nil:
 			klog.V(5).Infof("GoGet: Not executing index action because none is defined")
 		case err != nil:
 			klog.V(4).Infof("GoGet: Error while executing package action for %v, adding error to collection", p.String())
 			pError.Add(p.String(), err)
 			klog.V(5).Infof("GoGet: Not executing index action because of error on package action")
+		case skipped:
+			klog.V(5).Infof("GoGet: Not executing index action because the package action has been skipped")
 		default:
 			indexAction(p)
 		}
@@ -170,10 +258,11 @@ func (goH *Handler) do(packageAction func(Package) error, indexAction func(Packa
 	klog.V(6).Infof("GoGet: Marshaling packages")
 	raw, err := json.Marshal(goH.Packages)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	msg := json.RawMessage(raw)
-	return &msg, pError.IfNotEmpty()
+	res.Packages = &msg
+	return res, done, pError.IfNotEmpty()
 }
 
 // has package in index with version match
@@ -261,8 +350,9 @@ func (goH *Handler) upgradeIndex(p Package) {
 	}
 }
 
-// goGet the given package
-func (goH *Handler) goGet(pkg Package) error {
+// goGet the given package, printing the output of go get as
+// output of the operation
+func (goH *Handler) goGet(op *output.Operation, pkg Package) error {
 	c := []string{"go", "get", pkg.String()}
 	if goH.Config.UpdateDependencies {
 		// insert "-u"
@@ -276,7 +366,7 @@ func (goH *Handler) goGet(pkg Package) error {
 	out, err := cmd.Execute(
 		c,
 		cmd.WorkingDir(goH.Config.WorkingDir),
-		cmd.DirectPrint(bool(klog.V(5)) || goH.Config.PrintCommandOutput),
+		cmd.DirectPrintOperation(bool(klog.V(5)) || goH.Config.PrintCommandOutput, op, "📦 GoGet\t"),
 	)
 
 	// don't print the output twice if we have verbosity
@@ -287,61 +377,72 @@ func (goH *Handler) goGet(pkg Package) error {
 }
 
 // install the package. Does not add it to the package list
-func (goH *Handler) install(pkg Package) error {
-	output.Info("📦 GoGet\tInstalling Package %s", pkg)
-	err := goH.goGet(pkg)
+func (goH *Handler) install(j *handlers.Journal, pkg Package) (handlers.Outcome, error) {
+	op := output.NewOperation(handlerName, "install", pkg.URL, pkg.Version)
+	op.Start("📦 GoGet\tInstalling Package %s", pkg)
+	if err := goH.backup(j, pkg); err != nil {
+		return handlers.OutcomeFailed, op.Fail(err)
+	}
+	err := goH.goGet(op, pkg)
 	if err != nil {
-		return err
+		return handlers.OutcomeFailed, op.Fail(err)
 	}
-	output.Success("📦 GoGet\tInstalled Package %s", pkg)
-	return nil
+	op.Succeed("📦 GoGet\tInstalled Package %s", pkg)
+	return handlers.OutcomeInstalled, nil
 }
 
 // remove a package from the system. As this is kind-of guesswork (parsing
 // the name of the binary), it will ask the user for confirmation
-func (goH *Handler) remove(pkg Package) error {
-	output.Info("📦 GoGet\tRemoving Package %s", pkg)
+func (goH *Handler) remove(j *handlers.Journal, pkg Package) (handlers.Outcome, error) {
+	op := output.NewOperation(handlerName, "remove", pkg.URL, pkg.Version)
+	op.Start("📦 GoGet\tRemoving Package %s", pkg)
 	binName := extractBinaryName(pkg.URL)
-	e := exec.Command("go", "env", "GOPATH")
-	out, err := e.CombinedOutput()
+	binPath, err := binaryPath(pkg)
 	if err != nil {
-		return errors.Wrapf(err, "could not determine GOPATH")
+		return handlers.OutcomeFailed, op.Fail(err)
 	}
 
-	// remove newline and add /bin/
-	dirName := string(out[:len(out)-1]) + "/bin/"
-	confirmed := output.WithConfirmation("removing binary %s (%s)", binName, dirName+binName)
+	confirmed := output.WithConfirmation("removing binary %s (%s)", binName, binPath)
 	if !confirmed {
 		klog.V(5).Infof("GoGet: Binary removal not confirmed by user, aborting")
-		return nil
+		op.Skip("📦 GoGet\tNot removing Package %s, as it has not been confirmed", pkg)
+		return handlers.OutcomeSkipped, nil
 	}
 
-	err = os.Remove(dirName + binName)
+	if err := goH.backup(j, pkg); err != nil {
+		return handlers.OutcomeFailed, op.Fail(err)
+	}
+	err = os.Remove(binPath)
 	if err != nil {
-		return errors.Wrapf(err, "could not delete %v", dirName+binName)
+		return handlers.OutcomeFailed, op.Fail(errors.Wrapf(err, "could not delete %v", binPath))
 	}
-	output.Success("📦 GoGet\tRemoved Package %s", pkg)
-	return nil
+	op.Succeed("📦 GoGet\tRemoved Package %s", pkg)
+	return handlers.OutcomeRemoved, nil
 }
 
 // upgrade only "installs" a package if it is defined in the index
-func (goH *Handler) upgrade(pkg Package) error {
-	output.Info("📦 GoGet\tUpgrading Package %s", pkg)
+func (goH *Handler) upgrade(j *handlers.Journal, pkg Package) (handlers.Outcome, error) {
+	op := output.NewOperation(handlerName, "upgrade", pkg.URL, pkg.Version)
+	op.Start("📦 GoGet\tUpgrading Package %s", pkg)
 	if !goH.hasURL(pkg) {
-		return errors.Errorf("package %v not in index", pkg.String())
+		return handlers.OutcomeFailed, op.Fail(errors.Errorf("package %v not in index", pkg.String()))
 	}
 
-	// we don't update if the version specified is a valid
-	// semver version, meaning it is "pinned".
-	if matchSemVer(pkg.URL) {
-		output.Info("Not upgrading %v as version is pinned to %v", pkg.URL, pkg.Version)
-		return nil
+	// we don't update if the version in the index is a valid
+	// semver version, meaning it is "pinned". Upgrading to
+	// another version moves the pin.
+	if matchSemVer(pkg.Version) && goH.has(pkg) {
+		op.Skip("📦 GoGet\tNot upgrading %v as version is pinned to %v", pkg.URL, pkg.Version)
+		return handlers.OutcomePinned, nil
 	}
-	if err := goH.goGet(pkg); err != nil {
-		return err
+	if err := goH.backup(j, pkg); err != nil {
+		return handlers.OutcomeFailed, op.Fail(err)
 	}
-	output.Success("📦 GoGet\tUpgraded Package %s", pkg)
-	return nil
+	if err := goH.goGet(op, pkg); err != nil {
+		return handlers.OutcomeFailed, op.Fail(err)
+	}
+	op.Succeed("📦 GoGet\tUpgraded Package %s", pkg)
+	return handlers.OutcomeUpgraded, nil
 }
 
 // returns true if supplied version is a valid semver
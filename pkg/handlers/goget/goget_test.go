@@ -10,6 +10,7 @@ import (
 	"github.com/matryer/is"
 	"github.com/tommyknows/packa/pkg/collection"
 	"github.com/tommyknows/packa/pkg/defaults"
+	"github.com/tommyknows/packa/pkg/handlers"
 )
 
 func newTestHandler(t *testing.T) *Handler {
@@ -36,36 +37,36 @@ func TestInit(t *testing.T) {
 	}{
 		"empty": {
 			configRaw:   json.RawMessage(`{}`),
-			config:      configuration{defaults.WorkingDir(), false, false}, // default value from New() call
+			config:      configuration{defaults.WorkingDir(), false, false, 0}, // default value from New() call
 			packagesRaw: json.RawMessage(`[]`),
 			packages:    []Package{},
 			isErr:       false,
 		},
 		"nil-config": {
 			configRaw:   json.RawMessage(``),
-			config:      configuration{defaults.WorkingDir(), false, false}, // default value from New() call
+			config:      configuration{defaults.WorkingDir(), false, false, 0}, // default value from New() call
 			packagesRaw: json.RawMessage(`[]`),
 			packages:    []Package{},
 			isErr:       false,
 		},
 		"nil-packages": {
 			configRaw:   json.RawMessage(`{}`),
-			config:      configuration{defaults.WorkingDir(), false, false}, // default value from New() call
+			config:      configuration{defaults.WorkingDir(), false, false, 0}, // default value from New() call
 			packagesRaw: json.RawMessage(``),
 			packages:    []Package{{"github.com/tommyknows/packa", "latest"}},
 			isErr:       false,
 		},
 		"configed": {
 			configRaw:   json.RawMessage(`{"workingDir": "/test"}`),
-			config:      configuration{"/test", false, false},
+			config:      configuration{"/test", false, false, 0},
 			packagesRaw: json.RawMessage(`[]`),
 			packages:    []Package{},
 			isErr:       false,
 		},
 		"defined package": {
 			configRaw:   json.RawMessage(`{"workingDir": "/test"}`),
-			config:      configuration{"/test", false, false},
-			packagesRaw: json.RawMessage(`[{"url": "github.com/test/test", "version": "latest"}]`),
+			config:      configuration{"/test", false, false, 0},
+			packagesRaw: json.RawMessage(`[{"module": "github.com/test/test", "version": "latest"}]`),
 			packages:    []Package{{"github.com/test/test", "latest"}},
 			isErr:       false,
 		},
@@ -78,7 +79,7 @@ func TestInit(t *testing.T) {
 		},
 		"invalid packages": {
 			configRaw:   json.RawMessage(``),
-			config:      configuration{defaults.WorkingDir(), false, false}, // default value from New() call
+			config:      configuration{defaults.WorkingDir(), false, false, 0}, // default value from New() call
 			packagesRaw: json.RawMessage(`["test":"bla"]`),
 			packages:    []Package{},
 			isErr:       true,
@@ -115,14 +116,14 @@ func TestDo(t *testing.T) {
 
 	pkgCh := make(chan Package)
 	idxCh := make(chan Package)
-	pkgAction := func(returnError bool) func(Package) error {
-		return func(p Package) error {
+	pkgAction := func(returnError bool) func(*handlers.Journal, Package) (handlers.Outcome, error) {
+		return func(_ *handlers.Journal, p Package) (handlers.Outcome, error) {
 			var ce collection.Error
 			pkgCh <- p
 			if returnError {
 				ce.Add("test", fmt.Errorf("artificial error"))
 			}
-			return ce.IfNotEmpty()
+			return handlers.OutcomeInstalled, ce.IfNotEmpty()
 		}
 	}
 
@@ -131,14 +132,15 @@ func TestDo(t *testing.T) {
 	}
 
 	h := newTestHandler(t)
-	rm, err := h.do(nil, nil)
+	rm, _, err := h.do(nil, nil)
 	is.True(rm == nil)
 	is.True(err != nil)
 
 	go func() {
-		rm, err = h.do(pkgAction(false), idxAction)
+		rm, _, err = h.do(pkgAction(false), idxAction)
 		is.True(rm != nil)
 		is.NoErr(err)
+		is.Equal(handlers.OutcomeInstalled, rm.Outcomes[h.Packages[0].URL])
 		close(idxCh)
 		close(pkgCh)
 	}()
@@ -169,7 +171,7 @@ func TestDo(t *testing.T) {
 	idxCh = make(chan Package)
 
 	go func() {
-		rm, err = h.do(pkgAction(true), idxAction)
+		rm, _, err = h.do(pkgAction(true), idxAction)
 		is.True(rm != nil)
 		is.True(err != nil)
 		close(idxCh)
@@ -198,7 +200,17 @@ func TestDo(t *testing.T) {
 		}
 	}
 
-	rm, err = h.do(pkgAction(false), idxAction, "test@bla@x@")
+	// skipped packages are not done and stay in the index
+	indexed := false
+	rm, done, err := h.do(func(*handlers.Journal, Package) (handlers.Outcome, error) {
+		return handlers.OutcomeSkipped, nil
+	}, func(Package) { indexed = true })
+	is.NoErr(err)
+	is.Equal(0, len(done))
+	is.True(!indexed)
+	is.Equal(handlers.OutcomeSkipped, rm.Outcomes[h.Packages[0].URL])
+
+	rm, _, err = h.do(pkgAction(false), idxAction, "test@bla@x@")
 	is.True(rm != nil)
 	is.True(err != nil)
 	ce, ok := err.(*collection.Error)
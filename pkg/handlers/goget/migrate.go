@@ -0,0 +1,42 @@
+package goget
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+)
+
+// Migrations of the go packages
+func (goH *Handler) Migrations() []handlers.Migration {
+	return []handlers.Migration{
+		{
+			From:        "v1",
+			Description: "rename the url of packages to module",
+			Migrate:     renameURL,
+		},
+	}
+}
+
+// renameURL renames the url key of all packages to module
+func renameURL(settings, packages *json.RawMessage) (*json.RawMessage, *json.RawMessage, error) {
+	if packages == nil {
+		return settings, nil, nil
+	}
+	var pkgs []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*packages), &pkgs); err != nil {
+		return nil, nil, errors.Wrapf(err, "could not parse packages %s", packages)
+	}
+	for _, p := range pkgs {
+		if url, ok := p["url"]; ok {
+			p["module"] = url
+			delete(p, "url")
+		}
+	}
+	raw, err := json.Marshal(pkgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := json.RawMessage(raw)
+	return settings, &msg, nil
+}
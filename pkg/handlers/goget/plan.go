@@ -0,0 +1,226 @@
+package goget
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// binary is a Go binary that is installed in GOBIN
+type binary struct {
+	// import path of the main package
+	path string
+	// module and version the binary has been built from.
+	// empty if the binary has not been built in module mode
+	module  string
+	version string
+}
+
+// Plan compares the packages in the index with the binaries that are
+// installed in GOBIN and returns the changes that an install or upgrade
+// would make. Packages that have a pinned version are installed at that
+// version, all other packages are upgraded if a newer version exists.
+// Binaries that have been built by go but are not in the index are
+// returned as removals.
+func (goH *Handler) Plan() ([]handlers.Change, error) {
+	dir, err := binDir()
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := installedBinaries(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []handlers.Change
+	var cerr collection.Error
+	indexed := make(map[string]bool)
+	for _, p := range goH.Packages {
+		name := extractBinaryName(p.URL)
+		indexed[name] = true
+
+		bin, ok := installed[name]
+		if !ok {
+			klog.V(5).Infof("GoGet: Binary %v of package %s is not installed", name, p)
+			changes = append(changes, handlers.Change{Action: handlers.ActionInstall, Package: p.String(), To: desiredVersion(p)})
+			continue
+		}
+
+		c, err := goH.planPackage(p, bin)
+		if err != nil {
+			cerr.Add(p.String(), err)
+			continue
+		}
+		if c != nil {
+			changes = append(changes, *c)
+		}
+	}
+
+	for _, name := range sortedKeys(installed) {
+		if !indexed[name] {
+			changes = append(changes, handlers.Change{Action: handlers.ActionRemove, Package: installed[name].path, From: installed[name].version})
+		}
+	}
+	return changes, cerr.IfNotEmpty()
+}
+
+// planPackage returns the change needed for the installed package,
+// or nil if the package is installed in the desired version
+func (goH *Handler) planPackage(p Package, bin binary) (*handlers.Change, error) {
+	if matchSemVer(p.Version) {
+		if bin.version == p.Version {
+			return nil, nil
+		}
+		// pinned packages are not upgraded, but installed
+		// at the pinned version
+		return &handlers.Change{Action: handlers.ActionInstall, Package: p.String(), From: bin.version, To: p.Version}, nil
+	}
+
+	if bin.module == "" {
+		// without module information, we cannot resolve the
+		// version and always upgrade
+		return &handlers.Change{Action: handlers.ActionUpgrade, Package: p.String(), To: desiredVersion(p)}, nil
+	}
+
+	resolved, err := goH.resolveVersion(bin.module, desiredVersion(p))
+	if err != nil {
+		return nil, err
+	}
+	if resolved == bin.version {
+		return nil, nil
+	}
+	return &handlers.Change{Action: handlers.ActionUpgrade, Package: p.String(), From: bin.version, To: resolved}, nil
+}
+
+// resolve adds the versions that the given packages have been installed
+// at to the result, as read from the build info of their binaries.
+// Binaries that have not been built in module mode have no version.
+func (goH *Handler) resolve(res *handlers.Result, pkgs []Package) {
+	if res == nil || len(pkgs) == 0 {
+		return
+	}
+
+	dir, err := binDir()
+	if err != nil {
+		output.Warn("📦 GoGet\tCould not resolve installed versions: %v", err)
+		return
+	}
+	installed, err := installedBinaries(dir)
+	if err != nil {
+		output.Warn("📦 GoGet\tCould not resolve installed versions: %v", err)
+		return
+	}
+
+	res.Resolved = make(map[string]string)
+	for _, p := range pkgs {
+		bin := installed[extractBinaryName(p.URL)]
+		if bin.version == "" || bin.version == "(devel)" {
+			klog.V(5).Infof("GoGet: Could not resolve the installed version of %s", p)
+			continue
+		}
+		res.Resolved[p.URL] = bin.version
+	}
+}
+
+// desiredVersion returns the version that go get would install
+func desiredVersion(p Package) string {
+	if p.Version == "" {
+		return "latest"
+	}
+	return p.Version
+}
+
+// binDir returns the directory go get installs binaries to
+func binDir() (string, error) {
+	out, err := cmd.Execute([]string{"go", "env", "GOBIN", "GOPATH"})
+	if err != nil {
+		return "", errors.Wrapf(err, "could not determine GOBIN: %v", out)
+	}
+	env := strings.Split(out, "\n")
+	if gobin := strings.TrimSpace(env[0]); gobin != "" {
+		return gobin, nil
+	}
+	if len(env) < 2 || strings.TrimSpace(env[1]) == "" {
+		return "", errors.New("neither GOBIN nor GOPATH are set")
+	}
+	// GOPATH may consist of multiple paths, go get uses the first
+	gopath := filepath.SplitList(strings.TrimSpace(env[1]))[0]
+	return filepath.Join(gopath, "bin"), nil
+}
+
+// installedBinaries returns all binaries in dir that have been built
+// by go, keyed by the binary's name
+func installedBinaries(dir string) (map[string]binary, error) {
+	bins := make(map[string]binary)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		klog.V(5).Infof("GoGet: Binary directory %v does not exist", dir)
+		return bins, nil
+	}
+
+	out, err := cmd.Execute([]string{"go", "version", "-m", dir})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read build info of binaries in %v: %v", dir, out)
+	}
+
+	// the output contains a line "<file>: <go version>" for every
+	// binary, followed by indented lines with the build info
+	var name string
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") {
+			name = filepath.Base(strings.SplitN(line, ": ", 2)[0])
+			bins[name] = binary{}
+			continue
+		}
+
+		bin := bins[name]
+		switch fields := strings.Fields(line); {
+		case len(fields) >= 2 && fields[0] == "path":
+			bin.path = fields[1]
+		case len(fields) >= 3 && fields[0] == "mod":
+			bin.module, bin.version = fields[1], fields[2]
+		}
+		bins[name] = bin
+	}
+
+	// binaries without a path cannot be related to a package
+	for name, bin := range bins {
+		if bin.path == "" {
+			delete(bins, name)
+		}
+	}
+	return bins, nil
+}
+
+// resolveVersion queries the exact version that the given version
+// query (e.g. "latest" or a branch name) resolves to
+func (goH *Handler) resolveVersion(module, query string) (string, error) {
+	out, err := cmd.Execute(
+		[]string{"go", "list", "-m", "-f", "{{.Version}}", module + "@" + query},
+		cmd.WorkingDir(goH.Config.WorkingDir),
+	)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve version %v of module %v: %v", query, module, out)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func sortedKeys(bins map[string]binary) []string {
+	keys := make([]string, 0, len(bins))
+	for k := range bins {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
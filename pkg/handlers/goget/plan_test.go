@@ -0,0 +1,97 @@
+package goget
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+func TestPlan(t *testing.T) {
+	is := is.New(t)
+
+	gobin, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(gobin)
+
+	h := newTestHandler(t)
+	h.Packages = []Package{
+		{"github.com/test/missing", ""},
+		{"github.com/test/uptodate", "latest"},
+		{"github.com/test/outdated/v2", ""},
+		{"github.com/test/pinned", "v1.0.0"},
+		{"github.com/test/pinnedold", "v1.1.0"},
+	}
+
+	cmds := make(chan []string, 20)
+	buildInfo := func(bin, mod, version string) string {
+		return filepath.Join(gobin, bin) + ": go1.13\n\tpath\t" + mod + "\n\tmod\t" + mod + "\t" + version + "\th1:abc\n"
+	}
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{
+		"go env GOBIN GOPATH": gobin + "\n/go",
+		"go version -m " + gobin: buildInfo("uptodate", "github.com/test/uptodate", "v1.0.0") +
+			buildInfo("outdated", "github.com/test/outdated/v2", "v2.0.0") +
+			buildInfo("pinned", "github.com/test/pinned", "v1.0.0") +
+			buildInfo("pinnedold", "github.com/test/pinnedold", "v1.0.0") +
+			buildInfo("unlisted", "github.com/test/unlisted", "v0.1.0") +
+			filepath.Join(gobin, "nomodule") + ": go1.13\n",
+
+		"go list -m -f {{.Version}} github.com/test/uptodate@latest":    "v1.0.0",
+		"go list -m -f {{.Version}} github.com/test/outdated/v2@latest": "v2.1.0",
+	}))
+	defer cmd.ResetGlobalOptions()
+
+	changes, err := h.Plan()
+	is.NoErr(err)
+	is.Equal(changes, []handlers.Change{
+		{Action: handlers.ActionInstall, Package: "github.com/test/missing", To: "latest"},
+		{Action: handlers.ActionUpgrade, Package: "github.com/test/outdated/v2", From: "v2.0.0", To: "v2.1.0"},
+		{Action: handlers.ActionInstall, Package: "github.com/test/pinnedold@v1.1.0", From: "v1.0.0", To: "v1.1.0"},
+		{Action: handlers.ActionRemove, Package: "github.com/test/unlisted", From: "v0.1.0"},
+	})
+}
+
+func TestBinDir(t *testing.T) {
+	is := is.New(t)
+
+	cmds := make(chan []string, 2)
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{
+		"go env GOBIN GOPATH": "\n/go:/other",
+	}))
+	defer cmd.ResetGlobalOptions()
+
+	dir, err := binDir()
+	is.NoErr(err)
+	is.Equal("/go/bin", dir) // without GOBIN, the first GOPATH should be used
+}
+
+func TestResolve(t *testing.T) {
+	is := is.New(t)
+
+	gobin, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(gobin)
+
+	cmds := make(chan []string, 5)
+	cmd.AddGlobalOptions(fake.Respond(cmds, map[string]string{
+		"go env GOBIN GOPATH": gobin + "\n/go",
+		"go version -m " + gobin: filepath.Join(gobin, "tool") + ": go1.13\n\tpath\tgithub.com/test/tool/cmd/tool\n\tmod\tgithub.com/test/tool\tv0.0.0-20191010101010-abcdefabcdef\th1:abc\n" +
+			filepath.Join(gobin, "devel") + ": go1.13\n\tpath\tgithub.com/test/devel\n\tmod\tgithub.com/test/devel\t(devel)\t\n",
+	}))
+	defer cmd.ResetGlobalOptions()
+
+	h := newTestHandler(t)
+	res := &handlers.Result{}
+	h.resolve(res, []Package{
+		{"github.com/test/tool/cmd/tool", "master"},
+		{"github.com/test/devel", ""},
+	})
+	is.Equal(res.Resolved, map[string]string{
+		"github.com/test/tool/cmd/tool": "v0.0.0-20191010101010-abcdefabcdef",
+	})
+}
@@ -0,0 +1,105 @@
+// Package handlers contains the types that are shared between the
+// controller and the implementations of the package handlers.
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Action is an operation a handler executes on the system
+type Action string
+
+const (
+	ActionInstall Action = "install"
+	ActionUpgrade Action = "upgrade"
+	ActionRemove  Action = "remove"
+	ActionPin     Action = "pin"
+	ActionUnpin   Action = "unpin"
+	ActionTap     Action = "tap"
+	ActionUntap   Action = "untap"
+)
+
+// Change describes a single modification that a handler would make
+// to the system to get from the installed to the desired state.
+type Change struct {
+	Action Action `json:"action"`
+	// Package in the handler-specific format, as it would be
+	// passed to the handler's operations
+	Package string `json:"package"`
+	// From is the currently installed version, if known
+	From string `json:"from,omitempty"`
+	// To is the version after the change, if known
+	To string `json:"to,omitempty"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%v %v", c.Action, c.Package)
+	switch {
+	case c.From != "" && c.To != "":
+		s += fmt.Sprintf(" (%v -> %v)", c.From, c.To)
+	case c.To != "":
+		s += fmt.Sprintf(" (%v)", c.To)
+	}
+	return s
+}
+
+// Outcome of an operation on a package
+type Outcome string
+
+const (
+	OutcomeInstalled Outcome = "installed"
+	OutcomeUpgraded  Outcome = "upgraded"
+	OutcomeRemoved   Outcome = "removed"
+	// OutcomeUnchanged packages did not need an upgrade
+	OutcomeUnchanged Outcome = "unchanged"
+	// OutcomePinned packages have not been upgraded, as they
+	// are pinned to a version
+	OutcomePinned Outcome = "pinned"
+	// OutcomeSkipped packages have not been operated on for any
+	// other reason, e.g. as the user did not confirm it
+	OutcomeSkipped Outcome = "skipped"
+	OutcomeFailed  Outcome = "failed"
+)
+
+// Result is returned by the operations of a handler
+type Result struct {
+	// Packages is the handler's new package list. As long as it is
+	// not nil, it will be added back to the config.
+	Packages *json.RawMessage
+	// Resolved maps the names of the packages that have been installed
+	// or upgraded to the exact version that is installed on the system.
+	// The name is the package as accepted by the handler's operations,
+	// without a version; name@version installs exactly that version.
+	Resolved map[string]string
+	// Removed contains the names of the packages that have been
+	// removed from the system.
+	Removed []string
+	// Outcomes maps the names of the packages that have been operated
+	// on to the outcome of the operation, by the same names as Resolved.
+	// Packages that failed are reported in the returned error instead.
+	Outcomes map[string]Outcome
+	// Journal contains the steps of the operation that succeeded,
+	// so that the controller can roll them back. Steps of a package
+	// that failed should be rolled back by the handler itself.
+	Journal *Journal
+}
+
+// Schema contains the JSON Schemas of the settings of a handler and of
+// the entries in its package list. They are used to validate the config.
+type Schema struct {
+	Settings json.RawMessage
+	Package  json.RawMessage
+}
+
+// Migration upgrades the settings and packages of a handler from one
+// apiVersion of the config to the next.
+type Migration struct {
+	// From is the apiVersion of the config that is migrated
+	From string
+	// Description of the change, e.g. for logging
+	Description string
+	// Migrate the settings and packages of the handler. Both may be nil
+	// if they are not defined, the returned values replace them.
+	Migrate func(settings, packages *json.RawMessage) (*json.RawMessage, *json.RawMessage, error)
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"k8s.io/klog"
+)
+
+// Journal records the steps that a handler has executed together with
+// their compensating undo, so that they can be rolled back. A nil
+// Journal has nothing to roll back or commit.
+// It is safe to use a Journal concurrently.
+type Journal struct {
+	mu      sync.Mutex
+	steps   []step
+	cleanup []func() error
+}
+
+type step struct {
+	name string
+	undo func() error
+}
+
+// Record that the step with the given name has been executed
+// and can be undone by calling undo
+func (j *Journal) Record(name string, undo func() error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	klog.V(6).Infof("Journal: recording step %v", name)
+	j.steps = append(j.steps, step{name, undo})
+}
+
+// OnDone registers a cleanup function, e.g. removing a backup, that is
+// executed as soon as the steps have been committed or rolled back
+func (j *Journal) OnDone(cleanup func() error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cleanup = append(j.cleanup, cleanup)
+}
+
+// Append the steps of the other journal to this journal, leaving
+// the other journal empty
+func (j *Journal) Append(other *Journal) {
+	if other == nil {
+		return
+	}
+	other.mu.Lock()
+	steps, cleanup := other.steps, other.cleanup
+	other.steps, other.cleanup = nil, nil
+	other.mu.Unlock()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.steps = append(j.steps, steps...)
+	j.cleanup = append(j.cleanup, cleanup...)
+}
+
+// Rollback undoes all recorded steps in the reverse order of their
+// execution. Steps that cannot be undone do not stop the rollback of
+// the other steps, but are reported in the returned error.
+func (j *Journal) Rollback() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	steps := j.steps
+	j.steps = nil
+	j.mu.Unlock()
+
+	var cerr collection.Error
+	for i := len(steps) - 1; i >= 0; i-- {
+		klog.V(4).Infof("Journal: undoing step %v", steps[i].name)
+		if err := steps[i].undo(); err != nil {
+			cerr.Add(steps[i].name, errors.Wrapf(err, "could not undo"))
+		}
+	}
+	cerr.Merge(j.done())
+	return cerr.IfNotEmpty()
+}
+
+// Commit the recorded steps, so that they cannot be rolled back anymore
+func (j *Journal) Commit() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	j.steps = nil
+	j.mu.Unlock()
+
+	cerr := j.done()
+	return cerr.IfNotEmpty()
+}
+
+// done executes and removes all cleanup functions
+func (j *Journal) done() collection.Error {
+	j.mu.Lock()
+	cleanup := j.cleanup
+	j.cleanup = nil
+	j.mu.Unlock()
+
+	var cerr collection.Error
+	for i, c := range cleanup {
+		if err := c(); err != nil {
+			cerr.Add(fmt.Sprintf("cleanup %v", i), err)
+		}
+	}
+	return cerr
+}
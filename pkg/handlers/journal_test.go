@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestJournal(t *testing.T) {
+	is := is.New(t)
+
+	var undone []string
+	var cleaned int
+	undo := func(name string, err error) func() error {
+		return func() error {
+			undone = append(undone, name)
+			return err
+		}
+	}
+
+	var j, other Journal
+	j.Record("first", undo("first", nil))
+	j.Record("second", undo("second", errors.New("cannot undo")))
+	j.OnDone(func() error {
+		cleaned++
+		return nil
+	})
+	other.Record("third", undo("third", nil))
+	j.Append(&other)
+
+	// the other journal has been emptied
+	is.NoErr(other.Rollback())
+	is.Equal(0, len(undone))
+
+	// steps are undone in reverse order, even if one fails
+	err := j.Rollback()
+	is.True(err != nil)
+	is.Equal([]string{"third", "second", "first"}, undone)
+	is.Equal(1, cleaned)
+
+	// the journal is empty after a rollback
+	is.NoErr(j.Rollback())
+	is.Equal(3, len(undone))
+
+	// committing does not undo steps, but cleans up
+	j.Record("fourth", undo("fourth", nil))
+	j.OnDone(func() error {
+		cleaned++
+		return nil
+	})
+	is.NoErr(j.Commit())
+	is.NoErr(j.Rollback())
+	is.Equal(3, len(undone))
+	is.Equal(2, cleaned)
+
+	var nilJournal *Journal
+	is.NoErr(nilJournal.Rollback())
+	is.NoErr(nilJournal.Commit())
+}
@@ -0,0 +1,205 @@
+// Command packa-handler-npm is the reference plugin for packa. It
+// installs global npm packages. Install it with
+//
+//	go build -o ~/.packa/handlers/packa-handler-npm ./pkg/handlers/plugin/example
+//
+// and manage the packages with "packa npm install <package>[@version]".
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/handlers/plugin"
+	"github.com/tommyknows/packa/pkg/output"
+)
+
+func main() {
+	// stdout is reserved for the protocol
+	output.Set(os.Stderr, os.Stderr)
+	if err := plugin.Serve(&npm{}, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type npm struct {
+	Config   configuration
+	Packages []pkg
+}
+
+type configuration struct {
+	PrintCommandOutput bool `json:"printCommandOutput,omitempty"`
+}
+
+// pkg is a package in the index. Packages with a version are pinned
+// and not upgraded.
+type pkg struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func (p pkg) String() string {
+	if p.Version == "" {
+		return p.Name
+	}
+	return p.Name + "@" + p.Version
+}
+
+// parse name[@version], names of scoped packages start with an @
+func parse(s string) pkg {
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		return pkg{Name: s[:i], Version: s[i+1:]}
+	}
+	return pkg{Name: s}
+}
+
+func (n *npm) Init(config *json.RawMessage, packages *json.RawMessage) error {
+	if config != nil {
+		if err := json.Unmarshal([]byte(*config), &n.Config); err != nil {
+			return errors.Wrapf(err, "could not parse config %s", config)
+		}
+	}
+	if packages != nil {
+		if err := json.Unmarshal([]byte(*packages), &n.Packages); err != nil {
+			return errors.Wrapf(err, "could not parse packages %s", packages)
+		}
+	}
+	return nil
+}
+
+// Install the packages, or all packages in the index if none are given
+func (n *npm) Install(pkgs ...string) (*handlers.Result, error) {
+	if len(pkgs) == 0 {
+		for _, p := range n.Packages {
+			pkgs = append(pkgs, p.String())
+		}
+	}
+	return n.do(pkgs, func(p pkg) error {
+		version := p.Version
+		if version == "" {
+			version = "latest"
+		}
+		output.Info("📦 NPM\tInstalling Package %v", p)
+		if err := n.npm("install", "--global", p.Name+"@"+version); err != nil {
+			return err
+		}
+		n.index(p)
+		output.Success("📦 NPM\tInstalled Package %v", p)
+		return nil
+	})
+}
+
+// Remove the packages from the system and the index
+func (n *npm) Remove(pkgs ...string) (*handlers.Result, error) {
+	res, err := n.do(pkgs, func(p pkg) error {
+		output.Info("📦 NPM\tRemoving Package %v", p.Name)
+		if err := n.npm("uninstall", "--global", p.Name); err != nil {
+			return err
+		}
+		for i := range n.Packages {
+			if n.Packages[i].Name == p.Name {
+				n.Packages = append(n.Packages[:i], n.Packages[i+1:]...)
+				break
+			}
+		}
+		output.Success("📦 NPM\tRemoved Package %v", p.Name)
+		return nil
+	})
+	if res != nil {
+		for _, p := range pkgs {
+			if _, ok := res.Resolved[parse(p).Name]; !ok {
+				res.Removed = append(res.Removed, parse(p).Name)
+			}
+		}
+		res.Resolved = nil
+	}
+	return res, err
+}
+
+// Upgrade the packages, or all packages in the index that are not
+// pinned if none are given
+func (n *npm) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	if len(pkgs) == 0 {
+		for _, p := range n.Packages {
+			if p.Version == "" {
+				pkgs = append(pkgs, p.Name)
+			}
+		}
+	}
+	return n.Install(pkgs...)
+}
+
+// List the globally installed packages
+func (n *npm) List() (map[string]string, error) {
+	out, err := cmd.Execute([]string{"npm", "ls", "--global", "--depth=0", "--json"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list packages: %v", out)
+	}
+	var list struct {
+		Dependencies map[string]struct {
+			Version string `json:"version"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, errors.Wrapf(err, "could not parse package list")
+	}
+	installed := make(map[string]string, len(list.Dependencies))
+	for name, d := range list.Dependencies {
+		installed[name] = d.Version
+	}
+	return installed, nil
+}
+
+// do the action for every package and return the new index and the
+// installed versions of the packages
+func (n *npm) do(pkgs []string, action func(pkg) error) (*handlers.Result, error) {
+	var cerr collection.Error
+	for _, s := range pkgs {
+		if err := action(parse(s)); err != nil {
+			cerr.Add(s, err)
+		}
+	}
+
+	installed, err := n.List()
+	if err != nil {
+		cerr.Add("list", err)
+	}
+	resolved := make(map[string]string)
+	for _, s := range pkgs {
+		if v, ok := installed[parse(s).Name]; ok {
+			resolved[parse(s).Name] = v
+		}
+	}
+
+	data, err := json.Marshal(n.Packages)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(data)
+	return &handlers.Result{Packages: &raw, Resolved: resolved}, cerr.IfNotEmpty()
+}
+
+// index adds the package to the index or updates its version
+func (n *npm) index(p pkg) {
+	for i := range n.Packages {
+		if n.Packages[i].Name == p.Name {
+			n.Packages[i].Version = p.Version
+			return
+		}
+	}
+	n.Packages = append(n.Packages, p)
+}
+
+func (n *npm) npm(args ...string) error {
+	out, err := cmd.Execute(append([]string{"npm"}, args...),
+		cmd.DirectPrintWithPrefix(n.Config.PrintCommandOutput, "📦 NPM\t"),
+	)
+	return errors.Wrapf(err, "npm %v failed: %v", strings.Join(args, " "), out)
+}
@@ -0,0 +1,245 @@
+// Package plugin adapts external executables to package handlers. A
+// plugin is an executable named packa-handler-<name> that serves the
+// requests of the controller over its stdin and stdout, see Serve and
+// the README for the protocol.
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tommyknows/packa/pkg/defaults"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Prefix of the executables of plugins
+const Prefix = "packa-handler-"
+
+// Handler executes the operations with a plugin. The plugin is
+// started on the first request and stopped with Close.
+type Handler struct {
+	name string
+	path string
+	// start connects to the plugin
+	start func() (io.WriteCloser, io.Reader, error)
+
+	mu     sync.Mutex
+	in     io.WriteCloser
+	out    *bufio.Scanner
+	cmd    *exec.Cmd
+	lastID int
+}
+
+// New returns a handler with the name that executes the plugin at path
+func New(name, path string) *Handler {
+	h := &Handler{name: name, path: path}
+	h.start = h.exec
+	return h
+}
+
+// exec starts the plugin
+func (h *Handler) exec() (io.WriteCloser, io.Reader, error) {
+	h.cmd = exec.Command(h.path)
+	h.cmd.Stderr = os.Stderr
+	in, err := h.cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := h.cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	klog.V(3).Infof("Starting plugin %v", h.path)
+	return in, out, h.cmd.Start()
+}
+
+// Discover returns the plugins in the directories, by name. If a plugin
+// is found in several directories, the first one is used.
+func Discover(dirs ...string) map[string]string {
+	plugins := make(map[string]string)
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			klog.V(4).Infof("Could not search plugins in %v: %v", dir, err)
+			continue
+		}
+		for _, f := range files {
+			name := strings.TrimPrefix(f.Name(), Prefix)
+			if name == f.Name() || name == "" || f.IsDir() || f.Mode()&0111 == 0 {
+				continue
+			}
+			if _, ok := plugins[name]; !ok {
+				plugins[name] = filepath.Join(dir, f.Name())
+			}
+		}
+	}
+	return plugins
+}
+
+// Dirs returns the directories that plugins are searched in,
+// defaults.HandlersDir and the directories in PATH
+func Dirs() []string {
+	return append([]string{defaults.HandlersDir()}, filepath.SplitList(os.Getenv("PATH"))...)
+}
+
+// Name of the handler
+func (h *Handler) Name() string {
+	return h.name
+}
+
+// Command of the handler
+func (h *Handler) Command() *cobra.Command {
+	c := &cobra.Command{
+		Use:   h.name + " <action> [packages]",
+		Short: "HANDLER: " + h.name + " packages (plugin)",
+		Long: h.name + ` is an external handler, the plugin
+` + h.path + `
+executes all operations.`,
+	}
+	c.AddCommand(&cobra.Command{
+		Use:   "installed",
+		Short: "list the packages that are installed on the system",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			defer h.Close()
+			installed, err := h.List()
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(installed))
+			for name := range installed {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				output.Info("%v %v", name, installed[name])
+			}
+			return nil
+		},
+	})
+	return c
+}
+
+// Init the plugin with the settings and packages
+func (h *Handler) Init(settings *json.RawMessage, packages *json.RawMessage) error {
+	return h.call(MethodInit, InitParams{settings, packages}, nil)
+}
+
+// Install the packages with the plugin
+func (h *Handler) Install(pkgs ...string) (*handlers.Result, error) {
+	return h.operation(MethodInstall, pkgs)
+}
+
+// Remove the packages with the plugin
+func (h *Handler) Remove(pkgs ...string) (*handlers.Result, error) {
+	return h.operation(MethodRemove, pkgs)
+}
+
+// Upgrade the packages with the plugin
+func (h *Handler) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	return h.operation(MethodUpgrade, pkgs)
+}
+
+// List the packages that are installed on the system
+func (h *Handler) List() (map[string]string, error) {
+	var res ListResult
+	err := h.call(MethodList, nil, &res)
+	return res.Installed, err
+}
+
+func (h *Handler) operation(method string, pkgs []string) (*handlers.Result, error) {
+	var res *Result
+	err := h.call(method, PackagesParams{pkgs}, &res)
+	if res == nil {
+		return nil, err
+	}
+	return &handlers.Result{Packages: res.Packages, Resolved: res.Resolved, Removed: res.Removed, Outcomes: res.Outcomes}, err
+}
+
+// call the method of the plugin and decode its result into result.
+// If the plugin returns a result and an error, both are returned.
+func (h *Handler) call(method string, params interface{}, result interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.in == nil {
+		in, out, err := h.start()
+		if err != nil {
+			return errors.Wrapf(err, "could not start plugin %v", h.name)
+		}
+		h.in, h.out = in, bufio.NewScanner(out)
+		h.out.Buffer(nil, maxMessageSize)
+	}
+
+	h.lastID++
+	req := Request{ID: h.lastID, Method: method}
+	if params != nil {
+		p, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = p
+	}
+	klog.V(4).Infof("Plugin %v: request %v", h.name, req.Method)
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := h.in.Write(append(data, '\n')); err != nil {
+		return errors.Wrapf(err, "could not send request to plugin %v", h.name)
+	}
+
+	if !h.out.Scan() {
+		err := h.out.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrapf(err, "could not read response of plugin %v", h.name)
+	}
+	var resp Response
+	if err := json.Unmarshal(h.out.Bytes(), &resp); err != nil {
+		return errors.Wrapf(err, "invalid response of plugin %v", h.name)
+	}
+	if resp.ID != req.ID {
+		return errors.Errorf("plugin %v responded to request %v instead of %v", h.name, resp.ID, req.ID)
+	}
+	if resp.Result != nil && result != nil {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return errors.Wrapf(err, "invalid result of plugin %v", h.name)
+		}
+	}
+	if resp.Error != nil {
+		return resp.Error.err()
+	}
+	return nil
+}
+
+// Close stops the plugin, if it has been started
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.in == nil {
+		return nil
+	}
+	err := h.in.Close()
+	h.in, h.out = nil, nil
+	if h.cmd != nil {
+		if werr := h.cmd.Wait(); err == nil {
+			err = werr
+		}
+		h.cmd = nil
+	}
+	return errors.Wrapf(err, "could not stop plugin %v", h.name)
+}
@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/controller"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/test/fake"
+)
+
+// serve the handler as plugin in-process and return
+// a handler that is connected to it
+func serve(h controller.PackageHandler) *Handler {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	go func() {
+		_ = Serve(h, reqR, respW)
+		respW.Close()
+	}()
+	p := New("fake", "")
+	p.start = func() (io.WriteCloser, io.Reader, error) {
+		return reqW, respR, nil
+	}
+	return p
+}
+
+// collectionHandler reports the packages that fail to install
+// as collection.Error, like most handlers do
+type collectionHandler struct {
+	*fake.Handler
+}
+
+func (h collectionHandler) Install(pkgs ...string) (*handlers.Result, error) {
+	res, err := h.Handler.Install(pkgs...)
+	if err == nil {
+		return res, nil
+	}
+	var cerr collection.Error
+	for _, pkg := range pkgs {
+		for _, f := range h.Fail {
+			if pkg == f {
+				cerr.Add(pkg, errors.New("could not install "+pkg))
+			}
+		}
+	}
+	return res, cerr.IfNotEmpty()
+}
+
+// operator executes the operations of a handler
+type operator interface {
+	Install(...string) (*handlers.Result, error)
+	Remove(...string) (*handlers.Result, error)
+	Upgrade(...string) (*handlers.Result, error)
+}
+
+// TestConformance executes the same operations on a handler directly
+// and through the protocol, the results have to be the same
+func TestConformance(t *testing.T) {
+	is := is.New(t)
+
+	direct := &fake.Handler{Fail: []string{"bad", "worse"}}
+	served := &fake.Handler{Fail: []string{"bad", "worse"}}
+	p := serve(collectionHandler{served})
+	defer p.Close()
+
+	is.NoErr(direct.Init(fake.DefaultSettingsRaw, fake.DefaultPackagesRaw))
+	is.NoErr(p.Init(fake.DefaultSettingsRaw, fake.DefaultPackagesRaw))
+	is.Equal(direct.Config, served.Config)
+	is.Equal(direct.Packages, served.Packages)
+
+	// the journal is not transferred, plugins roll back themselves
+	withoutJournal := func(res *handlers.Result) *handlers.Result {
+		if res != nil {
+			res.Journal = nil
+		}
+		return res
+	}
+	// the error messages by package, the order of the
+	// packages in the message of a collection.Error is random
+	errStrings := func(err error) map[string]string {
+		if err == nil {
+			return nil
+		}
+		cerr, ok := err.(*collection.Error)
+		if !ok {
+			return map[string]string{"": err.Error()}
+		}
+		msgs := make(map[string]string)
+		for name, err := range *cerr {
+			msgs[name] = err.Error()
+		}
+		return msgs
+	}
+
+	operations := []struct {
+		name string
+		op   func(operator) (*handlers.Result, error)
+	}{
+		{"install", func(h operator) (*handlers.Result, error) {
+			return h.Install("one", "two@2.0.0")
+		}},
+		{"partially failing install", func(h operator) (*handlers.Result, error) {
+			return h.Install("bad", "three", "worse")
+		}},
+		{"upgrade", func(h operator) (*handlers.Result, error) {
+			return h.Upgrade("one")
+		}},
+		{"upgrade all", func(h operator) (*handlers.Result, error) {
+			return h.Upgrade()
+		}},
+		{"remove", func(h operator) (*handlers.Result, error) {
+			return h.Remove("three")
+		}},
+		{"failing remove", func(h operator) (*handlers.Result, error) {
+			return h.Remove("missing")
+		}},
+	}
+	for _, o := range operations {
+		t.Run(o.name, func(t *testing.T) {
+			is := is.New(t)
+			want, wantErr := o.op(collectionHandler{direct})
+			got, gotErr := o.op(p)
+			_, wantCollection := wantErr.(*collection.Error)
+			_, gotCollection := gotErr.(*collection.Error)
+			is.Equal(wantCollection, gotCollection)
+			is.Equal(errStrings(wantErr), errStrings(gotErr))
+			is.Equal(withoutJournal(want), got)
+			is.Equal(direct.Packages, served.Packages)
+			is.Equal(direct.Installed, served.Installed)
+		})
+	}
+
+	_, err := p.List()
+	is.True(err != nil) // the fake handler cannot list packages
+}
+
+func TestExec(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	// a plugin that answers every request with its packages
+	script := `#!/bin/sh
+id=0
+while read -r line; do
+	id=$((id+1))
+	echo '{"id": '$id', "result": {"installed": {"pkg": "1.0.0"}}}'
+done
+`
+	is.NoErr(ioutil.WriteFile(filepath.Join(dir, Prefix+"script"), []byte(script), 0755))
+	is.NoErr(ioutil.WriteFile(filepath.Join(dir, Prefix+"notexecutable"), []byte(script), 0644))
+	is.NoErr(ioutil.WriteFile(filepath.Join(dir, "other"), []byte(script), 0755))
+	is.NoErr(os.Mkdir(filepath.Join(dir, Prefix+"dir"), 0755))
+
+	plugins := Discover(filepath.Join(dir, "missing"), dir)
+	is.Equal(map[string]string{"script": filepath.Join(dir, Prefix+"script")}, plugins)
+
+	p := New("script", plugins["script"])
+	settings := json.RawMessage(`{}`)
+	is.NoErr(p.Init(&settings, nil))
+	installed, err := p.List()
+	is.NoErr(err)
+	is.Equal(map[string]string{"pkg": "1.0.0"}, installed)
+	is.NoErr(p.Close())
+	is.NoErr(p.Close()) // closing twice is a no-op
+}
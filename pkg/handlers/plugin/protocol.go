@@ -0,0 +1,185 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/controller"
+	"github.com/tommyknows/packa/pkg/handlers"
+)
+
+// Methods of the protocol
+const (
+	MethodInit    = "init"
+	MethodInstall = "install"
+	MethodRemove  = "remove"
+	MethodUpgrade = "upgrade"
+	MethodList    = "list"
+)
+
+// Request to a plugin. Requests are written to the plugin's stdin
+// as JSON, one request per line.
+type Request struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response of a plugin to the request with the same ID. Responses are
+// written to the plugin's stdout as JSON, one response per line. A
+// response may contain a result and an error if an operation failed
+// for some packages only.
+type Response struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// Error of a request. If the operation failed for some packages
+// only, Packages contains the error message of each of them.
+type Error struct {
+	Message  string            `json:"message"`
+	Packages map[string]string `json:"packages,omitempty"`
+}
+
+// InitParams are the parameters of the init method, the settings
+// and packages of the handler in the config
+type InitParams struct {
+	Settings *json.RawMessage `json:"settings"`
+	Packages *json.RawMessage `json:"packages"`
+}
+
+// PackagesParams are the parameters of the install, remove and
+// upgrade methods
+type PackagesParams struct {
+	Packages []string `json:"packages"`
+}
+
+// Result of the install, remove and upgrade methods,
+// see handlers.Result
+type Result struct {
+	Packages *json.RawMessage            `json:"packages,omitempty"`
+	Resolved map[string]string           `json:"resolved,omitempty"`
+	Removed  []string                    `json:"removed,omitempty"`
+	Outcomes map[string]handlers.Outcome `json:"outcomes,omitempty"`
+}
+
+// ListResult is the result of the list method, the packages that
+// are installed on the system and their versions
+type ListResult struct {
+	Installed map[string]string `json:"installed"`
+}
+
+// Lister is an optional interface for handlers that are served as
+// plugin. List returns the installed packages and their versions.
+type Lister interface {
+	List() (map[string]string, error)
+}
+
+// Serve the handler as plugin, reading requests from in and writing
+// the responses to out until in is closed. Plugins must not write
+// anything else to out, output should go to stderr instead, see
+// output.Set.
+func Serve(h controller.PackageHandler, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, maxMessageSize)
+	enc := json.NewEncoder(out)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return errors.Wrapf(err, "could not parse request")
+		}
+		result, err := handle(h, req)
+		resp := Response{ID: req.ID}
+		if result != nil {
+			data, merr := json.Marshal(result)
+			if merr != nil {
+				err = merr
+			}
+			resp.Result = data
+		}
+		if err != nil {
+			resp.Error = newError(err)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return errors.Wrapf(err, "could not write response")
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "could not read request")
+}
+
+// newError returns the error of a response for err, with the error of
+// each package if err is a collection.Error
+func newError(err error) *Error {
+	e := &Error{Message: err.Error()}
+	var cerr collection.Error
+	switch c := errors.Cause(err).(type) {
+	case *collection.Error:
+		cerr = *c
+	case collection.Error:
+		cerr = c
+	}
+	for name, err := range cerr {
+		if e.Packages == nil {
+			e.Packages = make(map[string]string, len(cerr))
+		}
+		e.Packages[name] = err.Error()
+	}
+	return e
+}
+
+// err returns the error as collection.Error if it contains the
+// error of each package, or as plain error otherwise
+func (e *Error) err() error {
+	if len(e.Packages) == 0 {
+		return errors.New(e.Message)
+	}
+	var cerr collection.Error
+	for name, msg := range e.Packages {
+		cerr.Add(name, errors.New(msg))
+	}
+	return cerr.IfNotEmpty()
+}
+
+// maxMessageSize is the maximum size of a request or response
+const maxMessageSize = 16 * 1024 * 1024
+
+// handle the request with the handler and return its result
+func handle(h controller.PackageHandler, req Request) (interface{}, error) {
+	switch req.Method {
+	case MethodInit:
+		var p InitParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, errors.Wrapf(err, "invalid parameters")
+		}
+		return nil, h.Init(p.Settings, p.Packages)
+	case MethodInstall, MethodRemove, MethodUpgrade:
+		var p PackagesParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &p); err != nil {
+				return nil, errors.Wrapf(err, "invalid parameters")
+			}
+		}
+		op := map[string]func(...string) (*handlers.Result, error){
+			MethodInstall: h.Install,
+			MethodRemove:  h.Remove,
+			MethodUpgrade: h.Upgrade,
+		}[req.Method]
+		res, err := op(p.Packages...)
+		if res == nil {
+			return nil, err
+		}
+		return Result{Packages: res.Packages, Resolved: res.Resolved, Removed: res.Removed, Outcomes: res.Outcomes}, err
+	case MethodList:
+		l, ok := h.(Lister)
+		if !ok {
+			return nil, errors.New("the handler cannot list installed packages")
+		}
+		installed, err := l.List()
+		return ListResult{installed}, err
+	}
+	return nil, errors.Errorf("unknown method %v", req.Method)
+}
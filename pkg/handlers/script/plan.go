@@ -0,0 +1,56 @@
+package script
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/tommyknows/packa/pkg/handlers"
+)
+
+// CanPlan reports whether the handler can be planned, which
+// needs the list command to know the installed packages
+func (h *Handler) CanPlan() bool {
+	_, ok := h.commands["list"]
+	return ok
+}
+
+// Plan compares the packages in the index with the packages that the
+// list command prints and returns the changes that an install would
+// make. Packages that are not installed are installed, pinned packages
+// that are installed at another version are installed at the pinned
+// version. Installed packages that are not in the index are returned
+// as removals. Unpinned packages are not upgraded, as the handler
+// cannot tell whether a newer version exists.
+func (h *Handler) Plan() ([]handlers.Change, error) {
+	if !h.CanPlan() {
+		return nil, errors.Errorf("handler %v has no list command", h.name)
+	}
+	installed, err := h.list()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list installed packages")
+	}
+
+	var changes []handlers.Change
+	indexed := make(map[string]bool)
+	for _, p := range h.Packages {
+		indexed[p.Name] = true
+		switch v, ok := installed[p.Name]; {
+		case !ok:
+			changes = append(changes, handlers.Change{Action: handlers.ActionInstall, Package: p.String(), To: p.Version})
+		case p.Version != "" && v != p.Version:
+			changes = append(changes, handlers.Change{Action: handlers.ActionInstall, Package: p.String(), From: v, To: p.Version})
+		}
+	}
+
+	var unlisted []string
+	for name := range installed {
+		if !indexed[name] {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		changes = append(changes, handlers.Change{Action: handlers.ActionRemove, Package: name, From: installed[name]})
+	}
+	return changes, nil
+}
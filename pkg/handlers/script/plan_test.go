@@ -0,0 +1,41 @@
+package script
+
+import (
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+)
+
+func TestPlan(t *testing.T) {
+	is := is.New(t)
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+	h.Packages = []Package{{"one", ""}, {"missing", ""}, {"pinned", "1.0.0"}, {"two", "2.1.0"}}
+
+	is.True(h.CanPlan())
+	changes, err := h.Plan()
+	is.NoErr(err)
+	is.Equal([]handlers.Change{
+		{Action: handlers.ActionInstall, Package: "missing"},
+		{Action: handlers.ActionInstall, Package: "pinned@1.0.0", To: "1.0.0"},
+		{Action: handlers.ActionInstall, Package: "two@2.1.0", From: "2.0.0", To: "2.1.0"},
+	}, changes)
+
+	// unlisted packages are removed
+	h.Packages = nil
+	changes, err = h.Plan()
+	is.NoErr(err)
+	is.Equal([]handlers.Change{
+		{Action: handlers.ActionRemove, Package: "one", From: "1.0.0"},
+		{Action: handlers.ActionRemove, Package: "two", From: "2.0.0"},
+	}, changes)
+
+	// without a list command, the handler cannot be planned
+	h, err = New("test", Definition{Install: "true", Remove: "true"})
+	is.NoErr(err)
+	is.True(!h.CanPlan())
+	_, err = h.Plan()
+	is.True(err != nil)
+}
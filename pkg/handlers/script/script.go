@@ -0,0 +1,377 @@
+// Package script implements handlers that are defined in the config by
+// the shell commands that install, remove, upgrade and list packages.
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tommyknows/packa/pkg/cmd"
+	"github.com/tommyknows/packa/pkg/collection"
+	"github.com/tommyknows/packa/pkg/handlers"
+	"github.com/tommyknows/packa/pkg/output"
+	"k8s.io/klog"
+)
+
+// Definition of a handler by its commands. The commands are templates
+// that are executed with a Package and then run with "sh -c".
+type Definition struct {
+	// Description of the handler, shown in its help
+	Description string `json:"description,omitempty"`
+	// Install installs a package, e.g.
+	// cargo install {{.Name}}{{if .Version}} --version {{.Version}}{{end}}
+	Install string `json:"install"`
+	// Remove removes a package
+	Remove string `json:"remove"`
+	// Upgrade upgrades a package, Install is used if empty
+	Upgrade string `json:"upgrade,omitempty"`
+	// List prints the installed packages, one per line with the name
+	// and version separated by whitespace. It is executed without a
+	// package and used to resolve the installed versions.
+	List string `json:"list,omitempty"`
+}
+
+// Handler executes the commands of a Definition
+type Handler struct {
+	Config   configuration
+	Packages []Package
+	name     string
+	def      Definition
+	commands map[string]*template.Template
+}
+
+type configuration struct {
+	// WorkingDir is the directory that the commands are executed in
+	WorkingDir         string `json:"workingDir,omitempty"`
+	PrintCommandOutput bool   `json:"printCommandOutput,omitempty"`
+}
+
+// Package in the index. Packages with a version are pinned and
+// are not upgraded when all packages are upgraded.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func (p Package) String() string {
+	if p.Version == "" {
+		return p.Name
+	}
+	return p.Name + "@" + p.Version
+}
+
+// parse name[@version]. Names may start with an @, e.g. scoped
+// npm packages.
+func parse(pkg string) Package {
+	if i := strings.LastIndex(pkg, "@"); i > 0 {
+		return Package{Name: pkg[:i], Version: pkg[i+1:]}
+	}
+	return Package{Name: pkg}
+}
+
+// templateFuncs are available in the commands
+var templateFuncs = template.FuncMap{
+	// quote the string for the shell
+	"quote": func(s string) string {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	},
+}
+
+// New returns the handler with the name, defined by def
+func New(name string, def Definition) (*Handler, error) {
+	h := &Handler{name: name, def: def, commands: make(map[string]*template.Template)}
+	if def.Upgrade == "" {
+		def.Upgrade = def.Install
+	}
+	for action, command := range map[string]string{
+		"install": def.Install,
+		"remove":  def.Remove,
+		"upgrade": def.Upgrade,
+		"list":    def.List,
+	} {
+		if command == "" {
+			if action != "list" {
+				return nil, errors.Errorf("handler %v has no %v command", name, action)
+			}
+			continue
+		}
+		t, err := template.New(action).Funcs(templateFuncs).Option("missingkey=error").Parse(command)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %v command of handler %v", action, name)
+		}
+		h.commands[action] = t
+	}
+	return h, nil
+}
+
+// Name of the handler
+func (h *Handler) Name() string {
+	return h.name
+}
+
+// Command of the handler
+func (h *Handler) Command() *cobra.Command {
+	long := h.def.Description
+	if long == "" {
+		long = h.name + " is defined in the config."
+	}
+	return &cobra.Command{
+		Use:   h.name + " <action> [packages]",
+		Short: "HANDLER: " + h.name + " packages",
+		Long: long + `
+
+Packages are given as name[@version]. Packages with a version are pinned
+and not upgraded when all packages are upgraded.`,
+	}
+}
+
+// Schema of the settings and packages
+func (h *Handler) Schema() handlers.Schema {
+	return handlers.Schema{
+		Settings: json.RawMessage(`{
+			"type": "object",
+			"additionalProperties": false,
+			"properties": {
+				"workingDir": {"type": "string"},
+				"printCommandOutput": {"type": "boolean"}
+			}
+		}`),
+		Package: json.RawMessage(`{
+			"type": "object",
+			"additionalProperties": false,
+			"required": ["name"],
+			"properties": {
+				"name": {"type": "string"},
+				"version": {"type": "string"}
+			}
+		}`),
+	}
+}
+
+// PackageID identifies a package by its name
+func (h *Handler) PackageID(pkg json.RawMessage) (string, error) {
+	var p Package
+	if err := json.Unmarshal(pkg, &p); err != nil {
+		return "", errors.Wrapf(err, "could not parse package %s", pkg)
+	}
+	return p.Name, nil
+}
+
+// Pinned reports whether the package is pinned to a version, see
+// controller.PinChecker
+func (h *Handler) Pinned(pkg json.RawMessage) bool {
+	var p Package
+	return json.Unmarshal(pkg, &p) == nil && p.Version != ""
+}
+
+// Init the handler with its settings and packages
+func (h *Handler) Init(config *json.RawMessage, packages *json.RawMessage) error {
+	if config != nil {
+		if err := json.Unmarshal([]byte(*config), &h.Config); err != nil {
+			return errors.Wrapf(err, "could not parse config %s", config)
+		}
+	}
+	if packages != nil {
+		if err := json.Unmarshal([]byte(*packages), &h.Packages); err != nil {
+			return errors.Wrapf(err, "could not parse packages %s", packages)
+		}
+		klog.V(4).Infof("%v: added package list %v", h.name, h.Packages)
+	}
+	return nil
+}
+
+// Install the packages and add them to the index, or install all
+// packages in the index if none are given
+func (h *Handler) Install(pkgs ...string) (*handlers.Result, error) {
+	if len(pkgs) == 0 {
+		for _, p := range h.Packages {
+			pkgs = append(pkgs, p.String())
+		}
+	}
+	res, done, err := h.do("install", pkgs, func(j *handlers.Journal, p Package) {
+		j.Record("install "+p.String(), func() error {
+			return h.run(nil, "remove", p)
+		})
+		h.index(p)
+	})
+	return h.resolve(res, done), err
+}
+
+// Remove the packages from the system and the index
+func (h *Handler) Remove(pkgs ...string) (*handlers.Result, error) {
+	res, done, err := h.do("remove", pkgs, func(j *handlers.Journal, p Package) {
+		for i := range h.Packages {
+			if h.Packages[i].Name == p.Name {
+				old := h.Packages[i]
+				j.Record("remove "+p.Name, func() error {
+					return h.run(nil, "install", old)
+				})
+				h.Packages = append(h.Packages[:i], h.Packages[i+1:]...)
+				break
+			}
+		}
+	})
+	for _, p := range done {
+		res.Removed = append(res.Removed, p.Name)
+	}
+	return res, err
+}
+
+// Upgrade the packages, or all packages in the index that are not
+// pinned if none are given. Packages that are upgraded with a
+// version are pinned to it, without a version they are unpinned.
+func (h *Handler) Upgrade(pkgs ...string) (*handlers.Result, error) {
+	var pinned []Package
+	if len(pkgs) == 0 {
+		for _, p := range h.Packages {
+			if p.Version == "" {
+				pkgs = append(pkgs, p.Name)
+			} else {
+				pinned = append(pinned, p)
+			}
+		}
+	}
+	res, done, err := h.do("upgrade", pkgs, func(_ *handlers.Journal, p Package) {
+		h.index(p)
+	})
+	if res != nil {
+		for _, p := range pinned {
+			res.Outcomes[p.Name] = handlers.OutcomePinned
+		}
+	}
+	return h.resolve(res, done), err
+}
+
+// actions and how they are logged
+var actions = map[string][2]string{
+	"install": {"Installing", "Installed"},
+	"remove":  {"Removing", "Removed"},
+	"upgrade": {"Upgrading", "Upgraded"},
+}
+
+// outcomes of the actions, the handler cannot tell whether an
+// upgrade changed a package
+var outcomes = map[string]handlers.Outcome{
+	"install": handlers.OutcomeInstalled,
+	"remove":  handlers.OutcomeRemoved,
+	"upgrade": handlers.OutcomeUpgraded,
+}
+
+// do runs the command of the action for every package and calls done
+// for the packages that succeeded. Continues with the other packages
+// if one fails. Returns the packages that succeeded.
+func (h *Handler) do(action string, pkgs []string, done func(*handlers.Journal, Package)) (*handlers.Result, []Package, error) {
+	journal := &handlers.Journal{}
+	res := &handlers.Result{Journal: journal, Outcomes: make(map[string]handlers.Outcome)}
+	var succeeded []Package
+	var cerr collection.Error
+	for _, pkg := range pkgs {
+		p := parse(pkg)
+		op := output.NewOperation(h.name, action, p.Name, p.Version)
+		op.Start("📦 %v\t%v Package %v", h.name, actions[action][0], p)
+		if err := h.run(op, action, p); err != nil {
+			cerr.Add(pkg, op.Fail(err))
+			continue
+		}
+		done(journal, p)
+		succeeded = append(succeeded, p)
+		res.Outcomes[p.Name] = outcomes[action]
+		op.Succeed("📦 %v\t%v Package %v", h.name, actions[action][1], p)
+	}
+
+	list, err := json.Marshal(h.Packages)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := json.RawMessage(list)
+	res.Packages = &raw
+	return res, succeeded, cerr.IfNotEmpty()
+}
+
+// resolve the installed versions of the packages with the list command.
+// Without a list command, only the versions of pinned packages are known.
+func (h *Handler) resolve(res *handlers.Result, pkgs []Package) *handlers.Result {
+	if res == nil || len(pkgs) == 0 {
+		return res
+	}
+	res.Resolved = make(map[string]string)
+	installed, err := h.list()
+	if err != nil {
+		output.Warn("could not resolve installed versions: %v", err)
+	}
+	for _, p := range pkgs {
+		switch v, ok := installed[p.Name]; {
+		case ok:
+			res.Resolved[p.Name] = v
+		case p.Version != "":
+			res.Resolved[p.Name] = p.Version
+		}
+	}
+	return res
+}
+
+// list returns the installed packages and their versions, nil
+// if there is no list command
+func (h *Handler) list() (map[string]string, error) {
+	t, ok := h.commands["list"]
+	if !ok {
+		return nil, nil
+	}
+	out, err := h.execute(nil, t, Package{})
+	if err != nil {
+		return nil, err
+	}
+	installed := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch len(fields) {
+		case 0:
+		case 1:
+			installed[fields[0]] = ""
+		default:
+			installed[fields[0]] = fields[1]
+		}
+	}
+	return installed, scanner.Err()
+}
+
+// run the command of the action for the package
+func (h *Handler) run(op *output.Operation, action string, p Package) error {
+	_, err := h.execute(op, h.commands[action], p)
+	return err
+}
+
+// execute the command template for the package with sh, printing
+// its output as output of the operation, which may be nil
+func (h *Handler) execute(op *output.Operation, t *template.Template, p Package) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, p); err != nil {
+		return "", errors.Wrapf(err, "could not render %v command", t.Name())
+	}
+	command := b.String()
+	klog.V(3).Infof("%v: executing %v", h.name, command)
+
+	opts := []cmd.Option{cmd.DirectPrintOperation(bool(klog.V(5)) || h.Config.PrintCommandOutput, op, "📦 "+h.name+"\t")}
+	if h.Config.WorkingDir != "" {
+		opts = append(opts, cmd.WorkingDir(h.Config.WorkingDir))
+	}
+	out, err := cmd.Execute([]string{"sh", "-c", command}, opts...)
+	return out, errors.Wrapf(err, "%v failed: %v", command, strings.TrimSpace(out))
+}
+
+// index adds the package to the index or updates its version
+func (h *Handler) index(p Package) {
+	for i := range h.Packages {
+		if h.Packages[i].Name == p.Name {
+			h.Packages[i].Version = p.Version
+			return
+		}
+	}
+	h.Packages = append(h.Packages, p)
+}
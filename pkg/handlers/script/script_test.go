@@ -0,0 +1,127 @@
+package script
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tommyknows/packa/pkg/handlers"
+)
+
+// newTestHandler returns a handler whose commands write to a log in a
+// temporary directory and that lists the packages in the file installed
+func newTestHandler(t *testing.T) (*Handler, string) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "")
+	is.NoErr(err)
+	h, err := New("test", Definition{
+		Install: `test {{.Name}} != bad && echo install {{.Name}}{{if .Version}} {{.Version}}{{end}} >> log`,
+		Remove:  `echo remove {{quote .Name}} >> log`,
+		List:    `cat installed`,
+	})
+	is.NoErr(err)
+	cfg := json.RawMessage(`{"workingDir": "` + dir + `"}`)
+	is.NoErr(h.Init(&cfg, nil))
+	is.NoErr(ioutil.WriteFile(filepath.Join(dir, "installed"), []byte("one 1.0.0\ntwo 2.0.0\n"), 0644))
+	return h, dir
+}
+
+func readLog(t *testing.T, dir string) []string {
+	is := is.New(t)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	is.NoErr(err)
+	is.NoErr(os.Remove(filepath.Join(dir, "log")))
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		def   Definition
+		isErr bool
+	}{
+		"complete":   {Definition{Install: "true", Remove: "true", Upgrade: "true", List: "true"}, false},
+		"minimal":    {Definition{Install: "true", Remove: "true"}, false},
+		"no install": {Definition{Remove: "true"}, true},
+		"no remove":  {Definition{Install: "true"}, true},
+		"invalid":    {Definition{Install: "{{.Name", Remove: "true"}, true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			_, err := New("test", tt.def)
+			is.Equal(tt.isErr, err != nil)
+		})
+	}
+}
+
+func TestInstall(t *testing.T) {
+	is := is.New(t)
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+
+	res, err := h.Install("one", "bad", "two@2.0.0")
+	is.True(err != nil) // bad fails to install
+	is.Equal([]string{"install one", "install two 2.0.0"}, readLog(t, dir))
+	is.Equal([]Package{{"one", ""}, {"two", "2.0.0"}}, h.Packages)
+	is.Equal(map[string]string{"one": "1.0.0", "two": "2.0.0"}, res.Resolved)
+	is.Equal(`[{"name":"one"},{"name":"two","version":"2.0.0"}]`, string(*res.Packages))
+
+	// the journal removes the installed packages again
+	is.NoErr(res.Journal.Rollback())
+	is.Equal([]string{"remove two", "remove one"}, readLog(t, dir))
+
+	// installs all packages in the index
+	_, err = h.Install()
+	is.NoErr(err)
+	is.Equal([]string{"install one", "install two 2.0.0"}, readLog(t, dir))
+}
+
+func TestRemove(t *testing.T) {
+	is := is.New(t)
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+	h.Packages = []Package{{"one", ""}, {"two", "2.0.0"}}
+
+	res, err := h.Remove("two")
+	is.NoErr(err)
+	is.Equal([]string{"remove two"}, readLog(t, dir))
+	is.Equal([]Package{{"one", ""}}, h.Packages)
+	is.Equal([]string{"two"}, res.Removed)
+
+	// the journal installs the removed version again
+	is.NoErr(res.Journal.Rollback())
+	is.Equal([]string{"install two 2.0.0"}, readLog(t, dir))
+}
+
+func TestUpgrade(t *testing.T) {
+	is := is.New(t)
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+	h.Packages = []Package{{"one", ""}, {"two", "2.0.0"}}
+
+	// pinned packages are not upgraded, install is used without upgrade command
+	res, err := h.Upgrade()
+	is.NoErr(err)
+	is.Equal([]string{"install one"}, readLog(t, dir))
+	is.Equal(map[string]string{"one": "1.0.0"}, res.Resolved)
+	is.Equal(map[string]handlers.Outcome{"one": handlers.OutcomeUpgraded, "two": handlers.OutcomePinned}, res.Outcomes)
+
+	// upgrading with a version pins the package
+	_, err = h.Upgrade("one@1.1.0", "two")
+	is.NoErr(err)
+	is.Equal([]string{"install one 1.1.0", "install two"}, readLog(t, dir))
+	is.Equal([]Package{{"one", "1.1.0"}, {"two", ""}}, h.Packages)
+}
+
+func TestParse(t *testing.T) {
+	is := is.New(t)
+	is.Equal(Package{"ripgrep", ""}, parse("ripgrep"))
+	is.Equal(Package{"ripgrep", "12.1.1"}, parse("ripgrep@12.1.1"))
+	is.Equal(Package{"@scope/pkg", "1.0.0"}, parse("@scope/pkg@1.0.0"))
+	is.Equal(Package{"@scope/pkg", ""}, parse("@scope/pkg"))
+}
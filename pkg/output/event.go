@@ -0,0 +1,214 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Format that the output is rendered in
+type Format string
+
+const (
+	// Text is human-readable, colored text
+	Text Format = "text"
+	// JSON renders every message and event as a JSON object,
+	// one per line
+	JSON Format = "json"
+)
+
+var format = Text
+
+// SetFormat sets the format of all further output, text or json
+func SetFormat(f string) error {
+	switch Format(f) {
+	case Text, JSON:
+		format = Format(f)
+		return nil
+	}
+	return errors.Errorf("unknown output format %v, use text or json", f)
+}
+
+// GetFormat returns the format that the output is rendered in
+func GetFormat() Format {
+	return format
+}
+
+// Kind of an event
+type Kind string
+
+const (
+	// Started operations have not finished yet
+	Started Kind = "started"
+	// Succeeded operations have finished successfully
+	Succeeded Kind = "succeeded"
+	// Skipped operations have not been executed, e.g. as
+	// the package is pinned
+	Skipped Kind = "skipped"
+	// Failed operations have finished with an error
+	Failed Kind = "failed"
+	// Output of a command that an operation executes
+	Output Kind = "output"
+	// Message is a message that is not part of an
+	// operation, see Info, Success, Warn and Error
+	Message Kind = "message"
+	// Summary is the outcome of the operations on a package at
+	// the end of a run, see Summarise
+	Summary Kind = "summary"
+)
+
+// Event is emitted for the operations on packages, their command
+// output and messages. In text output, only the message is printed.
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind Kind      `json:"kind"`
+	// Level of messages: info, success, warn or error
+	Level     string `json:"level,omitempty"`
+	Handler   string `json:"handler,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	Package   string `json:"package,omitempty"`
+	Version   string `json:"version,omitempty"`
+	// Duration of finished operations in seconds
+	Duration float64 `json:"duration,omitempty"`
+	// Stream of command output, stdout or stderr
+	Stream string `json:"stream,omitempty"`
+	// Outcome of a package in the summary
+	Outcome string `json:"outcome,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// emit the event as JSON to stdout
+func emit(e Event) {
+	e.Time = now()
+	data, err := json.Marshal(e)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"kind": "message", "level": "error", "message": %q}`, err.Error()))
+	}
+	write(stdout, string(data)+"\n")
+}
+
+// now returns the time of events, can be replaced in tests
+var now = time.Now
+
+// message prints the message in text format with style, or emits
+// it as event of the level
+func message(level string, w io.Writer, style func(string) string, format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	if GetFormat() == JSON {
+		emit(Event{Kind: Message, Level: level, Message: s})
+		return
+	}
+	write(w, style(s+"\n"))
+}
+
+// Operation on a package, e.g. an installation. It emits events when
+// it starts and ends, and for the output of the commands it executes.
+type Operation struct {
+	event Event
+	start time.Time
+}
+
+// NewOperation returns the operation of the handler on the package
+func NewOperation(handler, operation, pkg, version string) *Operation {
+	return &Operation{
+		event: Event{Handler: handler, Operation: operation, Package: pkg, Version: version},
+		start: now(),
+	}
+}
+
+// Start emits that the operation has started, printed as info
+func (o *Operation) Start(format string, args ...interface{}) {
+	o.start = now()
+	o.emit(Started, "", fmt.Sprintf(format, args...), Info)
+}
+
+// Succeed emits that the operation has succeeded, printed as success
+func (o *Operation) Succeed(format string, args ...interface{}) {
+	o.emit(Succeeded, "", fmt.Sprintf(format, args...), Success)
+}
+
+// Skip emits that the operation has been skipped, printed as warning
+func (o *Operation) Skip(format string, args ...interface{}) {
+	o.emit(Skipped, "", fmt.Sprintf(format, args...), Warn)
+}
+
+// Fail emits that the operation has failed and returns err. The failure
+// is not printed as text, as the error is reported by the caller.
+func (o *Operation) Fail(err error) error {
+	if err != nil {
+		o.emit(Failed, err.Error(), "", nil)
+	}
+	return err
+}
+
+func (o *Operation) emit(kind Kind, err, msg string, print func(string, ...interface{})) {
+	if GetFormat() != JSON {
+		if print != nil {
+			print("%s", msg)
+		}
+		return
+	}
+	e := o.event
+	e.Kind, e.Error, e.Message = kind, err, msg
+	if kind != Started {
+		e.Duration = now().Sub(o.start).Seconds()
+	}
+	emit(e)
+}
+
+// Output returns a writer for the output of a command that the
+// operation executes, to stdout or to stderr if toStderr is true. As
+// text, the prefix is added to every line, see LineWriter. It has to
+// be closed once the command has exited. The operation may be nil for
+// output that is not part of an operation.
+func (o *Operation) Output(prefix string, toStderr bool) io.WriteCloser {
+	w := &lineWriter{prefix: prefix, stderr: toStderr}
+	if o != nil {
+		w.event = o.event
+	}
+	return w
+}
+
+// events emits every line of p as output event
+func (w *lineWriter) events(p []byte) {
+	stream := "stdout"
+	if w.stderr {
+		stream = "stderr"
+	}
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		e := w.event
+		e.Kind, e.Stream, e.Message = Output, stream, strings.TrimSuffix(string(line), "\n")
+		emit(e)
+	}
+}
+
+// Summarise emits the outcome of the operations of the handler on the
+// package as summary event, with the reason if it failed. Nothing is
+// printed as text, the summary is printed as table by the caller.
+func Summarise(handler, pkg, outcome, reason string) {
+	if GetFormat() != JSON {
+		return
+	}
+	emit(Event{Kind: Summary, Handler: handler, Package: pkg, Outcome: outcome, Error: reason})
+}
+
+// Record writes v as JSON object on its own line to stdout, in any
+// format. It is used for output that consists of records in itself,
+// e.g. the status of the packages.
+func Record(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal record")
+	}
+	write(stdout, string(data)+"\n")
+	return nil
+}
@@ -0,0 +1,86 @@
+package output
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestEvents(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	Set(&buf, &buf)
+	defer Set(stdout, stderr)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	seconds := 0
+	now = func() time.Time {
+		seconds++
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	defer func() { now = time.Now }()
+
+	run := func() {
+		op := NewOperation("go", "install", "github.com/tommyknows/packa", "v1.0.0")
+		op.Start("Installing %v", "packa")
+		_, _ = op.Output("📦 GoGet\t", false).Write([]byte("go: downloading\ngo: done\n"))
+		op.Succeed("Installed %v", "packa")
+		is.Equal("failed", NewOperation("go", "remove", "dlv", "").Fail(errors.New("failed")).Error())
+		Warn("%v is pinned", "dlv")
+	}
+
+	is.True(SetFormat("xml") != nil)
+	is.NoErr(SetFormat("json"))
+	defer func() { _ = SetFormat("text") }()
+	run()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	is.Equal([]string{
+		`{"time":"2020-01-01T00:00:03Z","kind":"started","handler":"go","operation":"install","package":"github.com/tommyknows/packa","version":"v1.0.0","message":"Installing packa"}`,
+		`{"time":"2020-01-01T00:00:04Z","kind":"output","handler":"go","operation":"install","package":"github.com/tommyknows/packa","version":"v1.0.0","stream":"stdout","message":"go: downloading"}`,
+		`{"time":"2020-01-01T00:00:05Z","kind":"output","handler":"go","operation":"install","package":"github.com/tommyknows/packa","version":"v1.0.0","stream":"stdout","message":"go: done"}`,
+		`{"time":"2020-01-01T00:00:07Z","kind":"succeeded","handler":"go","operation":"install","package":"github.com/tommyknows/packa","version":"v1.0.0","duration":4,"message":"Installed packa"}`,
+		`{"time":"2020-01-01T00:00:10Z","kind":"failed","handler":"go","operation":"remove","package":"dlv","duration":1,"error":"failed"}`,
+		`{"time":"2020-01-01T00:00:11Z","kind":"message","level":"warn","message":"dlv is pinned"}`,
+	}, lines)
+
+	// as text, only the messages are printed, failures are not
+	buf.Reset()
+	is.NoErr(SetFormat("text"))
+	run()
+	is.True(strings.HasPrefix(buf.String(), "Installing packa\n📦 GoGet\tgo: downloading\n📦 GoGet\tgo: done\n"))
+	is.True(strings.Contains(buf.String(), "Installed packa"))
+	is.True(!strings.Contains(buf.String(), "failed"))
+}
+
+func TestLineWriter(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	Set(&buf, &buf)
+	defer Set(stdout, stderr)
+
+	// lines are printed once they are complete
+	w := LineWriter("> ", false)
+	_, _ = w.Write([]byte("go: down"))
+	is.Equal("", buf.String())
+	_, _ = w.Write([]byte("loading\ngo: do"))
+	is.Equal("> go: downloading\n", buf.String())
+	_, _ = w.Write([]byte("ne"))
+	is.NoErr(w.Close())
+	is.Equal("> go: downloading\n> go: done\n", buf.String())
+
+	// as JSON, a line that is written in parts is a single event
+	is.NoErr(SetFormat("json"))
+	defer func() { _ = SetFormat("text") }()
+	buf.Reset()
+	w = LineWriter("> ", true)
+	_, _ = w.Write([]byte("go: down"))
+	_, _ = w.Write([]byte("loading\n"))
+	is.NoErr(w.Close())
+	is.Equal(1, strings.Count(buf.String(), "\n"))
+	is.True(strings.Contains(buf.String(), `"stream":"stderr","message":"go: downloading"`))
+}
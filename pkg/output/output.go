@@ -2,9 +2,11 @@ package output
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	a "github.com/logrusorgru/aurora"
 )
@@ -12,6 +14,18 @@ import (
 var stdout = io.Writer(os.Stdout)
 var stderr = io.Writer(os.Stderr)
 
+// mu ensures that messages that are printed concurrently
+// do not interleave
+var mu sync.Mutex
+
+var confirmMu sync.Mutex
+
+func write(w io.Writer, s string) {
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprint(w, s)
+}
+
 func Set(out, err io.Writer) {
 	stdout = out
 	stderr = err
@@ -19,37 +33,105 @@ func Set(out, err io.Writer) {
 
 // Info prints an info string to the terminal
 func Info(format string, args ...interface{}) {
-	fmt.Fprintf(stdout, format+"\n", args...)
+	message("info", stdout, func(s string) string { return s }, format, args...)
 }
 
 // Success prints a string as a success message
 // aka bold green
 func Success(format string, args ...interface{}) {
-	s := fmt.Sprintf(format+"\n", args...)
-	fmt.Fprint(stdout, a.Green(s).Bold().String())
+	message("success", stdout, func(s string) string {
+		return a.Green(s).Bold().String()
+	}, format, args...)
 }
 
 // Warn prints a string as a warning to the terminal
 // aka bold yellow
 func Warn(format string, args ...interface{}) {
-	s := fmt.Sprintf(format+"\n", args...)
-	fmt.Fprint(stdout, a.Yellow(s).Bold().String())
+	message("warn", stdout, func(s string) string {
+		return a.Yellow(s).Bold().String()
+	}, format, args...)
 }
 
 // Error prints an error
-// aka bold red
+// aka bold red. As JSON, errors are written to stdout
+// with all other events.
 func Error(format string, args ...interface{}) {
-	s := fmt.Sprintf(format+"\n", args...)
-	fmt.Fprint(stderr, a.Red(s).Bold().String())
+	message("error", stderr, func(s string) string {
+		return a.Red(s).Bold().String()
+	}, format, args...)
 }
 
 // WithConfirmation prints the supplied message as an info
 // and waits for confirmation of the user. The default choice
 // for the confirmation, and thus for the returned boolean, is false
 func WithConfirmation(format string, args ...interface{}) bool {
+	// only ask for one confirmation at a time
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
 	Info(format, args...)
 	reader := bufio.NewReader(os.Stdin)
 	Info("confirm (y/N):")
 	text, _ := reader.ReadString('\n')
 	return text == "y\n" || text == "Y\n"
 }
+
+// LineWriter returns a writer that prints to stdout, or stderr if
+// toStderr is true, and adds the prefix to the start of every line.
+// Lines are printed once they are complete, so that they do not
+// interleave with messages or other writers. Close prints the last
+// line if it has not been terminated. As JSON, every line is emitted
+// as output event, see Operation.Output.
+func LineWriter(prefix string, toStderr bool) io.WriteCloser {
+	return (*Operation)(nil).Output(prefix, toStderr)
+}
+
+type lineWriter struct {
+	prefix string
+	stderr bool
+	// the incomplete last line of the output
+	buf []byte
+	// the event of the operation that the output belongs to
+	event Event
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if i := bytes.LastIndexByte(w.buf, '\n'); i >= 0 {
+		w.print(w.buf[:i+1])
+		w.buf = append([]byte(nil), w.buf[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// Close prints the remaining output, terminated by a newline
+func (w *lineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.print(append(w.buf, '\n'))
+		w.buf = nil
+	}
+	return nil
+}
+
+// print the complete lines in p
+func (w *lineWriter) print(p []byte) {
+	if GetFormat() == JSON {
+		w.events(p)
+		return
+	}
+
+	var b bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		b.WriteString(w.prefix)
+		b.Write(line)
+	}
+
+	out := stdout
+	if w.stderr {
+		out = stderr
+	}
+	write(out, b.String())
+}
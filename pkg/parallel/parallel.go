@@ -0,0 +1,29 @@
+// Package parallel executes functions concurrently
+package parallel
+
+import "sync"
+
+// Do calls f for every index in [0, n), with at most limit calls
+// running concurrently. A limit below 1 is treated as 1, meaning the
+// calls are executed sequentially and in order. Do returns after all
+// calls have returned.
+func Do(n, limit int, f func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
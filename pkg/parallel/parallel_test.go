@@ -0,0 +1,38 @@
+package parallel
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDo(t *testing.T) {
+	is := is.New(t)
+
+	for _, limit := range []int{0, 1, 3, 20} {
+		var mu sync.Mutex
+		var running, maxRunning int
+		done := make([]bool, 10)
+
+		Do(len(done), limit, func(i int) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			done[i] = true
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+
+		for _, d := range done {
+			is.True(d) // every index should have been called
+		}
+		is.True(maxRunning <= limit || maxRunning == 1) // limit should not be exceeded
+	}
+}
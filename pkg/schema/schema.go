@@ -0,0 +1,214 @@
+// Package schema validates configuration values against a subset of
+// JSON Schema: the keywords type, properties, additionalProperties,
+// required, items and enum are supported, all others are ignored.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Schema is a JSON Schema
+type Schema struct {
+	Description string             `json:"description,omitempty"`
+	Type        Types              `json:"type,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	// AdditionalProperties is the schema of properties that are not
+	// defined in Properties. If nil, they are not validated.
+	AdditionalProperties *Schema       `json:"-"`
+	Required             []string      `json:"required,omitempty"`
+	Items                *Schema       `json:"items,omitempty"`
+	Enum                 []interface{} `json:"enum,omitempty"`
+	// set if additionalProperties is false
+	closed bool
+}
+
+// Types that a value may have, one of "object", "array", "string",
+// "boolean", "integer", "number" and "null"
+type Types []string
+
+// UnmarshalJSON allows the type to be a single type or a list of types
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Errorf("type has to be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+// UnmarshalJSON parses the schema, where additionalProperties is
+// either a boolean or a schema
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type schema Schema
+	var raw struct {
+		*schema
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}
+	raw.schema = (*schema)(s)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	switch a := bytes.TrimSpace(raw.AdditionalProperties); {
+	case a == nil, bytes.Equal(a, []byte("true")):
+	case bytes.Equal(a, []byte("false")):
+		s.closed = true
+	default:
+		return errors.Wrapf(json.Unmarshal(a, &s.AdditionalProperties), "invalid additionalProperties")
+	}
+	return nil
+}
+
+// Parse the JSON Schema
+func Parse(raw []byte) (*Schema, error) {
+	s := &Schema{}
+	err := json.Unmarshal(raw, s)
+	return s, errors.Wrapf(err, "could not parse schema")
+}
+
+// Path to a value, consisting of property names and array indices
+type Path []interface{}
+
+func (p Path) String() string {
+	var b strings.Builder
+	for _, e := range p {
+		switch e := e.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%v]", e)
+		default:
+			if b.Len() > 0 {
+				b.WriteString(".")
+			}
+			fmt.Fprintf(&b, "%v", e)
+		}
+	}
+	return b.String()
+}
+
+// append returns a new path, so that paths can be appended
+// to from different branches
+func (p Path) append(e interface{}) Path {
+	return append(p[:len(p):len(p)], e)
+}
+
+// Violation of a schema
+type Violation struct {
+	Path    Path
+	Message string
+}
+
+func (v Violation) Error() string {
+	if len(v.Path) == 0 {
+		return v.Message
+	}
+	return fmt.Sprintf("%v: %v", v.Path, v.Message)
+}
+
+// Validate the JSON value against the schema and return all violations
+func (s *Schema) Validate(raw []byte) ([]Violation, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, errors.Wrapf(err, "could not decode value")
+	}
+	return s.validate(nil, v), nil
+}
+
+func (s *Schema) validate(path Path, v interface{}) []Violation {
+	if s == nil {
+		return nil
+	}
+	if len(s.Type) > 0 && !s.Type.has(typeOf(v)) {
+		return []Violation{{path, fmt.Sprintf("expected %v, got %v", strings.Join(s.Type, " or "), typeOf(v))}}
+	}
+	if len(s.Enum) > 0 && !s.inEnum(v) {
+		return []Violation{{path, fmt.Sprintf("%v is not one of %v", v, s.Enum)}}
+	}
+
+	var violations []Violation
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := v[r]; !ok {
+				violations = append(violations, Violation{path, fmt.Sprintf("missing property %v", r)})
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, ok := s.Properties[k]
+			switch {
+			case ok:
+				violations = append(violations, p.validate(path.append(k), v[k])...)
+			case s.closed:
+				violations = append(violations, Violation{path.append(k), "unknown property"})
+			default:
+				violations = append(violations, s.AdditionalProperties.validate(path.append(k), v[k])...)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			violations = append(violations, s.Items.validate(path.append(i), e)...)
+		}
+	}
+	return violations
+}
+
+func (t Types) has(typ string) bool {
+	for _, e := range t {
+		// integers are numbers, too
+		if e == typ || e == "number" && typ == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) inEnum(v interface{}) bool {
+	for _, e := range s.Enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
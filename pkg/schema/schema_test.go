@@ -0,0 +1,57 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+
+	s, err := Parse([]byte(`{
+		"type": "object",
+		"additionalProperties": false,
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string"},
+			"count": {"type": "integer"},
+			"ratio": {"type": ["number", "null"]},
+			"kind": {"enum": ["a", "b"]},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"labels": {"type": "object", "additionalProperties": {"type": "string"}}
+		}
+	}`))
+	is.NoErr(err)
+
+	tests := []struct {
+		name       string
+		value      string
+		violations []string
+	}{
+		{"valid", `{"name":"x","count":1,"ratio":0.5,"kind":"a","tags":["t"],"labels":{"l":"v"}}`, nil},
+		{"null", `{"name":"x","ratio":null}`, nil},
+		{"wrong type", `{"name":1}`, []string{"name: expected string, got integer"}},
+		{"not an integer", `{"name":"x","count":1.5}`, []string{"count: expected integer, got number"}},
+		{"missing property", `{}`, []string{"missing property name"}},
+		{"unknown property", `{"name":"x","nmae":"y"}`, []string{"nmae: unknown property"}},
+		{"enum", `{"name":"x","kind":"c"}`, []string{"kind: c is not one of [a b]"}},
+		{"items", `{"name":"x","tags":["t",2]}`, []string{"tags[1]: expected string, got integer"}},
+		{"additional properties", `{"name":"x","labels":{"l":true}}`, []string{"labels.l: expected string, got boolean"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			violations, err := s.Validate([]byte(tt.value))
+			is.NoErr(err)
+			var msgs []string
+			for _, v := range violations {
+				msgs = append(msgs, v.Error())
+			}
+			is.Equal(tt.violations, msgs)
+		})
+	}
+
+	_, err = Parse([]byte(`{"type": 1}`))
+	is.True(err != nil)
+}
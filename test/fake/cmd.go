@@ -2,6 +2,7 @@ package fake
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/tommyknows/packa/pkg/cmd"
 )
@@ -28,3 +29,34 @@ func NoOpError(cmds chan []string, output string) func(cmd.Cmd) error {
 		return nil
 	}
 }
+
+// Respond acts the same as NoOp, but prints the output that is defined for
+// the command in responses. The key is the command with all its arguments,
+// joined by spaces. Commands without a response print an empty line.
+func Respond(cmds chan []string, responses map[string]string) func(cmd.Cmd) error {
+	return func(command cmd.Cmd) error {
+		cmds <- command.Args
+		command.Args = []string{"echo", responses[strings.Join(command.Args, " ")]}
+		command.Path = "/bin/echo"
+		return nil
+	}
+}
+
+// Fail acts the same as NoOp with an empty output, but makes the commands
+// in failing exit with a non-zero exit code. The commands are given with
+// all their arguments, joined by spaces.
+func Fail(cmds chan []string, failing ...string) func(cmd.Cmd) error {
+	return func(command cmd.Cmd) error {
+		cmds <- command.Args
+		for _, f := range failing {
+			if f == strings.Join(command.Args, " ") {
+				command.Args = []string{"false"}
+				command.Path = "/bin/false"
+				return nil
+			}
+		}
+		command.Args = []string{"echo"}
+		command.Path = "/bin/echo"
+		return nil
+	}
+}
@@ -39,3 +39,19 @@ func TestNoOpErrorCmd(t *testing.T) {
 	is.True(err != nil)
 	is.Equal([]string{"echo", "hello world"}, <-executedCommand)
 }
+
+func TestRespondCmd(t *testing.T) {
+	is := is.New(t)
+	executedCommand := make(chan []string, 2)
+	responses := map[string]string{"echo hello world": "testoutput"}
+
+	out, err := cmd.Execute([]string{"echo", "hello world"}, Respond(executedCommand, responses))
+	is.Equal("testoutput\n", out) // defined response should be printed
+	is.NoErr(err)
+	is.Equal([]string{"echo", "hello world"}, <-executedCommand)
+
+	out, err = cmd.Execute([]string{"echo", "other"}, Respond(executedCommand, responses))
+	is.Equal("\n", out) // undefined response should print an empty line
+	is.NoErr(err)
+	is.Equal([]string{"echo", "other"}, <-executedCommand)
+}
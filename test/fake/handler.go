@@ -5,11 +5,18 @@ package fake
 import (
 	"encoding/json"
 	"errors"
+	"strings"
+
+	"github.com/tommyknows/packa/pkg/handlers"
 )
 
 type Handler struct {
 	Config
 	Packages []Package
+	// Installed are the packages that are "installed on the system"
+	Installed []Package
+	// Fail contains the packages that fail to install
+	Fail []string
 }
 
 type Config struct {
@@ -52,61 +59,152 @@ func (h *Handler) Init(config *json.RawMessage, packages *json.RawMessage) error
 	return json.Unmarshal([]byte(*packages), &h.Packages)
 }
 
-func (h *Handler) Install(pkgs ...string) (*json.RawMessage, error) {
+// DefaultVersion is the version that packages are installed
+// at if no version has been given
+const DefaultVersion = "1.0.0"
+
+// Install resolves packages without a version to DefaultVersion. Packages
+// can be installed at a specific version with name@version. Installs
+// all other packages if a package fails, and records uninstalling them
+// in the journal.
+func (h *Handler) Install(pkgs ...string) (*handlers.Result, error) {
+	resolved := make(map[string]string)
+	journal := &handlers.Journal{}
+	var err error
 	for _, pkg := range pkgs {
+		if h.fails(pkg) {
+			err = errors.New("could not install " + pkg)
+			continue
+		}
+		name, version := pkg, DefaultVersion
+		if i := strings.Index(pkg, "@"); i >= 0 {
+			name, version = pkg[:i], pkg[i+1:]
+		}
 		h.Packages = append(h.Packages, Package{pkg})
+		h.Installed = append(h.Installed, Package{name})
+		resolved[name] = version
+		journal.Record("install "+pkg, func() error {
+			h.Installed, _ = remove(h.Installed, name)
+			return nil
+		})
 	}
-	return h.marshalPackages()
+	res, rerr := h.result(resolved, nil)
+	if rerr != nil {
+		return nil, rerr
+	}
+	res.Journal = journal
+	return res, err
 }
 
-// Remove fails on the first package that has not been found and
-// does not process all packages on failure!
-func (h *Handler) Remove(pkgs ...string) (*json.RawMessage, error) {
+// Remove fails on the first package that has neither been found in
+// the index nor in the installed packages and does not process all
+// packages on failure!
+func (h *Handler) Remove(pkgs ...string) (*handlers.Result, error) {
 	for _, pkg := range pkgs {
-		removed := false
-		for i, p := range h.Packages {
-			if pkg == p.Name {
-				h.Packages = append(h.Packages[:i], h.Packages[i+1:]...)
-				removed = true
-				break
-			}
-		}
-		if !removed {
+		var removed, uninstalled bool
+		h.Packages, removed = remove(h.Packages, pkg)
+		h.Installed, uninstalled = remove(h.Installed, pkg)
+		if !removed && !uninstalled {
 			return nil, errors.New("no package found in index to remove")
 		}
 	}
 
-	return h.marshalPackages()
+	return h.result(nil, pkgs)
 }
 
+func remove(pkgs []Package, name string) ([]Package, bool) {
+	for i, p := range pkgs {
+		if name == p.Name {
+			return append(pkgs[:i], pkgs[i+1:]...), true
+		}
+	}
+	return pkgs, false
+}
+
+// UpgradedVersion is the version that packages are upgraded to
+const UpgradedVersion = "1.1.0"
+
 // Upgrade adds a "+" at the end of the package string
-func (h *Handler) Upgrade(pkgs ...string) (*json.RawMessage, error) {
+func (h *Handler) Upgrade(pkgs ...string) (*handlers.Result, error) {
 	if len(pkgs) == 0 {
 		return h.upgradeAll()
 	}
+	resolved := make(map[string]string)
 	for _, pkg := range pkgs {
 		for i := range h.Packages {
 			if h.Packages[i].Name == pkg {
 				h.Packages[i].Name += "+"
+				resolved[pkg] = UpgradedVersion
 			}
 		}
 	}
-	return h.marshalPackages()
+	return h.result(resolved, nil)
 }
 
-func (h *Handler) upgradeAll() (*json.RawMessage, error) {
+func (h *Handler) upgradeAll() (*handlers.Result, error) {
+	resolved := make(map[string]string)
 	for i := range h.Packages {
+		resolved[h.Packages[i].Name] = UpgradedVersion
 		h.Packages[i].Name += "+"
 	}
-	return h.marshalPackages()
+	return h.result(resolved, nil)
 }
 
-func (h *Handler) marshalPackages() (*json.RawMessage, error) {
+func (h *Handler) result(resolved map[string]string, removed []string) (*handlers.Result, error) {
 	pkgList, err := json.Marshal(h.Packages)
 	if err != nil {
 		return nil, err
 	}
 	rM := json.RawMessage(pkgList)
-	return &rM, nil
+	return &handlers.Result{Packages: &rM, Resolved: resolved, Removed: removed}, nil
+}
 
+// PackageID identifies a package by its name, without the version
+// and the "+" of upgraded packages
+func (h *Handler) PackageID(pkg json.RawMessage) (string, error) {
+	var p Package
+	if err := json.Unmarshal(pkg, &p); err != nil {
+		return "", err
+	}
+	name := strings.TrimRight(p.Name, "+")
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	return name, nil
+}
+
+// Plan returns an install change for every package in the index that
+// is not installed and a remove change for every installed package
+// that is not in the index
+func (h *Handler) Plan() ([]handlers.Change, error) {
+	var changes []handlers.Change
+	for _, p := range h.Packages {
+		if !contains(h.Installed, p.Name) {
+			changes = append(changes, handlers.Change{Action: handlers.ActionInstall, Package: p.Name})
+		}
+	}
+	for _, p := range h.Installed {
+		if !contains(h.Packages, p.Name) {
+			changes = append(changes, handlers.Change{Action: handlers.ActionRemove, Package: p.Name})
+		}
+	}
+	return changes, nil
+}
+
+func (h *Handler) fails(pkg string) bool {
+	for _, f := range h.Fail {
+		if f == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(pkgs []Package, name string) bool {
+	for _, p := range pkgs {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
 }